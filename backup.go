@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var backup backupStorage
+
+type backupStorage interface {
+	Put(cid string, r io.Reader) error
+	Get(cid string) (io.ReadCloser, error)
+}
+
+type fsBackup struct {
+	dir string
+}
+
+func (b fsBackup) path(cid string) string {
+	return filepath.Join(b.dir, filepath.Base(cid)+".car")
+}
+
+func (b fsBackup) Put(cid string, r io.Reader) error {
+	err := os.MkdirAll(b.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a failed export never
+	// replaces a good backup.
+	tmp, err := ioutil.TempFile(b.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), b.path(cid))
+}
+
+func (b fsBackup) Get(cid string) (io.ReadCloser, error) {
+	return os.Open(b.path(cid))
+}
+
+func saveBackup(cid string) error {
+	if backup == nil {
+		return nil
+	}
+
+	car, err := dagExport(cid)
+	if err != nil {
+		return err
+	}
+	defer car.Close()
+
+	return backup.Put(cid, car)
+}
+
+func restoreBackup(cid, name string) error {
+	if backup == nil {
+		return errors.New("no backup storage configured")
+	}
+
+	car, err := backup.Get(cid)
+	if err != nil {
+		return err
+	}
+	defer car.Close()
+
+	err = dagImport(car)
+	if err != nil {
+		return err
+	}
+
+	_, err = pin(context.Background(), cid, name)
+	return err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFsBackup(t *testing.T) {
+	b := fsBackup{filepath.Join(t.TempDir(), "cars")}
+
+	err := b.Put("QmA", strings.NewReader("car of QmA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed export doesn't replace the good backup
+	err = b.Put("QmA", io.MultiReader(strings.NewReader("half a car"), failingReader{}))
+	if err == nil {
+		t.Fatal("Put() of a failing export succeeded")
+	}
+
+	r, err := b.Get("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	car, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(car) != "car of QmA" {
+		t.Fatalf("backup = %q, want the first export", car)
+	}
+
+	// nothing is left behind by the failed one
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files in the backup dir, want 1", len(files))
+	}
+
+	if _, err := b.Get("QmB"); !os.IsNotExist(err) {
+		t.Fatalf("Get() of a missing backup = %v, want not exist", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("node went away")
+}
+
+// memBackup keeps backups in memory, for the rest of the test.
+type memBackup struct {
+	sync.Mutex
+	cars map[string]string
+	puts int
+}
+
+func useMemBackup(t *testing.T) *memBackup {
+	b := &memBackup{cars: make(map[string]string)}
+	saved := backup
+	backup = b
+	t.Cleanup(func() { backup = saved })
+	return b
+}
+
+func (b *memBackup) Put(cid string, r io.Reader) error {
+	car, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.cars[cid] = string(car)
+	b.puts++
+	return nil
+}
+
+func (b *memBackup) Get(cid string) (io.ReadCloser, error) {
+	b.Lock()
+	defer b.Unlock()
+	car, ok := b.cars[cid]
+	if !ok {
+		return nil, errors.New("no backup of " + cid)
+	}
+	return ioutil.NopCloser(strings.NewReader(car)), nil
+}
+
+func TestBackupExportRestore(t *testing.T) {
+	node := useFakeNode(t)
+	backups := useMemBackup(t)
+
+	node.sizes["QmA"] = 1 << 20
+	err := saveBackup("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backups.cars["QmA"] != "car of QmA" {
+		t.Fatalf("backup = %q, want the node's export", backups.cars["QmA"])
+	}
+
+	// the node lost the content, it can only be pinned once imported again
+	delete(node.sizes, "QmA")
+	var imported string
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "dag/import" {
+			body, _ := ioutil.ReadAll(r.Body)
+			imported = string(body)
+			node.Lock()
+			node.sizes["QmA"] = 1 << 20
+			node.Unlock()
+		}
+		return false
+	}
+
+	err = restoreBackup("QmA", "order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(imported, "car of QmA") {
+		t.Fatalf("imported %q, want the backup", imported)
+	}
+	if !node.pinned("QmA") || node.pins["QmA"] != "order1" {
+		t.Fatal("restored content isn't pinned under its name")
+	}
+
+	if err := restoreBackup("QmB", ""); err == nil {
+		t.Fatal("restoreBackup() without a backup succeeded")
+	}
+}
+
+func TestBackupOff(t *testing.T) {
+	saved := backup
+	backup = nil
+	t.Cleanup(func() { backup = saved })
+
+	// nothing to export to, and nothing asked of the node
+	if err := saveBackup("QmA"); err != nil {
+		t.Fatalf("saveBackup() without storage = %v", err)
+	}
+	if err := restoreBackup("QmA", ""); err == nil {
+		t.Fatal("restoreBackup() without storage succeeded")
+	}
+}
+
+func TestRepinMissingFromBackup(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+	backups := useMemBackup(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now(), interval '1 day')
+    `)
+	// gone from the node, only the backup has it
+	backups.cars["QmA"] = "car of QmA"
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "dag/import" {
+			ioutil.ReadAll(r.Body)
+			node.Lock()
+			node.sizes["QmA"] = 1 << 30
+			node.Unlock()
+		}
+		return false
+	}
+
+	err := repinMissing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := node.called("dag/import"); len(got) != 1 {
+		t.Fatalf("dag/import called %d times, want once", len(got))
+	}
+	if !node.pinned("QmA") {
+		t.Fatal("QmA not pinned again")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/c2h5oh/datasize"
+)
+
+var errCapacityFull = errors.New("not enough capacity left on the node")
+
+var reservations struct {
+	sync.Mutex
+	gb float64
+}
+
+// pinning is the size of the pins in progress.
+var pinning struct {
+	sync.Mutex
+	gb float64
+}
+
+// admitPin tells if a pin of sizegb can start without going over
+// MaxInFlightGB, and counts it if so. a pin is always admitted when nothing
+// else is pinning, so objects bigger than the budget still get pinned.
+func admitPin(sizegb float64) bool {
+	pinning.Lock()
+	defer pinning.Unlock()
+
+	if s.MaxInFlightGB > 0 && pinning.gb > 0 && pinning.gb+sizegb > s.MaxInFlightGB {
+		return false
+	}
+	pinning.gb += sizegb
+	return true
+}
+
+func pinFinished(sizegb float64) {
+	pinning.Lock()
+	defer pinning.Unlock()
+	pinning.gb -= sizegb
+}
+
+func usedGB() (used float64, err error) {
+	err = pg.Get(&used, `SELECT coalesce(sum(sizegb), 0) FROM objects`)
+	return
+}
+
+// nodeFreeGB is the space the node can still use according to its own repo
+// stats, which may differ from the sizes recorded for the objects.
+func nodeFreeGB() (float64, error) {
+	stat, err := repoStat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.StorageMax <= stat.RepoSize {
+		return 0, nil
+	}
+	return datasize.ByteSize(stat.StorageMax - stat.RepoSize).GBytes(), nil
+}
+
+func capacityLimited() bool {
+	return s.MaxTotalGB > 0 || s.MinFreeGB > 0
+}
+
+func reserveCapacity(sizegb float64) error {
+	if !capacityLimited() {
+		return nil
+	}
+
+	reservations.Lock()
+	defer reservations.Unlock()
+
+	if s.MaxTotalGB > 0 {
+		used, err := usedGB()
+		if err != nil {
+			return err
+		}
+
+		if used+reservations.gb+sizegb > s.MaxTotalGB {
+			return errCapacityFull
+		}
+	}
+
+	if s.MinFreeGB > 0 {
+		free, err := nodeFreeGB()
+		if err != nil {
+			return err
+		}
+
+		if free-reservations.gb-sizegb < s.MinFreeGB {
+			log.Warn().Float64("free", free).Float64("min", s.MinFreeGB).
+				Msg("node is low on disk")
+			return errCapacityFull
+		}
+	}
+
+	reservations.gb += sizegb
+	return nil
+}
+
+func releaseCapacity(sizegb float64) {
+	if !capacityLimited() {
+		return
+	}
+
+	reservations.Lock()
+	reservations.gb -= sizegb
+	reservations.Unlock()
+}
+
+type quotaError struct {
+	Owner  string
+	UsedGB float64
+	SizeGB float64
+}
+
+func (e *quotaError) Error() string {
+	if e.Owner == "" {
+		return "payments must have an owner with quotas on"
+	}
+	return fmt.Sprintf("owner %s would go over the quota: %v + %v > %v",
+		e.Owner, e.UsedGB, e.SizeGB, s.MaxOwnerGB)
+}
+
+// ownerGB is the size of the active objects the owner has paid for.
+func ownerGB(owner string) (used float64, err error) {
+	err = pg.Get(&used, `
+SELECT coalesce(sum(sizegb), 0) FROM objects
+WHERE pinned_at + lifespan > now()
+  AND cid IN (
+    SELECT cid FROM payments WHERE owner = $1 AND status = 'pinned'
+  )
+    `, owner)
+	return
+}
+
+// what was let through each owner's quota and isn't saved yet.
+var ownerReservations struct {
+	sync.Mutex
+	gb map[string]float64
+}
+
+// reserveOwnerQuota fails if storing cid would take the owner over
+// MaxOwnerGB, counting what's being stored for them already, and holds sizegb
+// of their quota until release is called. objects the owner already pays for
+// don't count twice, so renewing them is always fine. owners are whatever
+// payers say they are, quotas only keep them from going over by mistake, but
+// payments without one would go around them and are refused.
+func reserveOwnerQuota(owner, cid string, sizegb float64) (release func(), err error) {
+	release = func() {}
+	if s.MaxOwnerGB == 0 {
+		return release, nil
+	}
+	if owner == "" {
+		return release, &quotaError{SizeGB: sizegb}
+	}
+
+	ownerReservations.Lock()
+	defer ownerReservations.Unlock()
+
+	var already bool
+	err = pg.Get(&already, `
+SELECT EXISTS (
+  SELECT 1 FROM payments WHERE owner = $1 AND cid = $2 AND status = 'pinned'
+)
+    `, owner, cid)
+	if err != nil {
+		return release, err
+	}
+	if already {
+		return release, nil
+	}
+
+	used, err := ownerGB(owner)
+	if err != nil {
+		return release, err
+	}
+	used += ownerReservations.gb[owner]
+	if used+sizegb > s.MaxOwnerGB {
+		return release, &quotaError{owner, used, sizegb}
+	}
+
+	if ownerReservations.gb == nil {
+		ownerReservations.gb = make(map[string]float64)
+	}
+	ownerReservations.gb[owner] += sizegb
+	return func() {
+		ownerReservations.Lock()
+		defer ownerReservations.Unlock()
+		ownerReservations.gb[owner] -= sizegb
+		if ownerReservations.gb[owner] <= 0 {
+			delete(ownerReservations.gb, owner)
+		}
+	}, nil
+}
+
+// checkOwnerQuota is reserveOwnerQuota without holding anything.
+func checkOwnerQuota(owner, cid string, sizegb float64) error {
+	release, err := reserveOwnerQuota(owner, cid, sizegb)
+	release()
+	return err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveOwnerQuota(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxOwnerGB = 1 })
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, owner) VALUES
+  ('order1', 'QmA', 1000, 'pinned', 'alice'),
+  ('order2', 'QmOld', 1000, 'pinned', 'alice');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 0.5, now(), interval '1 day'),
+  ('QmOld', 0.5, now() - interval '2 days', interval '1 day');
+    `)
+
+	tests := []struct {
+		name     string
+		owner    string
+		cid      string
+		sizegb   float64
+		wantOver bool
+	}{
+		{"within", "alice", "QmB", 0.5, false},
+		{"over quota", "alice", "QmB", 0.6, true},
+		{"renewing what's paid for", "alice", "QmA", 0.5, false},
+		{"another owner", "bob", "QmB", 1, false},
+		{"no owner", "", "QmB", 0.1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, err := reserveOwnerQuota(tt.owner, tt.cid, tt.sizegb)
+			defer release()
+
+			quota, over := err.(*quotaError)
+			if over != tt.wantOver {
+				t.Fatalf("reserveOwnerQuota() = %v, want over quota %v", err, tt.wantOver)
+			}
+			if !over && err != nil {
+				t.Fatal(err)
+			}
+			if over && tt.owner != "" && quota.UsedGB != 0.5 {
+				t.Fatalf("used = %v, want 0.5 as ended objects don't count", quota.UsedGB)
+			}
+		})
+	}
+}
+
+func TestReserveOwnerQuotaConcurrent(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxOwnerGB = 1 })
+	useTestDB(t)
+
+	// what's reserved for a payment being processed counts for the next one
+	release, err := reserveOwnerQuota("alice", "QmA", 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reserveOwnerQuota("alice", "QmB", 0.6)
+	if _, over := err.(*quotaError); !over {
+		t.Fatalf("second reservation = %v, want over quota", err)
+	}
+
+	release()
+	release, err = reserveOwnerQuota("alice", "QmB", 0.6)
+	if err != nil {
+		t.Fatalf("reservation after releasing = %v", err)
+	}
+	release()
+}
+
+func TestReserveOwnerQuotaOff(t *testing.T) {
+	useSettings(t, nil)
+
+	// no database needed, nothing is looked up
+	release, err := reserveOwnerQuota("", "QmA", 100)
+	release()
+	if err != nil {
+		t.Fatalf("reserveOwnerQuota() = %v without quotas", err)
+	}
+}
+
+func TestMinFreeGB(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MinFreeGB = 2 })
+	node := useFakeNode(t)
+
+	tests := []struct {
+		name       string
+		repoSize   uint64
+		storageMax uint64
+		sizegb     float64
+		want       error
+	}{
+		{"plenty free", 1 << 30, 10 << 30, 1, nil},
+		{"down to the minimum", 7 << 30, 10 << 30, 1, nil},
+		{"under the minimum after", 7 << 30, 10 << 30, 1.5, errCapacityFull},
+		{"under the minimum already", 9 << 30, 10 << 30, 0.1, errCapacityFull},
+		// real content went over what the node was told to store
+		{"over the storage max", 11 << 30, 10 << 30, 0.1, errCapacityFull},
+	}
+
+	for _, tt := range tests {
+		node.repoSize, node.storageMax = tt.repoSize, tt.storageMax
+		err := reserveCapacity(tt.sizegb)
+		if err != tt.want {
+			t.Errorf("%s: reserveCapacity() = %v, want %v", tt.name, err, tt.want)
+		}
+		if err == nil {
+			releaseCapacity(tt.sizegb)
+		}
+	}
+
+	// without the node's stats nothing is pinned, but it isn't full either
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		w.WriteHeader(502)
+		return true
+	}
+	err := reserveCapacity(0.1)
+	if err == nil || err == errCapacityFull {
+		t.Fatalf("reserveCapacity() = %v with the node down", err)
+	}
+}
+
+func TestPinQueuedOnLowDisk(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MinFreeGB = 2 })
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.storageMax = 10 << 30
+	node.repoSize = 9 << 30
+	node.sizes["QmA"] = 1 << 29
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	err = pg.Get(&status, `SELECT status FROM payments WHERE order_id = 'order1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "queued" {
+		t.Fatalf("status = %s with the disk low, want queued", status)
+	}
+	if pins := node.called("pin/add"); len(pins) != 0 {
+		t.Fatalf("pinned %v with the disk low", pins)
+	}
+}
+
+func TestAdmitPin(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxInFlightGB = 3 })
+
+	steps := []struct {
+		admit  float64
+		finish float64
+		want   bool
+	}{
+		{admit: 2, want: true},
+		{admit: 1, want: true},
+		{admit: 0.5, want: false},
+		{finish: 2},
+		{admit: 0.5, want: true},
+		{admit: 2, want: false},
+		{finish: 1},
+		{finish: 0.5},
+		// bigger than the budget, but nothing else is pinning
+		{admit: 5, want: true},
+		{admit: 0.1, want: false},
+		{finish: 5},
+	}
+	for i, st := range steps {
+		if st.finish > 0 {
+			pinFinished(st.finish)
+			continue
+		}
+		if got := admitPin(st.admit); got != st.want {
+			t.Fatalf("step %d: admitPin(%v) = %v, want %v", i, st.admit, got, st.want)
+		}
+	}
+	if pinning.gb != 0 {
+		t.Fatalf("%v GB left pinning", pinning.gb)
+	}
+}
+
+func TestInFlightGBBudget(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxInFlightGB = 3 })
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	var mu sync.Mutex
+	var inFlight, peak float64
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd != "pin/add" {
+			return false
+		}
+		node.Lock()
+		gb := float64(node.sizes[call.Arg]) / (1 << 30)
+		node.Unlock()
+
+		mu.Lock()
+		inFlight += gb
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		inFlight -= gb
+		mu.Unlock()
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		large, small := fmt.Sprintf("QmLarge%d", i), fmt.Sprintf("QmSmall%d", i)
+		node.sizes[large] = 2 << 30
+		node.sizes[small] = 1 << 28
+		for _, cid := range []string{large, small} {
+			err := savePayment("order-"+cid, 5000, orderDescription{CID: cid})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pinned := func() (n int) {
+		t.Helper()
+		err := pg.Get(&n, `SELECT count(*) FROM payments WHERE status = 'pinned'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// deferred payments are done on later runs, without counting a try
+	for run := 0; run < 6 && pinned() < 6; run++ {
+		err := processPayments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err = waitBackground(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := pinned(); n != 6 {
+		t.Fatalf("%d of 6 payments pinned", n)
+	}
+	if peak > 3 {
+		t.Fatalf("%v GB pinned at once, over the 3 GB budget", peak)
+	}
+	var tries int
+	err := pg.Get(&tries, `SELECT coalesce(sum(tries + infra_tries), 0) FROM payments`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tries != 0 {
+		t.Fatalf("deferring counted %d tries", tries)
+	}
+}
+
+func TestReserveCapacityConcurrent(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MinFreeGB = 1 })
+	node := useFakeNode(t)
+
+	// 3 GB free, room for two 1 GB pins above the minimum
+	node.storageMax = 10 << 30
+	node.repoSize = 7 << 30
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := reserveCapacity(1)
+			if err == errCapacityFull {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			reserved++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	defer releaseCapacity(float64(reserved))
+
+	if reserved != 2 {
+		t.Fatalf("%d of 10 concurrent pins reserved capacity, want 2", reserved)
+	}
+
+	// released capacity can be reserved again
+	releaseCapacity(1)
+	if err := reserveCapacity(1); err != nil {
+		t.Fatalf("reserveCapacity() after a release = %v", err)
+	}
+}
+
+func TestConcurrentPinsTightCapacity(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxTotalGB = 2 })
+	useTestDB(t)
+	node := useFakeNode(t)
+	useMemBackup(t)
+
+	// slow enough for all of them to be pinning at once
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "pin/add" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		cid := fmt.Sprintf("QmLarge%d", i)
+		node.sizes[cid] = 1 << 30
+		err := savePayment("order-"+cid, 1000, orderDescription{CID: cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := processPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var counts struct {
+		Pinned int     `db:"pinned"`
+		Queued int     `db:"queued"`
+		UsedGB float64 `db:"used"`
+	}
+	err = pg.Get(&counts, `
+SELECT count(*) FILTER (WHERE status = 'pinned') AS pinned,
+  count(*) FILTER (WHERE status = 'queued') AS queued,
+  (SELECT coalesce(sum(sizegb), 0) FROM objects) AS used
+FROM payments
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Pinned != 2 || counts.Queued != 2 || counts.UsedGB != 2 {
+		t.Fatalf("got %+v, want 2 pinned and 2 queued within 2 GB", counts)
+	}
+	if got := node.called("pin/add"); len(got) != 2 {
+		t.Fatalf("pin/add called %d times, want 2", len(got))
+	}
+}
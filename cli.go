@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string, out io.Writer) error
+}
+
+var commands = []command{
+	{"list-objects", "list active objects", cmdListObjects},
+	{"largest", "list the biggest active objects", cmdLargest},
+	{"list-payments", "list payments, optionally filtered by status", cmdListPayments},
+	{"stuck", "list pending payments that haven't been tried in a while", cmdStuck},
+	{"erase-ended", "unpin and delete ended objects", cmdEraseEnded},
+	{"process-payments", "process pending payments", cmdProcessPayments},
+	{"reconcile", "compare the node's pins with the database", cmdReconcile},
+	{"requeue", "process given up payments again", cmdRequeue},
+	{"expired-paid", "list pinned payments whose object was erased since", cmdExpiredPaid},
+	{"replay-events", "write every event in order as json lines, to rebuild state from", cmdReplayEvents},
+	{"integrity", "check payments and objects match each other", cmdIntegrity},
+	{"stats", "show storage and payment totals", cmdStats},
+	{"audit", "list objects whose lifespan doesn't match their payments", cmdAudit},
+	{"recompute-lifespan", "rebuild the lifespan of the given cid from its payments", cmdRecomputeLifespan},
+	{"migrate", "move the remaining lifespan of a cid to another one", cmdMigrate},
+	{"reset-tries", "give the given pending payment its full retry budget back", cmdResetTries},
+	{"hold", "keep the given pending payment from being processed", cmdHold},
+	{"release", "let the given held payment be processed", cmdRelease},
+	{"shrink", "take time off the remaining lifespan of the given cid", cmdShrink},
+	{"dedupe", "merge objects stored under different forms of the same cid", cmdDedupe},
+	{"extend-all", "add time to every active object, e.g. after an outage", cmdExtendAll},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func runCommand(args []string, out io.Writer) error {
+	c := findCommand(args[0])
+	if c == nil {
+		usage(out)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return c.run(args[1:], out)
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintf(out, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-18s %s\n", c.name, c.usage)
+	}
+}
+
+func cmdListObjects(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("list-objects", flag.ContinueOnError)
+	order := flags.String("order", "ends_at ASC", "order by column and direction")
+	unlabeled := flags.Bool("unlabeled", false, "only objects without notes, soonest ending first")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var oo []Object
+	if *unlabeled {
+		oo, err = fetchUnlabeledObjects()
+	} else {
+		oo, err = fetchObjectsOrdered(*order)
+	}
+	if err != nil {
+		return err
+	}
+	return printObjects(out, oo)
+}
+
+func printObjects(out io.Writer, oo []Object) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CID\tSIZE GB\tPINNED AT\tENDS AT\tNOTES")
+	for _, o := range oo {
+		fmt.Fprintf(tw, "%s\t%.4f\t%s\t%s\t%s\n", o.CID, o.SizeGB,
+			o.PinnedAt.Format(time.RFC3339), o.EndsAt.Format(time.RFC3339),
+			strings.Join(o.Notes, ", "))
+	}
+	return tw.Flush()
+}
+
+func cmdLargest(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("largest", flag.ContinueOnError)
+	n := flags.Int("n", 10, "how many objects to list")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *n <= 0 {
+		return fmt.Errorf("-n must be positive, got %d", *n)
+	}
+
+	oo, err := fetchLargestObjects(*n)
+	if err != nil {
+		return err
+	}
+	return printObjects(out, oo)
+}
+
+func cmdListPayments(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("list-payments", flag.ContinueOnError)
+	status := flags.String("status", "", "only payments with this status")
+	min := flags.Int("min", -1, "only payments of at least this amount, ordered by amount")
+	max := flags.Int("max", -1, "only payments of at most this amount, ordered by amount")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var pp []Payment
+	if *min >= 0 || *max >= 0 {
+		if *status != "" {
+			return fmt.Errorf("-status can't be used with -min or -max")
+		}
+		if *max < 0 {
+			*max = math.MaxInt32
+		}
+		if *min < 0 {
+			*min = 0
+		}
+		pp, err = fetchPaymentsByAmount(*min, *max)
+	} else {
+		pp, err = fetchPayments(*status)
+	}
+	if err != nil {
+		return err
+	}
+	return printPayments(out, pp)
+}
+
+func printPayments(out io.Writer, pp []Payment) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER ID\tCID\tAMOUNT\tSTATUS\tTRIES\tPAID AT\tNOTE")
+	for _, p := range pp {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n", p.OrderId, p.CID,
+			p.Amount, p.Status, p.Tries, p.PaidAt, p.Note)
+	}
+	return tw.Flush()
+}
+
+func cmdStuck(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("stuck", flag.ContinueOnError)
+	older := flags.Duration("older", time.Hour, "only payments last tried longer ago than this")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *older <= 0 {
+		return fmt.Errorf("-older must be positive, got %s", *older)
+	}
+
+	pp, err := fetchStuckPayments(*older)
+	if err != nil {
+		return err
+	}
+	return printPayments(out, pp)
+}
+
+func cmdEraseEnded(args []string, out io.Writer) error {
+	err := flag.NewFlagSet("erase-ended", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
+	return eraseEnded()
+}
+
+func cmdProcessPayments(args []string, out io.Writer) error {
+	err := flag.NewFlagSet("process-payments", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
+	return processPayments()
+}
+
+func cmdRequeue(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("requeue", flag.ContinueOnError)
+	reason := flags.String("reason", "", "only payments given up for this reason")
+	from := flags.String("from", "", "only payments given up since this RFC3339 date")
+	to := flags.String("to", "", "only payments given up before this RFC3339 date")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filter := DeadLetterFilter{Reason: *reason}
+	if *from != "" {
+		filter.From, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		filter.To, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := requeueDeadLetters(filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "requeued %d payments\n", n)
+	return nil
+}
+
+func cmdExpiredPaid(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("expired-paid", flag.ContinueOnError)
+	days := flags.Int("days", 30, "only objects erased within this many days")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	pp, err := fetchExpiredPaidObjects(time.Now().AddDate(0, 0, -*days))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER ID\tCID\tAMOUNT\tPAID AT\tENDED AT\tERASED AT")
+	for _, p := range pp {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", p.OrderId, p.CID, p.Amount,
+			p.PaidAt.Format(time.RFC3339), p.EndsAt.Format(time.RFC3339),
+			p.ErasedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func cmdReplayEvents(args []string, out io.Writer) error {
+	err := flag.NewFlagSet("replay-events", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	return replayEvents(func(e Event) error {
+		return enc.Encode(e)
+	})
+}
+
+func cmdIntegrity(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("integrity", flag.ContinueOnError)
+	requeue := flags.Bool("requeue", false, "process the payments of missing objects with time left again")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	report, err := checkIntegrity(*requeue)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "missing objects with time left (%d):\n", len(report.Missing))
+	for _, cid := range report.Missing {
+		fmt.Fprintln(out, "  "+cid)
+	}
+	fmt.Fprintf(out, "other pinned payments without object (%d):\n", len(report.Unresolved))
+	for _, orderId := range report.Unresolved {
+		fmt.Fprintln(out, "  "+orderId)
+	}
+	fmt.Fprintf(out, "objects without pinned payment (%d):\n", len(report.Unpaid))
+	for _, cid := range report.Unpaid {
+		fmt.Fprintln(out, "  "+cid)
+	}
+	return nil
+}
+
+func cmdReconcile(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", s.ReconcileTimeout, "give up after this long")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report, err := reconcile(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "missing on node (%d):\n", len(report.MissingOnNode))
+	for _, cid := range report.MissingOnNode {
+		fmt.Fprintln(out, "  "+cid)
+	}
+	fmt.Fprintf(out, "unknown to database (%d):\n", len(report.UnknownOnNode))
+	for _, cid := range report.UnknownOnNode {
+		fmt.Fprintln(out, "  "+cid)
+	}
+	return nil
+}
+
+func cmdStats(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	days := flags.Int("days", 30, "compute the realized price over this many days")
+	within := flags.Duration("within", 7*24*time.Hour, "count the revenue of objects ending within this long")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	st, err := fetchStats()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "active objects\t%d\n", st.ActiveObjects)
+	fmt.Fprintf(tw, "stored GB\t%.4f\n", st.StoredGB)
+	avgSizeGB, avgDuration, err := averages()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "average object\t%.4f GB for %.1f days\n", avgSizeGB, avgDuration.Hours()/24)
+	for _, status := range []string{"trying", "queued", "pinned", "given_up", "cancelled", "repurposed"} {
+		fmt.Fprintf(tw, "%s payments\t%d\n", status, st.Payments[status])
+	}
+
+	now := time.Now()
+	realized, err := realizedPricePerGBDay(now.AddDate(0, 0, -*days), now)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "realized price per GB-day\t%.2f (PRICE_GB %d %s)\n",
+		realized, s.PriceGB, s.PriceCurrency)
+
+	atRisk, err := revenueAtRisk(*within)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "revenue ending within %s\t%s\n", *within, formatAmount(int64(atRisk)))
+
+	retries, err := retryDistribution()
+	if err != nil {
+		return err
+	}
+	tries := make([]int, 0, len(retries))
+	for n := range retries {
+		tries = append(tries, n)
+	}
+	sort.Ints(tries)
+	for _, n := range tries {
+		fmt.Fprintf(tw, "pinned after %d failed tries\t%d\n", n, retries[n])
+	}
+	return tw.Flush()
+}
+
+func cmdAudit(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	tolerance := flags.Float64("tolerance", 0.01, "allowed difference, as a fraction of the paid lifespan")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	oo, err := findInconsistentObjects(*tolerance)
+	if err != nil {
+		return err
+	}
+	err = printObjects(out, oo)
+	if err != nil {
+		return err
+	}
+	if len(oo) > 0 {
+		fmt.Fprintln(out, "\nrecompute-lifespan <cid> rewrites a lifespan from its payments")
+	}
+	return nil
+}
+
+func cmdRecomputeLifespan(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("recompute-lifespan", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("recompute-lifespan takes a single cid")
+	}
+
+	cid := toCID(flags.Arg(0))
+	err = recomputeLifespan(cid)
+	if err != nil {
+		return err
+	}
+
+	o, err := fetchObject(cid)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s now ends at %s\n", cid, o.EndsAt.Format(time.RFC3339))
+	return nil
+}
+
+func cmdResetTries(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("reset-tries", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("reset-tries takes a single order id")
+	}
+
+	err = resetPaymentTries(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s can be tried again\n", flags.Arg(0))
+	return nil
+}
+
+func cmdHold(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("hold", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("hold takes a single order id")
+	}
+
+	err = holdPayment(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s is on hold\n", flags.Arg(0))
+	return nil
+}
+
+func cmdRelease(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("release takes a single order id")
+	}
+
+	err = releasePayment(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s is released\n", flags.Arg(0))
+	return nil
+}
+
+func cmdShrink(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("shrink", flag.ContinueOnError)
+	by := flags.Duration("by", 0, "time to take off")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("shrink takes a single cid")
+	}
+
+	cid := toCID(flags.Arg(0))
+	err = shrinkLifespan(cid, *by)
+	if err != nil {
+		return err
+	}
+
+	o, err := fetchObject(cid)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s now ends at %s\n", cid, o.EndsAt.Format(time.RFC3339))
+	return nil
+}
+
+func cmdDedupe(args []string, out io.Writer) error {
+	err := flag.NewFlagSet("dedupe", flag.ContinueOnError).Parse(args)
+	if err != nil {
+		return err
+	}
+
+	n, err := dedupeObjects()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "merged %d duplicate objects\n", n)
+	return nil
+}
+
+func cmdExtendAll(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("extend-all", flag.ContinueOnError)
+	by := flags.Duration("by", 0, "time to add to each object")
+	reason := flags.String("reason", "", "why, recorded with each object")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	n, err := extendAll(*by, *reason)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "extended %d objects by %s\n", n, *by)
+	return nil
+}
+
+func cmdMigrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("migrate takes the old cid and the new one")
+	}
+
+	err = migrateCID(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "migrated %s to %s\n", flags.Arg(0), flags.Arg(1))
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandInvalid(t *testing.T) {
+	useSettings(t, nil)
+
+	// all of these fail before anything is queried
+	tests := [][]string{
+		{"list-objects", "-bogus"},
+		{"largest", "-n", "0"},
+		{"list-payments", "-status", "pinned", "-min", "5"},
+		{"stuck", "-older", "0s"},
+		{"process-payments", "-all"},
+		{"reconcile", "-timeout", "soon"},
+		{"stats", "-days", "many"},
+		{"requeue", "-from", "yesterday"},
+		{"recompute-lifespan"},
+		{"migrate", "QmA"},
+		{"reset-tries", "order1", "order2"},
+		{"hold"},
+		{"release", "order1", "order2"},
+		{"shrink", "-by", "1h"},
+	}
+
+	for _, args := range tests {
+		var out bytes.Buffer
+		err := runCommand(args, &out)
+		if err == nil {
+			t.Errorf("%v: nil error", args)
+		}
+	}
+}
+
+func TestRunCommandUnknown(t *testing.T) {
+	var out bytes.Buffer
+	err := runCommand([]string{"erase-everything"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "erase-everything") {
+		t.Fatalf("runCommand() = %v, want an unknown command error", err)
+	}
+	for _, c := range commands {
+		if !strings.Contains(out.String(), c.name) {
+			t.Errorf("usage doesn't list %s", c.name)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status) VALUES
+  ('order-old', 'QmOld', 1000, 'pinned'),
+  ('order-live', 'QmLive', 1000, 'pinned');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmOld', 1, now() - interval '2 days', interval '1 day'),
+  ('QmLive', 2, now(), interval '1 day');
+    `)
+	node.pins["QmOld"] = ""
+	node.pins["QmStray"] = ""
+	node.sizes["QmNew"] = 1 << 30
+	err := savePayment("order-new", 1000, orderDescription{CID: "QmNew"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		err := runCommand(args, &out)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if out := run("list-objects"); !strings.Contains(out, "QmLive") {
+		t.Errorf("list-objects doesn't list QmLive:\n%s", out)
+	}
+	out := run("list-payments", "-status", "trying")
+	if !strings.Contains(out, "order-new") || strings.Contains(out, "order-live") {
+		t.Errorf("list-payments -status trying:\n%s", out)
+	}
+
+	// QmLive was never pinned on the node, QmStray isn't known
+	out = run("reconcile")
+	if !strings.Contains(out, "missing on node (1):\n  QmLive") ||
+		!strings.Contains(out, "unknown to database (1):\n  QmStray") {
+		t.Errorf("reconcile:\n%s", out)
+	}
+
+	run("erase-ended")
+	if node.pinned("QmOld") {
+		t.Error("erase-ended didn't unpin QmOld")
+	}
+
+	run("process-payments")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.pinned("QmNew") {
+		t.Error("process-payments didn't pin QmNew")
+	}
+
+	// the columns are padded to line up
+	out = strings.Join(strings.Fields(run("stats")), " ")
+	if !strings.Contains(out, "active objects 2") || !strings.Contains(out, "pinned payments 3") {
+		t.Errorf("stats: %s", out)
+	}
+}
@@ -300,7 +300,7 @@ async function createOrder({cid, note, amount, reused_orders}) {
       body: JSON.stringify({cid, note, amount, reused_orders}),
       headers: {'Content-Type': 'application/json'}
     })
-    if (!res.ok) throw new Error(await res.text())
+    if (!res.ok) throw new Error((await res.json()).error)
 
     let {invoice, order_id} = await res.json()
 
@@ -321,7 +321,7 @@ async function fetchOrder(orderId) {
     let res = await fetch(`/api/order/${orderId}`, {
       method: 'GET'
     })
-    if (!res.ok) throw new Error(await res.text())
+    if (!res.ok) throw new Error((await res.json()).error)
     return res.json()
   } catch (err) {
     console.error(err)
@@ -102,7 +102,7 @@ export default function Main() {
 async function fetchObjects() {
   try {
     let res = await fetch('/api/objects')
-    if (!res.ok) throw new Error(await res.text())
+    if (!res.ok) throw new Error((await res.json()).error)
     return res.json()
   } catch (err) {
     console.error(err)
@@ -115,7 +115,7 @@ async function fetchObjects() {
 async function fetchGlobals() {
   try {
     let res = await fetch('/api/globals')
-    if (!res.ok) throw new Error(await res.text())
+    if (!res.ok) throw new Error((await res.json()).error)
     return res.json()
   } catch (err) {
     console.error(err)
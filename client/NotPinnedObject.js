@@ -12,7 +12,7 @@ export default function NotPinnedObject({orderId, onProcessed, onReuseSelect}) {
 
   useEffect(
     async () => {
-      if (payment.status !== 'given_up') {
+      if (payment.status !== 'given_up' && payment.status !== 'cancelled') {
         setTimeout(async () => {
           setPayment(await fetchPayment(orderId))
           setI(i + 1)
@@ -23,7 +23,10 @@ export default function NotPinnedObject({orderId, onProcessed, onReuseSelect}) {
       if (
         payment &&
         payment.status &&
-        (payment.status !== 'trying' && payment.status !== 'given_up')
+        (payment.status !== 'trying' &&
+          payment.status !== 'queued' &&
+          payment.status !== 'given_up' &&
+          payment.status !== 'cancelled')
       ) {
         orderStore.remove(orderId)
         onProcessed()
@@ -47,13 +50,13 @@ export default function NotPinnedObject({orderId, onProcessed, onReuseSelect}) {
     return null
   }
 
-  let {order_id, cid, amount, note, paid_at, tries, status} = payment
+  let {order_id, cid, amount, note, paid_at, status} = payment
 
   return (
     <div className={`object ${status}`}>
-      {status === 'given_up' ? (
+      {status === 'given_up' || status === 'cancelled' ? (
         <p>
-          given up{' '}
+          {status === 'given_up' ? 'given up' : 'cancelled'}{' '}
           <button
             data-id={order_id}
             data-note={note}
@@ -66,6 +69,8 @@ export default function NotPinnedObject({orderId, onProcessed, onReuseSelect}) {
             Reuse paid amount
           </button>
         </p>
+      ) : status === 'queued' ? (
+        <p>paid, waiting for free space</p>
       ) : (
         <p>paid, pinning in progress</p>
       )}
@@ -91,10 +96,6 @@ export default function NotPinnedObject({orderId, onProcessed, onReuseSelect}) {
               </a>
             </td>
           </tr>
-          <tr>
-            <td>Attempt: </td>
-            <td>{tries}</td>
-          </tr>
         </tbody>
       </table>
     </div>
@@ -104,7 +105,7 @@ export default function NotPinnedObject({orderId, onProcessed, onReuseSelect}) {
 async function fetchPayment(orderId) {
   try {
     let res = await fetch('/api/order/' + orderId)
-    if (!res.ok) throw new Error(await res.text())
+    if (!res.ok) throw new Error((await res.json()).error)
     return res.json()
   } catch (err) {
     console.error(err)
@@ -14,6 +14,7 @@ export default function PinnedObject({
   pinned_at,
   ends_at,
   notes,
+  encryption,
   onSelect
 }) {
   let [provs, setProvs] = useState(null)
@@ -77,6 +78,14 @@ export default function PinnedObject({
             <td>Ends in:</td>
             <td title={ends_at.split('T')[0]}>{fromNow(ends_at, {max: 2})}</td>
           </tr>
+          {encryption && (
+            <tr>
+              <td>Encrypted:</td>
+              <td title="Needs to be decrypted after retrieval.">
+                {encryption}
+              </td>
+            </tr>
+          )}
           <tr>
             <td>Notes</td>
             <td>
@@ -2,47 +2,281 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
 type Object struct {
-	CID      string         `json:"cid" db:"cid"`
-	SizeGB   float64        `json:"sizegb" db:"sizegb"`
-	PinnedAt time.Time      `json:"pinned_at" db:"pinned_at"`
-	EndsAt   time.Time      `json:"ends_at" db:"ends_at"`
-	Notes    pq.StringArray `json:"notes" db:"notes"`
+	CID        string         `db:"cid"`
+	SizeGB     float64        `db:"sizegb"`
+	PinnedAt   time.Time      `db:"pinned_at"`
+	EndsAt     time.Time      `db:"ends_at"`
+	Notes      pq.StringArray `db:"notes"`
+	Path       string         `db:"path"`
+	Encryption string         `db:"encryption"`
 }
 
 type Payment struct {
-	OrderId   string   `json:"order_id" db:"order_id"`
-	CID       string   `json:"cid" db:"cid"`
-	Note      string   `json:"note" db:"note"`
-	PaidAt    string   `json:"paid_at" db:"paid_at"`
-	Amount    int      `json:"amount" db:"amount"`
-	Status    string   `json:"status" db:"status"`
-	Tries     int      `json:"tries" db:"tries"`
-	Recycling []string `json:"recycling" db:"recycling"`
+	OrderId   string   `db:"order_id"`
+	CID       string   `db:"cid"`
+	Note      string   `db:"note"`
+	PaidAt    string   `db:"paid_at"`
+	Amount    int      `db:"amount"`
+	Status    string   `db:"status"`
+	Tries     int      `db:"tries"`
+	Recycling []string `db:"recycling"`
+}
+
+// set when the database has no notes column, as in deployments that still
+// use the old notes(objects) function and haven't been migrated.
+var notesMissing int32
+
+// notes are coalesced so they always scan into a non-nil empty slice.
+func objectColumns() string {
+	notes := "coalesce(notes, '{}')"
+	if atomic.LoadInt32(&notesMissing) == 1 {
+		notes = "'{}'::text[]"
+	}
+	return `
+  cid, sizegb, pinned_at, pinned_at + lifespan AS ends_at, path, encryption,
+  ` + notes + ` AS notes`
+}
+
+// currentPayments restricts payments aliased p to the pinned ones made since
+// their cid was last erased, i.e. those that paid for the object pinned now
+// rather than for an earlier one with the same cid. erasures from before there
+// were events or tombstones can't be told.
+const currentPayments = `
+  p.status = 'pinned'
+  AND p.paid_at > coalesce(greatest(
+    (SELECT max(erased_at) FROM erased_objects AS t WHERE t.cid = p.cid),
+    (SELECT max(created_at) FROM events AS e WHERE e.cid = p.cid AND e.kind = 'erased')
+  ), '-infinity')`
+
+// withNotesFallback runs an objects query, running it again without notes if
+// it failed because the notes column doesn't exist.
+func withNotesFallback(query func() error) error {
+	err := query()
+	if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "42703" &&
+		strings.Contains(pqerr.Message, "notes") {
+		if atomic.CompareAndSwapInt32(&notesMissing, 0, 1) {
+			log.Warn().Err(err).
+				Msg("objects have no notes column, listing them without notes")
+		}
+		return query()
+	}
+	return err
+}
+
+var objectOrderColumns = map[string]bool{
+	"ends_at":   true,
+	"pinned_at": true,
+	"sizegb":    true,
+	"cid":       true,
 }
 
 func fetchObjects() (oo []Object, err error) {
+	return fetchObjectsOrdered("ends_at ASC")
+}
+
+func objectOrderBy(order string) (string, error) {
+	parts := strings.Fields(order)
+	if len(parts) == 0 || len(parts) > 2 || !objectOrderColumns[parts[0]] {
+		return "", fmt.Errorf("invalid order: %q", order)
+	}
+	direction := "ASC"
+	if len(parts) == 2 {
+		direction = strings.ToUpper(parts[1])
+		if direction != "ASC" && direction != "DESC" {
+			return "", fmt.Errorf("invalid order direction: %q", parts[1])
+		}
+	}
+	return parts[0] + " " + direction, nil
+}
+
+func fetchObjectsOrdered(order string) (oo []Object, err error) {
+	orderBy, err := objectOrderBy(order)
+	if err != nil {
+		return nil, err
+	}
+
+	oo = make([]Object, 0)
+	err = withNotesFallback(func() error {
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE pinned_at + lifespan > now()
+ORDER BY `+orderBy+`
+    `)
+	})
+	return
+}
+
+// nextExpiry is the active object that ends first, or nil if there's none.
+func nextExpiry() (*Object, error) {
+	o := Object{}
+	err := withNotesFallback(func() error {
+		return pg.Get(&o, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE pinned_at + lifespan > now()
+ORDER BY ends_at ASC
+LIMIT 1
+    `)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &o, err
+}
+
+// exportObjects streams active objects ordered by cid as JSON lines. an
+// interrupted export is resumed by passing the last cid received as after.
+func exportObjects(w io.Writer, after string) error {
+	var rows *sqlx.Rows
+	err := withNotesFallback(func() (err error) {
+		rows, err = pg.Queryx(`
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE pinned_at + lifespan > now()
+  AND cid > $1
+ORDER BY cid ASC
+    `, after)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		o := Object{}
+		err = rows.StructScan(&o)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(objectResponse(&o))
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// fetchLargestObjects lists the n biggest active objects, biggest first.
+func fetchLargestObjects(n int) (oo []Object, err error) {
 	oo = make([]Object, 0)
-	err = pg.Select(&oo, `
-SELECT cid, sizegb, pinned_at, pinned_at + lifespan AS ends_at, notes(o)
+	err = withNotesFallback(func() error {
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
 FROM objects AS o
 WHERE pinned_at + lifespan > now()
+ORDER BY sizegb DESC, cid
+LIMIT $1
+    `, n)
+	})
+	return
+}
+
+func fetchObjectsPinnedBetween(from, to time.Time) (oo []Object, err error) {
+	oo = make([]Object, 0)
+	err = withNotesFallback(func() error {
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE pinned_at >= $1 AND pinned_at < $2
+ORDER BY pinned_at ASC
+    `, from.UTC(), to.UTC())
+	})
+	return
+}
+
+// fetchUnpaidObjects lists the objects no pinned payment paid for, e.g. pinned
+// by an admin for free.
+func fetchUnpaidObjects() (oo []Object, err error) {
+	oo = make([]Object, 0)
+	err = withNotesFallback(func() error {
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE NOT EXISTS (
+  SELECT 1 FROM payments
+  WHERE payments.cid = o.cid
+    AND payments.status = 'pinned'
+)
 ORDER BY ends_at ASC
     `)
+	})
+	return
+}
+
+// fetchUnlabeledObjects lists active objects without any notes. without a
+// notes column none of them has notes.
+func fetchUnlabeledObjects() (oo []Object, err error) {
+	oo = make([]Object, 0)
+	err = withNotesFallback(func() error {
+		unlabeled := "array_length(notes, 1) IS NULL"
+		if atomic.LoadInt32(&notesMissing) == 1 {
+			unlabeled = "true"
+		}
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE pinned_at + lifespan > now() AND `+unlabeled+`
+ORDER BY ends_at ASC
+    `)
+	})
+	return
+}
+
+const maxPrefixResults = 50
+
+// searchObjectsByCIDPrefix finds up to maxPrefixResults objects whose cid
+// starts with prefix. base32 cids are case-insensitive and written in
+// lowercase, so those prefixes are lowercased.
+func searchObjectsByCIDPrefix(prefix string) (oo []Object, err error) {
+	prefix = toCID(prefix)
+	if prefix == "" || strings.IndexFunc(prefix, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) != -1 {
+		return nil, errInvalidCID
+	}
+	if len(prefix) > 0 && (prefix[0] == 'b' || prefix[0] == 'B') {
+		prefix = strings.ToLower(prefix)
+	}
+
+	oo = make([]Object, 0)
+	err = withNotesFallback(func() error {
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+WHERE cid LIKE $1 || '%'
+ORDER BY cid
+LIMIT $2
+    `, prefix, maxPrefixResults)
+	})
 	return
 }
 
 func fetchObject(cid string) (*Object, error) {
 	o := Object{}
-	err = pg.Get(&o, `
-SELECT cid, sizegb, pinned_at, pinned_at + lifespan AS ends_at, notes(o)
+	err := withNotesFallback(func() error {
+		return pg.Get(&o, `
+SELECT `+objectColumns()+`
 FROM objects AS o WHERE cid = $1
     `, cid)
+	})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -61,23 +295,444 @@ FROM payments AS o WHERE order_id = $1
 	return &p, err
 }
 
-func savePayment(order_id, cid string, paidAmount int, note string, orders []string) error {
+func fetchPayments(status string) (pp []Payment, err error) {
+	pp = make([]Payment, 0)
+	err = pg.Select(&pp, `
+SELECT order_id, cid, coalesce(note, '') AS note, paid_at, amount, status, tries
+FROM payments
+WHERE $1 = '' OR status::text = $1
+ORDER BY paid_at DESC
+    `, status)
+	return
+}
+
+// fetchPaymentsByAmount lists the payments of min to max, both included,
+// smallest first.
+func fetchPaymentsByAmount(min, max int) (pp []Payment, err error) {
+	pp = make([]Payment, 0)
+	err = pg.Select(&pp, `
+SELECT order_id, cid, coalesce(note, '') AS note, paid_at, amount, status, tries
+FROM payments
+WHERE amount >= $1 AND amount <= $2
+ORDER BY amount ASC, paid_at ASC
+    `, min, max)
+	return
+}
+
+func fetchStuckPayments(olderThan time.Duration) (pp []Payment, err error) {
+	pp = make([]Payment, 0)
+	err = pg.Select(&pp, `
+SELECT order_id, cid, coalesce(note, '') AS note, paid_at, amount, status, tries
+FROM payments
+WHERE status IN ('trying', 'queued')
+  AND tries > 0
+  AND coalesce(last_try_at, paid_at) < now() - make_interval(secs := $1)
+ORDER BY paid_at ASC
+    `, olderThan.Seconds())
+	return
+}
+
+var errEmptyCID = errors.New("payment has no cid")
+var errNonPositiveAmount = errors.New("payment amount must be positive")
+
+// savePayment stores a paid order. an amount of zero is only valid when the
+// order reuses others.
+func savePayment(order_id string, paidAmount int, d orderDescription) error {
+	if strings.TrimSpace(d.CID) == "" {
+		return errEmptyCID
+	}
+	reusing := false
+	for _, o := range d.ReusedOrders {
+		reusing = reusing || o != ""
+	}
+	if paidAmount < 0 || (paidAmount == 0 && !reusing) {
+		return errNonPositiveAmount
+	}
+
 	_, err := pg.Exec(`
 WITH reused_orders AS (
   UPDATE payments
   SET status = 'repurposed'
-  WHERE status = 'given_up'
+  WHERE status IN ('given_up', 'cancelled')
   AND order_id = any($1)
   RETURNING order_id, amount
 )
-INSERT INTO payments (order_id, cid, note, amount, recycling)
+INSERT INTO payments (order_id, cid, note, amount, recycling, owner, path, encryption)
 VALUES (
   $3,
   $4,
   $5,
   (SELECT coalesce(sum(amount), 0) + $2 FROM reused_orders),
-  (SELECT coalesce(array_agg(order_id), '{}'::text[]) FROM reused_orders)
+  (SELECT coalesce(array_agg(order_id), '{}'::text[]) FROM reused_orders),
+  $6,
+  $7,
+  $8
 )
-    `, pq.Array(orders), paidAmount, order_id, cid, note)
+    `, pq.Array(d.ReusedOrders), paidAmount, order_id, d.CID, d.Note, d.Owner, d.Path,
+		d.Encryption)
+	return err
+}
+
+var errBinaryNote = errors.New("notes must be text")
+var errNoteTooLong = errors.New("note is too long")
+var errTooManyNotes = errors.New("object has too many notes")
+
+// sanitizeNote strips control characters and surrounding space from note and
+// checks it's text within MaxNoteLength.
+func sanitizeNote(note string) (string, error) {
+	if !utf8.ValidString(note) || strings.ContainsRune(note, 0) {
+		return "", errBinaryNote
+	}
+
+	note = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, note))
+
+	if utf8.RuneCountInString(note) > s.MaxNoteLength {
+		return "", errNoteTooLong
+	}
+	return note, nil
+}
+
+func addNote(cid, note string) error {
+	note, err := sanitizeNote(note)
+	if err != nil || note == "" {
+		return err
+	}
+
+	res, err := pg.Exec(`
+UPDATE objects
+SET notes = array_append(notes, $2)
+WHERE cid = $1
+  AND NOT $2 = any(notes)
+  AND coalesce(array_length(notes, 1), 0) < $3
+    `, cid, note, s.MaxNotes)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+
+	o, err := fetchObject(cid)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		return errObjectNotFound
+	}
+	for _, existing := range o.Notes {
+		if existing == note {
+			return nil
+		}
+	}
+	return errTooManyNotes
+}
+
+func removeNote(cid, note string) error {
+	_, err := pg.Exec(`
+UPDATE objects SET notes = array_remove(notes, $2) WHERE cid = $1
+    `, cid, note)
 	return err
 }
+
+var errPaymentNotFound = errors.New("payment not found")
+var errPaymentProcessed = errors.New("payment already processed")
+
+// cancelPayment stops a payment from being processed. nothing is refunded to
+// the payer: like the amount of given up orders, it's kept as credit that can be
+// reused by passing the order in a new order's reused_orders.
+func cancelPayment(orderId string) error {
+	res, err := pg.Exec(`
+UPDATE payments SET status = 'cancelled'
+WHERE order_id = $1 AND status IN ('trying', 'queued')
+    `, orderId)
+	if err != nil {
+		return err
+	}
+
+	err = pendingPaymentUpdated(orderId, res)
+	if err == nil {
+		abortInFlight(orderId)
+	}
+	return err
+}
+
+func holdPayment(orderId string) error {
+	return setOnHold(orderId, true)
+}
+
+func releasePayment(orderId string) error {
+	return setOnHold(orderId, false)
+}
+
+func setOnHold(orderId string, hold bool) error {
+	res, err := pg.Exec(`
+UPDATE payments SET on_hold = $2
+WHERE order_id = $1 AND status IN ('trying', 'queued')
+    `, orderId, hold)
+	if err != nil {
+		return err
+	}
+	return pendingPaymentUpdated(orderId, res)
+}
+
+// resetPaymentTries gives a pending payment its full retry budget back.
+func resetPaymentTries(orderId string) error {
+	res, err := pg.Exec(`
+UPDATE payments SET tries = 0, infra_tries = 0
+WHERE order_id = $1 AND status IN ('trying', 'queued')
+    `, orderId)
+	if err != nil {
+		return err
+	}
+	return pendingPaymentUpdated(orderId, res)
+}
+
+// pendingPaymentUpdated explains why an update restricted to pending
+// payments didn't touch the given order.
+func pendingPaymentUpdated(orderId string, res sql.Result) error {
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+
+	p, err := fetchPayment(orderId)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return errPaymentNotFound
+	}
+	return errPaymentProcessed
+}
+
+type cidBlockedError struct {
+	Until time.Time
+}
+
+func (e *cidBlockedError) Error() string {
+	return "this cid failed too many times, try again after " +
+		e.Until.UTC().Format(time.RFC3339)
+}
+
+// contentFailures are the reasons for giving up that come from the content
+// itself. the others depend on the order, e.g. paying too little for its size,
+// so they don't count towards blocking a cid for everyone.
+var contentFailures = []string{"exhausted", string(pinErrInvalid), string(pinErrUnresolvable)}
+
+func checkCIDBlocked(cid string) error {
+	if s.CIDBlockThreshold <= 0 {
+		return nil
+	}
+
+	var res struct {
+		Count int         `db:"count"`
+		Last  pq.NullTime `db:"last"`
+	}
+	err := pg.Get(&res, `
+SELECT count(*) AS count, max(created_at) AS last
+FROM events
+WHERE kind = 'given_up'
+  AND cid = $1
+  AND created_at > now() - make_interval(secs := $2)
+  AND detail = any($3)
+    `, cid, s.CIDBlockCoolOff.Seconds(), pq.Array(contentFailures))
+	if err != nil {
+		return err
+	}
+
+	if res.Count >= s.CIDBlockThreshold {
+		return &cidBlockedError{res.Last.Time.Add(s.CIDBlockCoolOff)}
+	}
+	return nil
+}
+
+var errObjectNotFound = errors.New("object not found")
+var errShrinkTooLarge = errors.New("can't shrink lifespan beyond the remaining time")
+
+// shrinkLifespan takes delta off the remaining lifespan of cid, which can't
+// go below nothing left.
+func shrinkLifespan(cid string, delta time.Duration) error {
+	if delta <= 0 {
+		return fmt.Errorf("shrink delta must be positive, got %v", delta)
+	}
+
+	res, err := pg.Exec(`
+UPDATE objects
+SET lifespan = lifespan - make_interval(secs := $2)
+WHERE cid = $1
+  AND pinned_at + lifespan - make_interval(secs := $2) >= now()
+    `, cid, delta.Seconds())
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+
+	o, err := fetchObject(cid)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		return errObjectNotFound
+	}
+	return errShrinkTooLarge
+}
+
+// extendAll adds delta to the lifespan of every object that hasn't ended yet,
+// e.g. to compensate for an outage. each of them gets an 'extended' event with
+// the reason, so it shows in its timeline.
+func extendAll(delta time.Duration, reason string) (int, error) {
+	if delta <= 0 {
+		return 0, fmt.Errorf("extend delta must be positive, got %v", delta)
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return 0, errors.New("a reason for extending is required")
+	}
+
+	var n int
+	err := pg.Get(&n, `
+WITH extended AS (
+  UPDATE objects
+  SET lifespan = lifespan + make_interval(secs := $1)
+  WHERE pinned_at + lifespan > now()
+  RETURNING cid, sizegb
+), audit AS (
+  INSERT INTO events (kind, cid, sizegb, detail)
+  SELECT 'extended', cid, sizegb, 'by ' || $2 || ': ' || $3
+  FROM extended
+)
+SELECT count(*) FROM extended
+    `, delta.Seconds(), delta.String(), reason)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info().Int("objects", n).Str("delta", delta.String()).Str("reason", reason).
+		Msg("extended all active objects")
+	return n, nil
+}
+
+type PinsetEntry struct {
+	CID    string    `db:"cid"`
+	EndsAt time.Time `db:"ends_at"`
+}
+
+func exportPinset() (entries []PinsetEntry, err error) {
+	entries = make([]PinsetEntry, 0)
+	err = pg.Select(&entries, `
+SELECT cid, pinned_at + lifespan AS ends_at
+FROM objects
+WHERE pinned_at + lifespan > now()
+ORDER BY cid
+    `)
+	return
+}
+
+type ErasedObject struct {
+	CID      string    `json:"cid" db:"cid"`
+	SizeGB   float64   `json:"sizegb" db:"sizegb"`
+	PinnedAt time.Time `json:"pinned_at" db:"pinned_at"`
+	EndsAt   time.Time `json:"ends_at" db:"ends_at"`
+	ErasedAt time.Time `json:"erased_at" db:"erased_at"`
+}
+
+// fetchErased lists the tombstones of cid, last erased first.
+func fetchErased(cid string) (ee []ErasedObject, err error) {
+	ee = make([]ErasedObject, 0)
+	err = pg.Select(&ee, `
+SELECT cid, sizegb, pinned_at, ends_at, erased_at
+FROM erased_objects
+WHERE cid = $1
+ORDER BY erased_at DESC
+    `, cid)
+	return
+}
+
+type PaymentObject struct {
+	OrderId  string    `json:"order_id" db:"order_id"`
+	CID      string    `json:"cid" db:"cid"`
+	Amount   int       `json:"amount" db:"amount"`
+	PaidAt   time.Time `json:"paid_at" db:"paid_at"`
+	EndsAt   time.Time `json:"ends_at" db:"ends_at"`
+	ErasedAt time.Time `json:"erased_at" db:"erased_at"`
+}
+
+// fetchExpiredPaidObjects lists pinned payments whose object was erased since
+// the given time, matching each payment to the first erasure after it was paid.
+func fetchExpiredPaidObjects(since time.Time) (pp []PaymentObject, err error) {
+	pp = make([]PaymentObject, 0)
+	err = pg.Select(&pp, `
+SELECT p.order_id, p.cid, p.amount, p.paid_at, e.ends_at, e.erased_at
+FROM payments AS p
+CROSS JOIN LATERAL (
+  SELECT ends_at, erased_at FROM erased_objects
+  WHERE cid = p.cid AND erased_at > p.paid_at
+  ORDER BY erased_at ASC
+  LIMIT 1
+) AS e
+WHERE p.status = 'pinned'
+  AND e.erased_at >= $1
+ORDER BY e.erased_at DESC
+    `, since.UTC())
+	return
+}
+
+// isPinned tells if cid has an object that hasn't ended yet.
+func isPinned(cid string) (pinned bool, err error) {
+	err = pg.Get(&pinned, `
+SELECT EXISTS (
+  SELECT 1 FROM objects WHERE cid = $1 AND pinned_at + lifespan > now()
+)
+    `, cid)
+	return
+}
+
+type Receipt struct {
+	OrderId  string    `db:"order_id"`
+	CID      string    `db:"cid"`
+	Amount   int64     `db:"amount"`
+	SizeGB   float64   `db:"sizegb"`
+	PinnedAt time.Time `db:"pinned_at"`
+	EndsAt   time.Time `db:"ends_at"`
+}
+
+var errNoReceipt = errors.New("payment wasn't pinned, there's no receipt")
+
+// fetchReceipt describes a pinned payment and the object it paid for.
+func fetchReceipt(orderId string) (*Receipt, error) {
+	var status string
+	err := pg.Get(&status, `SELECT status FROM payments WHERE order_id = $1`, orderId)
+	if err == sql.ErrNoRows {
+		return nil, errPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != "pinned" {
+		return nil, errNoReceipt
+	}
+
+	r := Receipt{}
+	err = pg.Get(&r, `
+SELECT p.order_id, p.cid, p.amount, o.sizegb, o.pinned_at,
+  o.pinned_at + o.lifespan AS ends_at
+FROM payments AS p
+INNER JOIN objects AS o ON o.cid = p.cid
+WHERE p.order_id = $1
+    `, orderId)
+	if err == sql.ErrNoRows {
+		// pinned, but the object has been erased since
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,1175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// useTestDB points pg at the database in TEST_DATABASE_URL for the rest of the
+// test, wiped and set up from postgres.sql. the test is skipped without one.
+func useTestDB(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	schema, err := ioutil.ReadFile("postgres.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := pg
+	pg = db
+	t.Cleanup(func() {
+		pg = saved
+		db.Close()
+	})
+}
+
+func TestObjectOrderBy(t *testing.T) {
+	tests := []struct {
+		order   string
+		want    string
+		wantErr bool
+	}{
+		{"ends_at", "ends_at ASC", false},
+		{"ends_at ASC", "ends_at ASC", false},
+		{"sizegb desc", "sizegb DESC", false},
+		{"  pinned_at   DESC ", "pinned_at DESC", false},
+		{"cid asc", "cid ASC", false},
+		{"", "", true},
+		{"notes", "", true},
+		{"ends_at sideways", "", true},
+		{"ends_at DESC, cid", "", true},
+		{"ends_at; DROP TABLE objects", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := objectOrderBy(tt.order)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("objectOrderBy(%q) error = %v, want error %v", tt.order, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("objectOrderBy(%q) = %q, want %q", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNote(t *testing.T) {
+	tests := []struct {
+		name    string
+		note    string
+		want    string
+		wantErr error
+	}{
+		{"plain", "photos", "photos", nil},
+		{"surrounding space", "  photos\n", "photos", nil},
+		{"control characters", "pho\ttos\x07", "photos", nil},
+		{"unicode", "férias 📷", "férias 📷", nil},
+		{"empty", "", "", nil},
+		{"null byte", "pho\x00tos", "", errBinaryNote},
+		{"invalid utf-8", "pho\xfftos", "", errBinaryNote},
+		{"at the limit", "éééééééé", "éééééééé", nil},
+		{"over the limit", "ééééééééé", "", errNoteTooLong},
+		{"within the limit after trimming", "  éééééééé  ", "éééééééé", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, func(s *Settings) { s.MaxNoteLength = 8 })
+
+			got, err := sanitizeNote(tt.note)
+			if err != tt.wantErr {
+				t.Fatalf("sanitizeNote(%q) error = %v, want %v", tt.note, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("sanitizeNote(%q) = %q, want %q", tt.note, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCIDBlocked(t *testing.T) {
+	useSettings(t, func(s *Settings) {
+		s.CIDBlockThreshold = 2
+		s.CIDBlockCoolOff = 24 * time.Hour
+	})
+	useTestDB(t)
+
+	tests := []struct {
+		name        string
+		reasons     []string
+		ago         time.Duration
+		wantBlocked bool
+	}{
+		{"no failures", nil, 0, false},
+		{"below threshold", []string{"invalid"}, 0, false},
+		{"content failures", []string{"invalid", "exhausted"}, 0, true},
+		{"unresolvable", []string{"unresolvable", "unresolvable"}, time.Hour, true},
+		{"order failures", []string{"below_minimum", "over_quota", "queue_timeout"}, 0, false},
+		{"infra failures", []string{"infra_exhausted", "unreachable", "no_space"}, 0, false},
+		{"mixed", []string{"invalid", "over_quota"}, 0, false},
+		{"cooled off", []string{"invalid", "invalid"}, 25 * time.Hour, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid := fmt.Sprintf("Qm%d", i)
+			for _, reason := range tt.reasons {
+				pg.MustExec(`
+INSERT INTO events (kind, cid, detail, created_at)
+VALUES ('given_up', $1, $2, now() - make_interval(secs := $3))
+                `, cid, reason, tt.ago.Seconds())
+			}
+
+			err := checkCIDBlocked(cid)
+			if _, blocked := err.(*cidBlockedError); blocked != tt.wantBlocked {
+				t.Fatalf("checkCIDBlocked() = %v, want blocked %v", err, tt.wantBlocked)
+			}
+			if !tt.wantBlocked && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckCIDBlockedDisabled(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.CIDBlockThreshold = 0 })
+
+	// no database needed, nothing is looked up
+	if err := checkCIDBlocked("QmA"); err != nil {
+		t.Fatalf("checkCIDBlocked() = %v, want nil", err)
+	}
+}
+
+func TestSchemaMigration(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	schema, err := ioutil.ReadFile("postgres.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a deployment from when notes came from a function over the payments
+	pg.MustExec(`
+ALTER TABLE objects DROP COLUMN notes;
+CREATE FUNCTION notes(objects) RETURNS text[] AS $$
+  SELECT array_agg(note) FROM payments WHERE cid = $1.cid
+$$ LANGUAGE sql;
+INSERT INTO payments (order_id, cid, amount, status, note) VALUES
+  ('order1', 'QmA', 1000, 'pinned', 'photos'),
+  ('order2', 'QmA', 1000, 'pinned', ''),
+  ('order3', 'QmA', 1000, 'given_up', 'junk');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now(), interval '1 day');
+    `)
+
+	notes := func() string {
+		t.Helper()
+		var notes string
+		err := pg.Get(&notes, `SELECT array_to_string(notes, ',') FROM objects WHERE cid = 'QmA'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return notes
+	}
+
+	_, err = pg.Exec(string(schema))
+	if err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if got := notes(); got != "photos" {
+		t.Fatalf("migrated notes = %q, want photos", got)
+	}
+	var function bool
+	err = pg.Get(&function, `SELECT to_regprocedure('notes(objects)') IS NOT NULL`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if function {
+		t.Fatal("notes(objects) is still there after migrating")
+	}
+
+	// notes maintained since then survive running the schema again
+	err = addNote("QmA", "videos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg.Exec(string(schema))
+	if err != nil {
+		t.Fatalf("running again: %v", err)
+	}
+	if got := notes(); got != "photos,videos" {
+		t.Fatalf("notes after running again = %q, want photos,videos", got)
+	}
+}
+
+func TestFetchObjectNullNotes(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	// rows written before notes were kept non-null
+	pg.MustExec(`
+ALTER TABLE objects ALTER COLUMN notes DROP NOT NULL;
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes)
+VALUES ('QmA', 1, now(), interval '1 day', NULL);
+    `)
+
+	o, err := fetchObject("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Notes == nil || len(o.Notes) != 0 {
+		t.Errorf("fetchObject(QmA).Notes = %#v, want an empty slice", o.Notes)
+	}
+
+	oo, err := fetchObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oo) != 1 || oo[0].Notes == nil || len(oo[0].Notes) != 0 {
+		t.Errorf("fetchObjects() = %#v, want QmA with no notes", oo)
+	}
+}
+
+func TestFetchObjectsWithoutNotes(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	t.Cleanup(func() { atomic.StoreInt32(&notesMissing, 0) })
+
+	// a deployment that never got the notes
+	pg.MustExec(`
+ALTER TABLE objects DROP COLUMN notes;
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now(), interval '1 day');
+    `)
+
+	oo, err := fetchObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oo) != 1 || oo[0].CID != "QmA" || len(oo[0].Notes) != 0 {
+		t.Fatalf("fetchObjects() = %#v, want QmA without notes", oo)
+	}
+	if atomic.LoadInt32(&notesMissing) != 1 {
+		t.Fatal("the missing notes weren't remembered")
+	}
+
+	// later queries leave the notes out from the start
+	o, err := fetchObject("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil || len(o.Notes) != 0 {
+		t.Fatalf("fetchObject(QmA) = %#v, want it without notes", o)
+	}
+}
+
+func TestSavePaymentInvalid(t *testing.T) {
+	// refused before anything is written
+	tests := []struct {
+		name   string
+		amount int
+		d      orderDescription
+		want   error
+	}{
+		{"empty cid", 1000, orderDescription{CID: ""}, errEmptyCID},
+		{"blank cid", 1000, orderDescription{CID: "  "}, errEmptyCID},
+		{"zero amount", 0, orderDescription{CID: "QmA"}, errNonPositiveAmount},
+		{"negative amount", -1000, orderDescription{CID: "QmA"}, errNonPositiveAmount},
+		{"zero reusing nothing", 0, orderDescription{CID: "QmA", ReusedOrders: []string{""}},
+			errNonPositiveAmount},
+		{"negative reusing", -1, orderDescription{CID: "QmA", ReusedOrders: []string{"order0"}},
+			errNonPositiveAmount},
+	}
+
+	for _, tt := range tests {
+		err := savePayment("order1", tt.amount, tt.d)
+		if err != tt.want {
+			t.Errorf("%s: savePayment() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSavePayment(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status)
+VALUES ('order0', 'QmOld', 500, 'given_up');
+    `)
+
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// paid entirely with an earlier order
+	err = savePayment("order2", 0, orderDescription{CID: "QmB", ReusedOrders: []string{"order0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var amounts []int
+	err = pg.Select(&amounts, `
+SELECT amount FROM payments WHERE status = 'trying' ORDER BY order_id
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(amounts) != 2 || amounts[0] != 1000 || amounts[1] != 500 {
+		t.Fatalf("amounts = %v, want 1000 and 500", amounts)
+	}
+}
+
+func TestExtendAll(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 1, now() - interval '1 hour', interval '1 day'),
+  ('QmB', 2, now() - interval '10 days', interval '30 days'),
+  ('QmC', 1, now() - interval '2 days', interval '1 day');
+    `)
+
+	endsAt := func() map[string]time.Time {
+		t.Helper()
+		var oo []struct {
+			CID    string    `db:"cid"`
+			EndsAt time.Time `db:"ends_at"`
+		}
+		err := pg.Select(&oo, `SELECT cid, pinned_at + lifespan AS ends_at FROM objects`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends := make(map[string]time.Time)
+		for _, o := range oo {
+			ends[o.CID] = o.EndsAt
+		}
+		return ends
+	}
+
+	if _, err := extendAll(3*time.Hour, " "); err == nil {
+		t.Fatal("extendAll() without a reason succeeded")
+	}
+
+	before := endsAt()
+	n, err := extendAll(3*time.Hour, "outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("extendAll() = %d, want 2", n)
+	}
+
+	// every active object's end shifts by delta, the ended one stays ended
+	after := endsAt()
+	for cid, want := range map[string]time.Duration{"QmA": 3 * time.Hour, "QmB": 3 * time.Hour, "QmC": 0} {
+		if got := after[cid].Sub(before[cid]); got != want {
+			t.Errorf("%s ends %v later, want %v", cid, got, want)
+		}
+	}
+
+	tt, err := cidTimeline("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tt) != 1 || tt[0].Kind != "extended" || tt[0].Detail != "by 3h0m0s: outage" {
+		t.Fatalf("timeline = %+v, want the extension with its reason", tt)
+	}
+	tt, err = cidTimeline("QmC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tt) != 0 {
+		t.Fatalf("timeline of the ended object = %+v, want nothing", tt)
+	}
+}
+
+func TestCancelPayment(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, on_hold) VALUES
+  ('trying', 'QmA', 1000, 'trying', false),
+  ('queued', 'QmA', 1000, 'queued', false),
+  ('on_hold', 'QmA', 1000, 'trying', true),
+  ('pinned', 'QmA', 1000, 'pinned', false),
+  ('given_up', 'QmA', 1000, 'given_up', false),
+  ('cancelled', 'QmA', 1000, 'cancelled', false),
+  ('repurposed', 'QmA', 1000, 'repurposed', false);
+    `)
+
+	tests := []struct {
+		orderId string
+		wantErr error
+	}{
+		{"trying", nil},
+		{"queued", nil},
+		{"on_hold", nil},
+		{"pinned", errPaymentProcessed},
+		{"given_up", errPaymentProcessed},
+		{"cancelled", errPaymentProcessed},
+		{"repurposed", errPaymentProcessed},
+		{"unknown", errPaymentNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.orderId, func(t *testing.T) {
+			var before string
+			pg.Get(&before, `SELECT status FROM payments WHERE order_id = $1`, tt.orderId)
+
+			err := cancelPayment(tt.orderId)
+			if err != tt.wantErr {
+				t.Fatalf("cancelPayment() = %v, want %v", err, tt.wantErr)
+			}
+
+			var status string
+			pg.Get(&status, `SELECT status FROM payments WHERE order_id = $1`, tt.orderId)
+			want := before
+			if tt.wantErr == nil {
+				want = "cancelled"
+			}
+			if status != want {
+				t.Fatalf("status = %q, want %q", status, want)
+			}
+		})
+	}
+
+	// nothing is refunded, the amount is credit for a new order
+	err := savePayment("new", 0, orderDescription{CID: "QmB", ReusedOrders: []string{"trying"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var amount int
+	err = pg.Get(&amount, `SELECT amount FROM payments WHERE order_id = 'new'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount != 1000 {
+		t.Fatalf("new order's amount = %d, want the cancelled 1000", amount)
+	}
+}
+
+func TestNextExpiry(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	tests := []struct {
+		name string
+		seed string
+		want string
+	}{
+		{"empty", ``, ""},
+		{"only ended", `
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmEnded', 1, now() - interval '2 days', interval '1 day')`, ""},
+		{"one", `
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now(), interval '3 days')`, "QmA"},
+		{"many", `
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmB', 1, now() - interval '1 day', interval '2 days'),
+  ('QmC', 1, now(), interval '30 days')`, "QmB"},
+	}
+
+	// each step adds to the objects of the previous ones
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.seed != "" {
+				pg.MustExec(tt.seed)
+			}
+
+			o, err := nextExpiry()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if o != nil {
+				got = o.CID
+			}
+			if got != tt.want {
+				t.Fatalf("nextExpiry() = %q, want %q", got, tt.want)
+			}
+
+			w := httptest.NewRecorder()
+			getNextExpiry(w, httptest.NewRequest("GET", "/api/objects/next", nil))
+			var res *ObjectResponse
+			err = json.NewDecoder(w.Body).Decode(&res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (res == nil) != (tt.want == "") || (res != nil && res.CID != tt.want) {
+				t.Fatalf("GET /api/objects/next = %+v, want %q", res, tt.want)
+			}
+		})
+	}
+}
+
+func TestShrinkLifespan(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	// 47h left
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now() - interval '1 hour', interval '2 days')
+    `)
+
+	tests := []struct {
+		name         string
+		cid          string
+		delta        time.Duration
+		wantErr      bool
+		wantLifespan time.Duration
+	}{
+		{"valid", "QmA", 24 * time.Hour, false, 24 * time.Hour},
+		{"negative", "QmA", -time.Hour, true, 24 * time.Hour},
+		{"zero", "QmA", 0, true, 24 * time.Hour},
+		{"beyond the remaining time", "QmA", 24 * time.Hour, true, 24 * time.Hour},
+		{"unknown object", "QmB", time.Hour, true, 24 * time.Hour},
+		{"down to almost nothing", "QmA", 22 * time.Hour, false, 2 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := shrinkLifespan(tt.cid, tt.delta)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("shrinkLifespan() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.cid == "QmB" && err != errObjectNotFound {
+				t.Fatalf("shrinkLifespan() = %v, want %v", err, errObjectNotFound)
+			}
+
+			var secs float64
+			err = pg.Get(&secs, `SELECT extract(epoch FROM lifespan) FROM objects WHERE cid = 'QmA'`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Duration(secs) * time.Second; got != tt.wantLifespan {
+				t.Fatalf("lifespan = %v, want %v", got, tt.wantLifespan)
+			}
+		})
+	}
+}
+
+func TestFetchLargestObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmSmall', 0.1, now(), interval '1 day'),
+  ('QmBig', 5, now(), interval '1 day'),
+  ('QmMedium', 1, now(), interval '1 day'),
+  ('QmHuge', 8, now(), interval '1 day'),
+  ('QmEnded', 9, now() - interval '2 days', interval '1 day');
+    `)
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{1, "QmHuge"},
+		{3, "QmHuge,QmBig,QmMedium"},
+		{10, "QmHuge,QmBig,QmMedium,QmSmall"},
+	}
+
+	for _, tt := range tests {
+		oo, err := fetchLargestObjects(tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids := make([]string, len(oo))
+		for i, o := range oo {
+			cids[i] = o.CID
+		}
+		if got := strings.Join(cids, ","); got != tt.want {
+			t.Errorf("fetchLargestObjects(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFetchExpiredPaidObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, paid_at) VALUES
+  ('order1', 'QmA', 1000, 'pinned', $1::timestamp - interval '10 days'),
+  -- paid again after the erasure, for the object pinned now
+  ('order2', 'QmA', 1000, 'pinned', $1::timestamp - interval '1 day'),
+  ('order3', 'QmB', 1000, 'pinned', $1::timestamp - interval '60 days'),
+  ('order4', 'QmC', 1000, 'given_up', $1::timestamp - interval '10 days');
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at, erased_at) VALUES
+  ('QmA', 1, $1::timestamp - interval '10 days', $1::timestamp - interval '3 days',
+    $1::timestamp - interval '2 days'),
+  ('QmB', 1, $1::timestamp - interval '60 days', $1::timestamp - interval '50 days',
+    $1::timestamp - interval '49 days'),
+  ('QmC', 1, $1::timestamp - interval '10 days', $1::timestamp - interval '3 days',
+    $1::timestamp - interval '2 days');
+    `, now)
+
+	pp, err := fetchExpiredPaidObjects(now.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 1 || pp[0].OrderId != "order1" || !pp[0].EndsAt.Equal(now.AddDate(0, 0, -3)) ||
+		!pp[0].ErasedAt.Equal(now.AddDate(0, 0, -2)) {
+		t.Fatalf("fetchExpiredPaidObjects() = %+v, want order1's erased object", pp)
+	}
+
+	pp, err = fetchExpiredPaidObjects(now.AddDate(0, 0, -90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 2 || pp[1].OrderId != "order3" {
+		t.Fatalf("fetchExpiredPaidObjects() over 90 days = %+v, want order3 too", pp)
+	}
+}
+
+func TestResetPaymentTries(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, tries, infra_tries) VALUES
+  ('trying', 'QmA', 1000, 'trying', 3, 2),
+  ('queued', 'QmB', 1000, 'queued', 1, 4),
+  ('pinned', 'QmC', 1000, 'pinned', 2, 0),
+  ('given_up', 'QmD', 1000, 'given_up', 5, 0),
+  ('other', 'QmE', 1000, 'trying', 3, 1);
+    `)
+
+	tests := []struct {
+		orderId   string
+		wantErr   error
+		wantTries string
+	}{
+		{"trying", nil, "0,0"},
+		{"queued", nil, "0,0"},
+		{"pinned", errPaymentProcessed, "2,0"},
+		{"given_up", errPaymentProcessed, "5,0"},
+		{"unknown", errPaymentNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.orderId, func(t *testing.T) {
+			err := resetPaymentTries(tt.orderId)
+			if err != tt.wantErr {
+				t.Fatalf("resetPaymentTries() = %v, want %v", err, tt.wantErr)
+			}
+			var tries string
+			pg.Get(&tries, `
+SELECT tries || ',' || infra_tries FROM payments WHERE order_id = $1
+            `, tt.orderId)
+			if tries != tt.wantTries {
+				t.Fatalf("tries = %q, want %q", tries, tt.wantTries)
+			}
+		})
+	}
+
+	// the others are left alone
+	var status, tries string
+	err := pg.QueryRow(`
+SELECT status, tries || ',' || infra_tries FROM payments WHERE order_id = 'other'
+    `).Scan(&status, &tries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "trying" || tries != "3,1" {
+		t.Fatalf("other payment = %s %s, want it untouched", status, tries)
+	}
+}
+
+func TestCIDTimeline(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.KeepTombstones = true })
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, paid_at) VALUES
+  ('order1', 'QmA', 1000, 'pinned', $1::timestamp - interval '10 days'),
+  ('order2', 'QmA', 500, 'pinned', $1::timestamp - interval '9 days'),
+  ('order3', 'QmA', 2000, 'trying', $1::timestamp - interval '1 hour'),
+  ('order4', 'QmB', 1000, 'pinned', $1::timestamp - interval '10 days');
+INSERT INTO events (kind, cid, order_id, sizegb, detail, created_at) VALUES
+  ('pinned', 'QmA', 'order1', 1, '', $1::timestamp - interval '10 days' + interval '1 minute'),
+  ('renewed', 'QmA', 'order2', 1, '', $1::timestamp - interval '9 days' + interval '1 minute'),
+  ('extended', 'QmA', '', 1, 'by 3h0m0s: outage', $1::timestamp - interval '3 days'),
+  ('erased', 'QmA', '', 1, '', $1::timestamp - interval '1 day'),
+  ('pinned', 'QmB', 'order4', 1, '', $1::timestamp - interval '10 days');
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at, erased_at)
+VALUES ('QmA', 1, $1::timestamp - interval '10 days', $1::timestamp - interval '2 days',
+  $1::timestamp - interval '1 day');
+    `, now)
+
+	tt, err := cidTimeline("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tombstone stands for the erased event, with when the object ended
+	want := []string{"paid order1", "pinned order1", "paid order2", "renewed order2",
+		"extended ", "erased ", "paid order3"}
+	got := make([]string, len(tt))
+	for i, e := range tt {
+		got[i] = e.Kind + " " + e.OrderId
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("timeline = %v, want %v", got, want)
+	}
+	for i := 1; i < len(tt); i++ {
+		if tt[i].At.Before(tt[i-1].At) {
+			t.Fatalf("timeline out of order at %d: %+v", i, tt)
+		}
+	}
+	if erased := tt[5]; !strings.HasPrefix(erased.Detail, "ended at ") || erased.SizeGB != 1 {
+		t.Fatalf("erasure = %+v, want when the object ended", erased)
+	}
+	if tt[0].Amount != 1000 || tt[0].Detail != "pinned" {
+		t.Fatalf("first payment = %+v", tt[0])
+	}
+}
+
+func TestFetchUnlabeledObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes) VALUES
+  ('QmLabeled', 1, now(), interval '1 day', '{photos}'),
+  ('QmLater', 1, now(), interval '3 days', '{}'),
+  ('QmSooner', 1, now(), interval '2 days', '{}'),
+  ('QmEnded', 1, now() - interval '2 days', interval '1 day', '{}');
+    `)
+
+	oo, err := fetchUnlabeledObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids := make([]string, len(oo))
+	for i, o := range oo {
+		cids[i] = o.CID
+	}
+	if got := strings.Join(cids, ","); got != "QmSooner,QmLater" {
+		t.Fatalf("fetchUnlabeledObjects() = %s, want QmSooner,QmLater", got)
+	}
+
+	// labeling one takes it off the list
+	err = addNote("QmSooner", "videos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oo, err = fetchUnlabeledObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oo) != 1 || oo[0].CID != "QmLater" {
+		t.Fatalf("fetchUnlabeledObjects() after labeling = %+v, want QmLater", oo)
+	}
+}
+
+func TestFetchPaymentsByAmount(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status) VALUES
+  ('below', 'QmA', 99, 'pinned'),
+  ('min', 'QmA', 100, 'pinned'),
+  ('inside', 'QmA', 150, 'given_up'),
+  ('max', 'QmA', 200, 'trying'),
+  ('above', 'QmA', 201, 'pinned');
+    `)
+
+	tests := []struct {
+		min, max int
+		want     string
+	}{
+		{100, 200, "min,inside,max"},
+		{101, 199, "inside"},
+		{150, 150, "inside"},
+		{0, 99, "below"},
+		{300, 400, ""},
+		{200, 100, ""},
+	}
+
+	for _, tt := range tests {
+		pp, err := fetchPaymentsByAmount(tt.min, tt.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders := make([]string, len(pp))
+		for i, p := range pp {
+			orders[i] = p.OrderId
+		}
+		if got := strings.Join(orders, ","); got != tt.want {
+			t.Errorf("fetchPaymentsByAmount(%d, %d) = %s, want %s", tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	// replays follow the order events were recorded in, whatever their times
+	pg.MustExec(`
+INSERT INTO events (kind, cid, order_id, created_at) VALUES
+  ('pinned', 'QmA', 'order1', now() - interval '1 hour'),
+  ('renewed', 'QmA', 'order2', now() - interval '2 hours'),
+  ('pinned', 'QmB', 'order3', now()),
+  ('erased', 'QmA', '', now());
+    `)
+
+	var seen []string
+	err := replayEvents(func(e Event) error {
+		seen = append(seen, e.Kind+" "+e.CID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "pinned QmA, renewed QmA, pinned QmB, erased QmA"
+	if got := strings.Join(seen, ", "); got != want {
+		t.Fatalf("replayed %s, want %s", got, want)
+	}
+
+	// an error from the handler stops the replay
+	errStop := errors.New("stop")
+	n := 0
+	err = replayEvents(func(e Event) error {
+		n++
+		if e.Kind == "renewed" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 2 {
+		t.Fatalf("replayEvents() = %v after %d events, want %v after 2", err, n, errStop)
+	}
+}
+
+func TestSearchObjectsByCIDPrefix(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmAbc1', 1, now(), interval '1 day'),
+  ('QmAbc2', 1, now(), interval '1 day'),
+  ('QmXyz', 1, now(), interval '1 day'),
+  ('bafyabc', 1, now(), interval '1 day');
+    `)
+
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr error
+	}{
+		{"QmAbc", "QmAbc1,QmAbc2", nil},
+		{"QmAbc2", "QmAbc2", nil},
+		{"/ipfs/QmX", "QmXyz", nil},
+		{"BAFYA", "bafyabc", nil},
+		{"Qmabc", "", nil},
+		{"QmNothing", "", nil},
+		{"", "", errInvalidCID},
+		{"Qm%", "", errInvalidCID},
+		{"Qm_bc", "", errInvalidCID},
+	}
+
+	for _, tt := range tests {
+		oo, err := searchObjectsByCIDPrefix(tt.prefix)
+		if err != tt.wantErr {
+			t.Errorf("searchObjectsByCIDPrefix(%q) error = %v, want %v", tt.prefix, err, tt.wantErr)
+			continue
+		}
+		cids := make([]string, len(oo))
+		for i, o := range oo {
+			cids[i] = o.CID
+		}
+		if got := strings.Join(cids, ","); got != tt.want {
+			t.Errorf("searchObjectsByCIDPrefix(%q) = %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+
+	// results are bounded
+	for i := 0; i < maxPrefixResults+5; i++ {
+		pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ($1, 1, now(), interval '1 day')
+        `, fmt.Sprintf("QmMany%03d", i))
+	}
+	oo, err := searchObjectsByCIDPrefix("QmMany")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oo) != maxPrefixResults {
+		t.Fatalf("got %d objects, want at most %d", len(oo), maxPrefixResults)
+	}
+}
+
+func TestFetchUnpaidObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmPaid', 1, now(), interval '1 day'),
+  ('QmAdmin', 1, now(), interval '1 day'),
+  ('QmPending', 1, now(), interval '2 days');
+INSERT INTO payments (order_id, cid, amount, status) VALUES
+  ('order1', 'QmPaid', 1000, 'pinned'),
+  -- not processed yet, doesn't pay for anything
+  ('order2', 'QmPending', 1000, 'trying');
+    `)
+
+	oo, err := fetchUnpaidObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids := make([]string, len(oo))
+	for i, o := range oo {
+		cids[i] = o.CID
+	}
+	if got := strings.Join(cids, ","); got != "QmAdmin,QmPending" {
+		t.Fatalf("fetchUnpaidObjects() = %s, want QmAdmin,QmPending", got)
+	}
+}
+
+func TestExportPinset(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmB', 1, $1::timestamp - interval '1 day', interval '3 days'),
+  ('QmA', 1, $1, interval '1 day'),
+  -- expired but not erased yet
+  ('QmExpired', 1, $1::timestamp - interval '2 days', interval '1 day');
+-- erased, so only a tombstone is left
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at)
+VALUES ('QmErased', 1, $1::timestamp - interval '2 days', $1::timestamp + interval '1 day');
+    `, now)
+
+	want := []PinsetEntry{
+		{"QmA", now.Add(24 * time.Hour)},
+		{"QmB", now.Add(48 * time.Hour)},
+	}
+
+	entries, err := exportPinset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("exportPinset() = %v, want %v", entries, want)
+	}
+	for i, e := range entries {
+		if e.CID != want[i].CID || !e.EndsAt.Equal(want[i].EndsAt) {
+			t.Errorf("entry %d = %v, want %v", i, e, want[i])
+		}
+	}
+
+	w := httptest.NewRecorder()
+	listPinset(w, httptest.NewRequest("GET", "/api/pinset", nil))
+	var res []PinsetEntryResponse
+	err = json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].CID != "QmA" || res[1].CID != "QmB" {
+		t.Fatalf("listPinset() = %v", res)
+	}
+}
+
+// cutWriter takes left writes, then fails as if the client went away.
+type cutWriter struct {
+	cids []string
+	left int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if w.left == 0 {
+		return 0, errors.New("connection reset")
+	}
+	w.left--
+	var o ObjectResponse
+	err := json.Unmarshal(p, &o)
+	if err != nil {
+		return 0, err
+	}
+	w.cids = append(w.cids, o.CID)
+	return len(p), nil
+}
+
+func TestExportObjectsResume(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmE', 1, now(), interval '1 day'),
+  ('QmB', 1, now(), interval '1 day'),
+  ('QmD', 1, now(), interval '1 day'),
+  ('QmA', 1, now(), interval '1 day'),
+  ('QmC', 1, now(), interval '1 day'),
+  ('QmEnded', 1, now() - interval '2 days', interval '1 day');
+    `)
+
+	first := &cutWriter{left: 2}
+	err := exportObjects(first, "")
+	if err == nil {
+		t.Fatal("exportObjects() = nil with the writer failing")
+	}
+	if got := strings.Join(first.cids, ","); got != "QmA,QmB" {
+		t.Fatalf("before the cut = %s, want QmA,QmB", got)
+	}
+
+	rest := &cutWriter{left: -1}
+	err = exportObjects(rest, first.cids[len(first.cids)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rest.cids, ","); got != "QmC,QmD,QmE" {
+		t.Fatalf("resumed = %s, want QmC,QmD,QmE", got)
+	}
+}
+
+func TestFetchStuckPayments(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, tries, paid_at, last_try_at) VALUES
+  ('stuck', 'QmA', 1000, 'trying', 2, now() - interval '3 hours', now() - interval '2 hours'),
+  ('stuck-queued', 'QmB', 1000, 'queued', 1, now() - interval '3 hours', now() - interval '2 hours'),
+  ('healthy', 'QmC', 1000, 'trying', 3, now() - interval '3 hours', now() - interval '5 minutes'),
+  -- never tried, it's waiting rather than stuck
+  ('untried', 'QmD', 1000, 'trying', 0, now() - interval '3 hours', NULL),
+  ('done', 'QmE', 1000, 'pinned', 2, now() - interval '3 hours', now() - interval '2 hours'),
+  ('dead', 'QmF', 1000, 'given_up', 5, now() - interval '3 hours', now() - interval '2 hours');
+    `)
+
+	pp, err := fetchStuckPayments(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(pp))
+	for i, p := range pp {
+		ids[i] = p.OrderId
+	}
+	sort.Strings(ids)
+	if got := strings.Join(ids, ","); got != "stuck,stuck-queued" {
+		t.Fatalf("fetchStuckPayments() = %s, want stuck,stuck-queued", got)
+	}
+}
+
+func TestIsPinned(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmPinned', 1, now() - interval '1 day', interval '2 days'),
+  -- ended, though eraseEnded hasn't got to it yet
+  ('QmExpired', 1, now() - interval '2 days', interval '1 day');
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at)
+VALUES ('QmErased', 1, now() - interval '2 days', now() + interval '1 day');
+    `)
+
+	tests := []struct {
+		cid  string
+		want bool
+	}{
+		{"QmPinned", true},
+		{"QmExpired", false},
+		{"QmErased", false},
+		{"QmAbsent", false},
+	}
+	for _, tt := range tests {
+		pinned, err := isPinned(tt.cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pinned != tt.want {
+			t.Errorf("isPinned(%s) = %v, want %v", tt.cid, pinned, tt.want)
+		}
+
+		r := httptest.NewRequest("GET", "/api/object/"+tt.cid+"/pinned", nil)
+		r = mux.SetURLVars(r, map[string]string{"cid": tt.cid})
+		w := httptest.NewRecorder()
+		getPinned(w, r)
+		var res struct{ Pinned bool }
+		err = json.NewDecoder(w.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 200 || res.Pinned != tt.want {
+			t.Errorf("getPinned(%s) = %d %v, want %v", tt.cid, w.Code, res.Pinned, tt.want)
+		}
+	}
+}
+
+func TestFetchObjectsPinnedBetweenZones(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, '2024-01-01 12:00', interval '1 day');
+    `)
+
+	tokyo := time.FixedZone("JST", 9*3600)
+	newYork := time.FixedZone("EST", -5*3600)
+	tests := []struct {
+		from, to time.Time
+	}{
+		{time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		// the same range from elsewhere
+		{time.Date(2024, 1, 1, 20, 0, 0, 0, tokyo), time.Date(2024, 1, 1, 22, 0, 0, 0, tokyo)},
+		{time.Date(2024, 1, 1, 6, 0, 0, 0, newYork), time.Date(2024, 1, 1, 8, 0, 0, 0, newYork)},
+	}
+	for _, tt := range tests {
+		oo, err := fetchObjectsPinnedBetween(tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(oo) != 1 {
+			t.Errorf("fetchObjectsPinnedBetween(%s, %s) = %d objects, want QmA",
+				tt.from.Format(time.RFC3339), tt.to.Format(time.RFC3339), len(oo))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// requestError is a failure with a message meant for the client.
+type requestError struct {
+	Status  int
+	Message string
+}
+
+func (e *requestError) Error() string { return e.Message }
+
+func badRequest(message string) error { return &requestError{400, message} }
+
+// errorStatus maps the errors handlers get to the HTTP status they mean.
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case *requestError:
+		return e.Status
+	case *cidBlockedError:
+		return 429
+	case *quotaError:
+		return 409
+	case *amountTooLowError:
+		return 400
+	case *pinError:
+		switch e.Class {
+		case pinErrInvalid, pinErrUnresolvable, pinErrTooLarge:
+			return 400
+		case pinErrUnreachable, pinErrCancelled:
+			return 503
+		}
+		return 500
+	}
+
+	switch err {
+	case errPaymentNotFound, errObjectNotFound:
+		return 404
+	case errPaymentProcessed, errCapacityFull, errNoReceipt:
+		return 409
+	case errShrinkTooLarge, errInvalidCID, errImplausibleDuration,
+		errEmptyCID, errNonPositiveAmount,
+		errBinaryNote, errNoteTooLong, errTooManyNotes:
+		return 400
+	case errRateUnavailable:
+		return 503
+	}
+	return 500
+}
+
+// writeError responds with the status err maps to and a JSON body. details of
+// internal errors aren't sent, handlers log them.
+func writeError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	message := err.Error()
+	if _, ok := err.(*requestError); !ok && status >= 500 {
+		message = http.StatusText(status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{message, status})
+}
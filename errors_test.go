@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{badRequest("invalid json"), 400},
+		{&requestError{406, "invoice not paid"}, 406},
+		{&cidBlockedError{time.Now()}, 429},
+		{&quotaError{}, 409},
+		{&amountTooLowError{}, 400},
+		{errPaymentNotFound, 404},
+		{errObjectNotFound, 404},
+		{errPaymentProcessed, 409},
+		{errCapacityFull, 409},
+		{errNoReceipt, 409},
+		{errInvalidCID, 400},
+		{errEmptyCID, 400},
+		{errNonPositiveAmount, 400},
+		{errNoteTooLong, 400},
+		{errRateUnavailable, 503},
+		{errors.New("pq: connection reset"), 500},
+	}
+
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("errorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantMessage string
+	}{
+		{"client error", errNoteTooLong, 400, "note is too long"},
+		{"request error", &requestError{500, "failed to fetch objects list"}, 500,
+			"failed to fetch objects list"},
+		{"internal error", errors.New("pq: password authentication failed"), 500,
+			"Internal Server Error"},
+		{"unavailable", errRateUnavailable, 503, "Service Unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, tt.err)
+
+			var body struct {
+				Error  string `json:"error"`
+				Status int    `json:"status"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.wantStatus || body.Status != tt.wantStatus {
+				t.Fatalf("status = %d (%d in the body), want %d", w.Code, body.Status, tt.wantStatus)
+			}
+			if body.Error != tt.wantMessage {
+				t.Fatalf("error = %q, want %q", body.Error, tt.wantMessage)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("content type = %q", ct)
+			}
+		})
+	}
+}
+
+func TestPaymentCallbackInvalidPrice(t *testing.T) {
+	for _, price := range []string{"", "abc", "1.5"} {
+		form := url.Values{"order_id": {"order1"}, "price": {price}, "id": {"charge1"},
+			"description": {"QmA ←  ← "}}
+		r := httptest.NewRequest("POST", "/callback/order", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		paymentCallback(w, r)
+
+		if w.Code != 400 {
+			t.Errorf("price %q: status = %d, want 400", price, w.Code)
+		}
+		// a single error and nothing written after it
+		dec := json.NewDecoder(w.Body)
+		var body map[string]interface{}
+		if err := dec.Decode(&body); err != nil {
+			t.Errorf("price %q: %v", price, err)
+		}
+		if dec.More() {
+			t.Errorf("price %q: more written after the error", price)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+type Event struct {
+	Id        int64     `json:"id" db:"id"`
+	Kind      string    `json:"kind" db:"kind"`
+	CID       string    `json:"cid" db:"cid"`
+	OrderId   string    `json:"order_id,omitempty" db:"order_id"`
+	SizeGB    float64   `json:"sizegb,omitempty" db:"sizegb"`
+	Detail    string    `json:"detail,omitempty" db:"detail"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func recordEvent(kind, cid, orderId string, sizegb float64) {
+	_, err := pg.Exec(`
+INSERT INTO events (kind, cid, order_id, sizegb)
+VALUES ($1, $2, $3, $4)
+    `, kind, cid, orderId, sizegb)
+	if err != nil {
+		log.Warn().Err(err).Str("kind", kind).Str("cid", cid).
+			Msg("failed to record event")
+	}
+}
+
+type TimelineEvent struct {
+	At      time.Time `json:"at" db:"at"`
+	Kind    string    `json:"kind" db:"kind"`
+	OrderId string    `json:"order_id,omitempty" db:"order_id"`
+	Amount  int       `json:"amount,omitempty" db:"amount"`
+	SizeGB  float64   `json:"sizegb,omitempty" db:"sizegb"`
+	Detail  string    `json:"detail,omitempty" db:"detail"`
+}
+
+// cidTimeline is everything that happened to cid, oldest first: its payments,
+// the events recorded for it and its erasures.
+func cidTimeline(cid string) (tt []TimelineEvent, err error) {
+	tt = make([]TimelineEvent, 0)
+	err = pg.Select(&tt, `
+SELECT paid_at AS at, 'paid' AS kind, order_id, amount, 0 AS sizegb,
+  status::text AS detail
+FROM payments WHERE cid = $1
+UNION ALL
+SELECT created_at, kind, order_id, 0, sizegb, detail
+FROM events WHERE cid = $1
+  AND (kind != 'erased' OR NOT EXISTS (SELECT 1 FROM erased_objects WHERE cid = $1))
+UNION ALL
+-- tombstones, when kept, also know when the erased object had ended
+SELECT erased_at, 'erased', '', 0, sizegb, 'ended at ' || ends_at::text
+FROM erased_objects WHERE cid = $1
+ORDER BY at ASC
+    `, cid)
+	return
+}
+
+// EventHandler is given events one at a time, an error stops the replay.
+type EventHandler func(e Event) error
+
+// replayEvents streams every event to handler in the order they happened, to
+// rebuild state derived from them.
+func replayEvents(handler EventHandler) error {
+	rows, err := pg.Queryx(`
+SELECT id, kind, cid, order_id, sizegb, detail, created_at
+FROM events
+ORDER BY id ASC
+    `)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := Event{}
+		err = rows.StructScan(&e)
+		if err != nil {
+			return err
+		}
+		err = handler(e)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
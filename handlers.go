@@ -1,22 +1,34 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"github.com/lucsky/cuid"
 	"github.com/tidwall/gjson"
 )
 
 func getGlobals(w http.ResponseWriter, r *http.Request) {
+	// the price orders are charged at, in satoshis whatever it's set in
+	priceGB, err := satsPriceGB()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	price, _ := priceGB.Float64()
+
 	globals := struct {
-		PriceGB       int64    `json:"priceGB"`
+		PriceGB       float64  `json:"priceGB"`
 		IPFSID        string   `json:"ipfsID"`
 		IPFSAddresses []string `json:"ipfsAddresses"`
-	}{s.PriceGB, "temporarily offline", make([]string, 0)}
+	}{price, "temporarily offline", make([]string, 0)}
 
 	info, err := ipfs.ID()
 	if err != nil {
@@ -32,15 +44,19 @@ func getGlobals(w http.ResponseWriter, r *http.Request) {
 func orderCreate(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "invalid json", 400)
+		writeError(w, badRequest("invalid json"))
 		return
 	}
 
-	res := gjson.GetManyBytes(data, "cid", "note", "amount", "reused_orders")
+	res := gjson.GetManyBytes(data,
+		"cid", "note", "amount", "reused_orders", "owner", "path", "encryption")
 	cid := res[0].String()
 	note := res[1].String()
 	amount := res[2].Int()
 	reusedOrders := res[3]
+	owner := res[4].String()
+	path := strings.Trim(res[5].String(), "/")
+	encryption := res[6].String()
 
 	orders := make([]string, len(reusedOrders.Array()))
 	var i = 0
@@ -51,50 +67,129 @@ func orderCreate(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if amount == 0 && len(orders) == 0 {
-		http.Error(w, "cannot pay zero", 400)
+		writeError(w, badRequest("cannot pay zero"))
+		return
+	}
+
+	note, err = sanitizeNote(note)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
 	if len(note) > 23 && len(note) > int(amount) {
-		http.Error(w, "note length should not be greater than 23 or amount paid", 400)
+		writeError(w, badRequest("note length should not be greater than 23 or amount paid"))
+		return
+	}
+
+	if strings.Contains(owner, SEPARATOR) || len(owner) > 64 {
+		writeError(w, badRequest("invalid owner"))
+		return
+	}
+	if owner == "" && s.MaxOwnerGB > 0 {
+		// it'd be given up once paid
+		writeError(w, badRequest("an owner is required"))
+		return
+	}
+
+	if strings.Contains(path, SEPARATOR) || len(path) > 512 {
+		writeError(w, badRequest("invalid path"))
 		return
 	}
 
-	log.Info().Int64("amount", amount).Str("cid", cid).Str("note", note).
+	if encryption != "" && !encryptionSchemes[encryption] {
+		writeError(w, badRequest("unknown encryption scheme"))
+		return
+	}
+
+	log.Info().Str("amount", formatAmount(amount)).Str("cid", cid).Str("note", note).
 		Msg("payment order")
 
 	cid = toCID(cid)
 	if cid == "" {
-		http.Error(w, "wrong cid", 400)
+		writeError(w, badRequest("wrong cid"))
 		return
 	}
 
+	if path != "" {
+		// pin and charge just for the selected part, remembering where it was
+		// selected from.
+		sub, err := resolvePath(cid, path)
+		if err != nil {
+			log.Info().Err(err).Str("cid", cid).Str("path", path).
+				Msg("path not resolvable")
+			writeError(w, err)
+			return
+		}
+		path = cid + "/" + path
+		cid = sub
+	}
+
+	err = checkCIDBlocked(cid)
+	if err != nil {
+		if _, ok := err.(*cidBlockedError); !ok {
+			log.Error().Err(err).Str("cid", cid).Msg("failed to check blocked cid")
+		}
+		writeError(w, err)
+		return
+	}
+
+	if amount > 0 {
+		// reused orders only add up when processing, so those are checked then.
+		o, err := fetchObject(cid)
+		if err != nil {
+			log.Error().Err(err).Str("cid", cid).Msg("failed to fetch object")
+			writeError(w, err)
+			return
+		}
+		err = checkMinAmount(amount, o != nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if s.RequireResolve {
+		// check before an invoice exists, as a paid order can't be rejected.
+		err = checkResolvable(cid, s.ResolveTimeout)
+		if err != nil {
+			log.Info().Err(err).Str("cid", cid).Msg("cid not resolvable")
+			writeError(w, err)
+			return
+		}
+	}
+
 	var order_id string
 	var invoice string
 	if amount == 0 {
 		// end the order here, don't generate an invoice
 		order_id = cuid.New()
-		err = savePayment(order_id, cid, 0, note, orders)
+		err = savePayment(order_id, 0, orderDescription{cid, orders, owner, path, encryption, note})
 		if err != nil {
 			log.Error().Err(err).
 				Str("cid", cid).
 				Msg("error saving payment with just reused orders.")
+			writeError(w, err)
+			return
 		}
 
-		go func() {
-			err := processPayments()
-			log.Error().Err(err).
-				Msg("failed to process payments after getting pure-reuse order")
-		}()
+		goBackground(func() {
+			err := processPayment(order_id)
+			if err != nil {
+				log.Error().Err(err).Str("order_id", order_id).
+					Msg("failed to process pure-reuse order")
+			}
+		})
 	} else {
 		// the process will continue on the webhook we'll get from opennode
-		invoice, order_id, err = makeInvoice(cid, note, amount, orders)
+		invoice, order_id, err = makeInvoice(
+			orderDescription{cid, orders, owner, path, encryption, note}, amount)
 		if err != nil {
 			log.Warn().Err(err).
 				Str("order_id", order_id).
-				Str("cid", cid).Int64("amount", amount).Str("note", note).
+				Str("cid", cid).Str("amount", formatAmount(amount)).Str("note", note).
 				Msg("error making invoice")
-			http.Error(w, "error making invoice, please contact us", 500)
+			writeError(w, &requestError{500, "error making invoice, please contact us"})
 			return
 		}
 	}
@@ -111,11 +206,51 @@ func orderStatus(w http.ResponseWriter, r *http.Request) {
 	p, err := fetchPayment(order_id)
 	if err != nil {
 		log.Print(err)
-		http.Error(w, "", 400)
+		writeError(w, badRequest("failed to fetch payment"))
+		return
+	}
+
+	json.NewEncoder(w).Encode(paymentResponse(p))
+}
+
+// orderCancel is DELETE /api/order/{orderId}, for payments not processed yet.
+// there's no refund: the cancelled payment is credit for a new order, given in
+// its reused_orders. processed payments can't be cancelled (409).
+func orderCancel(w http.ResponseWriter, r *http.Request) {
+	order_id := mux.Vars(r)["orderId"]
+
+	err := cancelPayment(order_id)
+	if err != nil {
+		if errorStatus(err) >= 500 {
+			log.Error().Err(err).Str("order_id", order_id).Msg("failed to cancel payment")
+		}
+		writeError(w, err)
+		return
+	}
+
+	p, err := fetchPayment(order_id)
+	if err != nil {
+		log.Print(err)
+		writeError(w, badRequest("failed to fetch payment"))
 		return
 	}
 
-	json.NewEncoder(w).Encode(p)
+	json.NewEncoder(w).Encode(paymentResponse(p))
+}
+
+func orderReceipt(w http.ResponseWriter, r *http.Request) {
+	order_id := mux.Vars(r)["orderId"]
+
+	receipt, err := fetchReceipt(order_id)
+	if err != nil {
+		if errorStatus(err) >= 500 {
+			log.Error().Err(err).Str("order_id", order_id).Msg("failed to fetch receipt")
+		}
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(receiptResponse(receipt))
 }
 
 func paymentCallback(w http.ResponseWriter, r *http.Request) {
@@ -126,33 +261,45 @@ func paymentCallback(w http.ResponseWriter, r *http.Request) {
 
 	log.Info().Str("oi", order_id).Str("p", price).Msg("payment callback")
 
-	cid, reusedOrders, note := splitDescription(description)
+	d := splitDescription(description)
 
 	paidAmount, err := strconv.Atoi(price)
 	if err != nil {
 		log.Warn().Err(err).Str("price", price).Str("id", id).
 			Msg("got wrong 'price' from opennode callback")
-		http.Error(w, "", 400)
+		writeError(w, badRequest("invalid price"))
+		return
 	}
 
 	if isInvoicePaid(id) {
-		err = savePayment(order_id, cid, paidAmount, note, reusedOrders)
+		err = savePayment(order_id, paidAmount, d)
+		if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "23505" {
+			// a repeated callback, the payment is saved and being processed
+			log.Info().Str("order_id", order_id).Msg("payment already saved")
+			w.WriteHeader(200)
+			return
+		}
 		if err != nil {
 			log.Error().Err(err).
-				Str("cid", cid).
-				Int("amount", paidAmount).
+				Str("cid", d.CID).
+				Str("amount", formatAmount(int64(paidAmount))).
 				Msg("error saving payment")
+			// opennode calls again on errors, it's saved then
+			writeError(w, err)
+			return
 		}
 
-		go func() {
-			err := processPayments()
-			log.Error().Err(err).
-				Msg("failed to process payments after getting a payment")
-		}()
+		goBackground(func() {
+			err := processPayment(order_id)
+			if err != nil {
+				log.Error().Err(err).Str("order_id", order_id).
+					Msg("failed to process order after getting its payment")
+			}
+		})
 	} else {
 		log.Warn().Err(err).Str("id", id).
 			Msg("invoice reported as paid but not actually paid, why?")
-		http.Error(w, "", 406)
+		writeError(w, &requestError{406, "invoice not paid"})
 		return
 	}
 
@@ -160,37 +307,343 @@ func paymentCallback(w http.ResponseWriter, r *http.Request) {
 }
 
 func listObjects(w http.ResponseWriter, r *http.Request) {
-	objs, err := fetchObjects()
+	order := r.URL.Query().Get("order")
+	if order == "" {
+		order = "ends_at ASC"
+	}
+	if _, err := objectOrderBy(order); err != nil {
+		writeError(w, badRequest(err.Error()))
+		return
+	}
+
+	objs, err := fetchObjectsOrdered(order)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to fetch objects list")
-		http.Error(w, "failed to fetch objects list", 500)
+		writeError(w, &requestError{500, "failed to fetch objects list"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(objectsResponse(objs))
+}
+
+func listObjectsPinnedBetween(w http.ResponseWriter, r *http.Request) {
+	from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	if err != nil {
+		writeError(w, badRequest("invalid 'from' date"))
+		return
+	}
+	to, err := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if err != nil {
+		writeError(w, badRequest("invalid 'to' date"))
+		return
+	}
+
+	objs, err := fetchObjectsPinnedBetween(from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch objects pinned between dates")
+		writeError(w, &requestError{500, "failed to fetch objects list"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(objectsResponse(objs))
+}
+
+// searchObjects finds the objects whose cid starts with the given prefix.
+func searchObjects(w http.ResponseWriter, r *http.Request) {
+	objs, err := searchObjectsByCIDPrefix(r.URL.Query().Get("prefix"))
+	if err != nil {
+		if errorStatus(err) >= 500 {
+			log.Error().Err(err).Msg("failed to search objects")
+		}
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(objectsResponse(objs))
+}
+
+// listNotes counts the active objects carrying each note, for filtering by
+// them.
+func listNotes(w http.ResponseWriter, r *http.Request) {
+	nn, err := distinctNotes()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch notes")
+		writeError(w, &requestError{500, "failed to fetch notes"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(nn)
+}
+
+// getNextExpiry is the object that ends first, null when there's none.
+func getNextExpiry(w http.ResponseWriter, r *http.Request) {
+	obj, err := nextExpiry()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to fetch next expiring object")
+		writeError(w, &requestError{500, "failed to fetch next expiring object"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(objectResponse(obj))
+}
+
+func listRemainingBuckets(w http.ResponseWriter, r *http.Request) {
+	buckets, err := objectsByRemainingBucket()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to group objects by remaining lifespan")
+		writeError(w, &requestError{500, "failed to fetch objects list"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(buckets)
+}
+
+func exportObjectsStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	err := exportObjects(w, r.URL.Query().Get("after"))
+	if err != nil {
+		// headers are gone by now, the client will see a truncated stream
+		// and can resume from the last cid it got.
+		log.Error().Err(err).Msg("failed to export objects")
+	}
+}
+
+func getEstimate(w http.ResponseWriter, r *http.Request) {
+	cid := toCID(r.URL.Query().Get("cid"))
+	if cid == "" {
+		writeError(w, badRequest("wrong cid"))
+		return
+	}
+	amount, err := strconv.Atoi(r.URL.Query().Get("amount"))
+	if err != nil || amount <= 0 {
+		writeError(w, badRequest("invalid amount"))
 		return
 	}
 
-	json.NewEncoder(w).Encode(objs)
+	duration, err := estimateDuration(cid, amount)
+	if err != nil {
+		if errorStatus(err) >= 500 {
+			log.Error().Err(err).Str("cid", cid).Msg("failed to estimate duration")
+		}
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Seconds int64   `json:"seconds"`
+		Days    float64 `json:"days"`
+	}{int64(duration.Seconds()), duration.Hours() / 24})
+}
+
+// getTimeline is everything that happened to cid, oldest first.
+// getPinned is a cheap check of whether cid is pinned, without its details.
+func getPinned(w http.ResponseWriter, r *http.Request) {
+	cid := toCID(mux.Vars(r)["cid"])
+
+	pinned, err := isPinned(cid)
+	if err != nil {
+		log.Error().Err(err).Str("cid", cid).Msg("failed to check pinned cid")
+		writeError(w, &requestError{500, "failed to check pinned cid"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Pinned bool `json:"pinned"`
+	}{pinned})
+}
+
+func getTimeline(w http.ResponseWriter, r *http.Request) {
+	cid := toCID(mux.Vars(r)["cid"])
+
+	tt, err := cidTimeline(cid)
+	if err != nil {
+		log.Error().Err(err).Str("cid", cid).Msg("failed to fetch timeline")
+		writeError(w, &requestError{500, "failed to fetch timeline"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(tt)
+}
+
+// listErased tells when cid was erased before, if tombstones are kept.
+func listErased(w http.ResponseWriter, r *http.Request) {
+	cid := toCID(mux.Vars(r)["cid"])
+
+	ee, err := fetchErased(cid)
+	if err != nil {
+		log.Error().Err(err).Str("cid", cid).Msg("failed to fetch erased objects")
+		writeError(w, &requestError{500, "failed to fetch erased objects"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(ee)
+}
+
+// getRenewalPreview tells when the object would end if renewed with amount.
+func getRenewalPreview(w http.ResponseWriter, r *http.Request) {
+	cid := toCID(mux.Vars(r)["cid"])
+	amount, err := strconv.Atoi(r.URL.Query().Get("amount"))
+	if err != nil || amount <= 0 {
+		writeError(w, badRequest("invalid amount"))
+		return
+	}
+
+	endsAt, err := previewRenewal(cid, amount)
+	if err != nil {
+		if errorStatus(err) >= 500 {
+			log.Error().Err(err).Str("cid", cid).Msg("failed to preview renewal")
+		}
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		EndsAt time.Time `json:"ends_at"`
+	}{endsAt.In(displayLocation)})
+}
+
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		writeError(w, badRequest("invalid 'at' date"))
+		return
+	}
+
+	entries, err := snapshot(at)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to take snapshot")
+		writeError(w, &requestError{500, "failed to take snapshot"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(snapshotResponse(entries))
+}
+
+func getStorageDrift(w http.ResponseWriter, r *http.Request) {
+	drift, err := storageDrift()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to compute storage drift")
+		writeError(w, &requestError{500, "failed to compute storage drift"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(drift)
+}
+
+func listPinset(w http.ResponseWriter, r *http.Request) {
+	entries, err := exportPinset()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to export pinset")
+		writeError(w, &requestError{500, "failed to export pinset"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(pinsetResponse(entries))
+}
+
+func getObjectCAR(w http.ResponseWriter, r *http.Request) {
+	cid := toCID(mux.Vars(r)["cid"])
+
+	// check before writing anything, errors can't be sent once it streams
+	pinned, err := isPinned(cid)
+	if err != nil {
+		log.Error().Err(err).Str("cid", cid).Msg("failed to check pinned cid")
+		writeError(w, err)
+		return
+	}
+	if !pinned {
+		writeError(w, errObjectNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+cid+`.car"`)
+	err = exportCAR(cid, w)
+	if err != nil {
+		log.Error().Err(err).Str("cid", cid).Msg("failed to export car")
+	}
 }
 
 func getObject(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "invalid json", 400)
+		writeError(w, badRequest("invalid json"))
 		return
 	}
 
-	cid := gjson.GetBytes(data, "cid").String()
+	cid := toCID(gjson.GetBytes(data, "cid").String())
 	obj, err := fetchObject(cid)
+	if err != nil || obj == nil {
+		writeError(w, &requestError{404, "object not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(objectResponse(obj))
+}
+
+// getHealth also tells how long the oldest pending payment has waited, for
+// alerting on a backed up pipeline.
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	health := struct {
+		Database      bool    `json:"database"`
+		IPFS          bool    `json:"ipfs"`
+		Maintenance   bool    `json:"maintenance"`
+		OldestPending float64 `json:"oldest_pending_seconds"`
+	}{pg.Ping() == nil, ipfs.IsUp(), inMaintenance(), 0}
+
+	if health.Database {
+		age, err := oldestUnprocessedAge()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to get the oldest pending payment")
+		}
+		health.OldestPending = age.Seconds()
+	}
+
+	if !health.Database || !health.IPFS {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// cronAuth lets requests through only if they carry CronSecret as a bearer
+// token. without a CronSecret, handlers that aren't required to be protected
+// are open, as the jobs were before there was one, and the others refused.
+func cronAuth(handler http.HandlerFunc, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.CronSecret == "" {
+			if required {
+				writeError(w, &requestError{403, "CRON_SECRET isn't set"})
+				return
+			}
+			handler(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.CronSecret)) != 1 {
+			writeError(w, &requestError{401, "invalid cron secret"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func maintenanceMode(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.FormValue("on"))
 	if err != nil {
-		http.Error(w, "object not found", 404)
+		writeError(w, badRequest("'on' must be true or false"))
 		return
 	}
 
-	json.NewEncoder(w).Encode(obj)
+	setMaintenance(on)
+	w.WriteHeader(200)
 }
 
 func periodicJob(w http.ResponseWriter, r *http.Request) {
 	log.Info().Msg("periodic job")
 
-	go func() {
+	goBackground(func() {
 		err := processPayments()
 		if err != nil {
 			log.Error().Err(err).Msg("failed to process payments on periodic job")
@@ -201,7 +654,38 @@ func periodicJob(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Error().Err(err).Msg("failed to erase ended")
 		}
-	}()
+
+		err = repinMissing()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to repin missing")
+		}
+	})
+
+	w.WriteHeader(200)
+}
+
+func dailyJob(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msg("daily job")
+
+	goBackground(func() {
+		err := emitDailySummary()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to emit daily summary")
+		}
+	})
+
+	w.WriteHeader(200)
+}
+
+func verifyJob(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msg("verify job")
+
+	goBackground(func() {
+		err := verifyObjects()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to verify objects")
+		}
+	})
 
 	w.WriteHeader(200)
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCronAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		required bool
+		header   string
+		want     int
+	}{
+		{"open without a secret", "", false, "", 200},
+		{"required without a secret", "", true, "Bearer anything", 403},
+		{"right secret", "s3cret", false, "Bearer s3cret", 200},
+		{"right secret where required", "s3cret", true, "Bearer s3cret", 200},
+		{"wrong secret", "s3cret", false, "Bearer guess", 401},
+		{"no header", "s3cret", true, "", 401},
+		{"secret prefix", "s3cret", false, "Bearer s3c", 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, func(s *Settings) { s.CronSecret = tt.secret })
+
+			called := false
+			handler := cronAuth(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(200)
+			}, tt.required)
+
+			r := httptest.NewRequest("POST", "/cron/periodic", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if called != (tt.want == 200) {
+				t.Fatalf("handler called = %v with status %d", called, w.Code)
+			}
+		})
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	defer setMaintenance(false)
+
+	tests := []struct {
+		on     string
+		want   int
+		wantOn bool
+	}{
+		{"true", 200, true},
+		{"false", 200, false},
+		{"1", 200, true},
+		{"yes", 400, true}, // unchanged
+		{"", 400, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/cron/maintenance?on="+tt.on, nil)
+		w := httptest.NewRecorder()
+		maintenanceMode(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("on=%q: status = %d, want %d", tt.on, w.Code, tt.want)
+		}
+		if inMaintenance() != tt.wantOn {
+			t.Errorf("on=%q: in maintenance = %v, want %v", tt.on, inMaintenance(), tt.wantOn)
+		}
+	}
+}
+
+func TestOrderCreateInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"zero amount", `{"cid": "QmA", "amount": 0}`, "cannot pay zero"},
+		{"binary note", `{"cid": "QmA", "amount": 1000, "note": "a\u0000b"}`, "notes must be text"},
+		{"note over amount", `{"cid": "QmA", "amount": 10, "note": "a note that's longer than 23"}`,
+			"note length should not be greater than 23 or amount paid"},
+		{"owner with separator", `{"cid": "QmA", "amount": 1000, "owner": "a ← b"}`, "invalid owner"},
+		{"long owner", `{"cid": "QmA", "amount": 1000, "owner": "` + strings.Repeat("a", 65) + `"}`,
+			"invalid owner"},
+		{"path with separator", `{"cid": "QmA", "amount": 1000, "path": "a ← b"}`, "invalid path"},
+		{"long path", `{"cid": "QmA", "amount": 1000, "path": "` + strings.Repeat("a", 513) + `"}`,
+			"invalid path"},
+		{"unknown encryption", `{"cid": "QmA", "amount": 1000, "encryption": "rot13"}`,
+			"unknown encryption scheme"},
+		{"no cid", `{"cid": " /ipfs/ ", "amount": 1000}`, "wrong cid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, nil)
+
+			r := httptest.NewRequest("POST", "/api/order", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			orderCreate(w, r)
+
+			if w.Code != 400 {
+				t.Fatalf("status = %d, want 400", w.Code)
+			}
+			if got := errorMessage(t, w); got != tt.want {
+				t.Fatalf("error = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// errorMessage is the message of the single error written to w.
+func errorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	dec := json.NewDecoder(w.Body)
+	err := dec.Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.More() {
+		t.Fatal("more written after the error")
+	}
+	return body.Error
+}
+
+func TestGetEstimateInvalid(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"amount=1000", "wrong cid"},
+		{"cid=/ipfs/&amount=1000", "wrong cid"},
+		{"cid=QmA", "invalid amount"},
+		{"cid=QmA&amount=abc", "invalid amount"},
+		{"cid=QmA&amount=0", "invalid amount"},
+		{"cid=QmA&amount=-5", "invalid amount"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/estimate?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		getEstimate(w, r)
+
+		if w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", tt.query, w.Code)
+		}
+		if got := errorMessage(t, w); got != tt.want {
+			t.Errorf("%s: error = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestListObjectsPinnedBetweenInvalid(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "invalid 'from' date"},
+		{"from=yesterday&to=2024-01-02T00:00:00Z", "invalid 'from' date"},
+		{"from=2024-01-01T00:00:00Z", "invalid 'to' date"},
+		{"from=2024-01-01T00:00:00Z&to=2024-01-02", "invalid 'to' date"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/objects/pinned?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		listObjectsPinnedBetween(w, r)
+
+		if w.Code != 400 {
+			t.Errorf("%q: status = %d, want 400", tt.query, w.Code)
+		}
+		if got := errorMessage(t, w); got != tt.want {
+			t.Errorf("%q: error = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGetSnapshotInvalid(t *testing.T) {
+	for _, at := range []string{"", "now", "2024-01-01"} {
+		r := httptest.NewRequest("GET", "/api/snapshot?at="+at, nil)
+		w := httptest.NewRecorder()
+		getSnapshot(w, r)
+
+		if w.Code != 400 {
+			t.Errorf("at=%q: status = %d, want 400", at, w.Code)
+		}
+		if got := errorMessage(t, w); got != "invalid 'at' date" {
+			t.Errorf("at=%q: error = %q", at, got)
+		}
+	}
+}
+
+func TestOrderCreateNeedsOwner(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxOwnerGB = 1 })
+
+	r := httptest.NewRequest("POST", "/api/order", strings.NewReader(`{"cid": "QmA", "amount": 1000}`))
+	w := httptest.NewRecorder()
+	orderCreate(w, r)
+
+	if w.Code != 400 {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	if got := errorMessage(t, w); got != "an owner is required" {
+		t.Fatalf("error = %q", got)
+	}
+}
+
+func TestOrderCreateMissingPath(t *testing.T) {
+	useSettings(t, nil)
+	node := useFakeNode(t)
+	serveResolve(node, nil)
+
+	r := httptest.NewRequest("POST", "/api/order",
+		strings.NewReader(`{"cid": "QmDir", "path": "/missing/", "amount": 1000}`))
+	w := httptest.NewRecorder()
+	orderCreate(w, r)
+
+	if w.Code != 400 {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	if got := node.called("resolve"); len(got) != 1 || got[0] != "/ipfs/QmDir/missing" {
+		t.Fatalf("resolved %v, want /ipfs/QmDir/missing", got)
+	}
+}
+
+func TestGetRenewalPreviewInvalid(t *testing.T) {
+	for _, amount := range []string{"", "abc", "0", "-5"} {
+		r := httptest.NewRequest("GET", "/api/object/QmA/renewal?amount="+amount, nil)
+		r = mux.SetURLVars(r, map[string]string{"cid": "QmA"})
+		w := httptest.NewRecorder()
+		getRenewalPreview(w, r)
+
+		if w.Code != 400 {
+			t.Errorf("amount=%q: status = %d, want 400", amount, w.Code)
+		}
+		if got := errorMessage(t, w); got != "invalid amount" {
+			t.Errorf("amount=%q: error = %q", amount, got)
+		}
+	}
+}
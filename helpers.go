@@ -1,6 +1,15 @@
 package main
 
-import "strings"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 func filterOutLocal(multiaddresses []string) []string {
 	addresses := make([]string, 0, len(multiaddresses))
@@ -19,3 +28,159 @@ func filterOutLocal(multiaddresses []string) []string {
 
 	return addresses
 }
+
+func postWebhook(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// background tracks work started by requests that outlives them, so it can
+// be waited for on shutdown.
+var background sync.WaitGroup
+
+func goBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+func waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flightGroup runs at most one call per key at a time, callers arriving while
+// it runs get the same result instead of calling again.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+
+	// for calls made with DoContext
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.val, c.err
+}
+
+// DoContext is Do for calls that can be cancelled. the shared call runs on a
+// context of its own, cancelled only once every caller waiting for it has
+// given up, so one caller going away doesn't fail the others. callers whose
+// ctx ends first get ctx.Err().
+func (g *flightGroup) DoContext(ctx context.Context, key string,
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+
+		go func() {
+			c.val, c.err = fn(callCtx)
+			close(c.done)
+			cancel()
+
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// callers arriving from now on start a call of their own
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// formatAmount renders an amount in the smallest unit (e.g. satoshis) in the
+// configured currency, e.g. 500 with 8 decimals and BTC is "0.00000500 BTC".
+func formatAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	if s.AmountDecimals > 0 {
+		if len(digits) <= s.AmountDecimals {
+			digits = strings.Repeat("0", s.AmountDecimals-len(digits)+1) + digits
+		}
+		point := len(digits) - s.AmountDecimals
+		digits = digits[:point] + "." + digits[point:]
+	}
+
+	return sign + digits + " " + s.AmountCurrency
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupShares(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.Do("cid", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return 42, nil
+			})
+		}(i)
+	}
+
+	// let every caller join the call before it finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("fn ran %d times, want once", calls)
+	}
+	for i, r := range results {
+		if r != 42 {
+			t.Fatalf("caller %d got %v", i, r)
+		}
+	}
+
+	// once done, the next call runs again
+	g.Do("cid", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	if calls != 2 {
+		t.Fatalf("fn ran %d times after the first call finished, want twice", calls)
+	}
+}
+
+func TestFlightGroupDoContext(t *testing.T) {
+	tests := []struct {
+		name string
+		// which of two callers give up before the call finishes
+		cancelFirst, cancelSecond bool
+		wantFnCancelled           bool
+	}{
+		{"nobody leaves", false, false, false},
+		{"one leaves", true, false, false},
+		{"everybody leaves", true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g flightGroup
+			release := make(chan struct{})
+			fnErr := make(chan error, 1)
+			fn := func(ctx context.Context) (interface{}, error) {
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+				fnErr <- ctx.Err()
+				return "pinned", ctx.Err()
+			}
+
+			type result struct {
+				val interface{}
+				err error
+			}
+			call := func(ctx context.Context) chan result {
+				out := make(chan result, 1)
+				go func() {
+					val, err := g.DoContext(ctx, "cid", fn)
+					out <- result{val, err}
+				}()
+				return out
+			}
+
+			ctx1, cancel1 := context.WithCancel(context.Background())
+			defer cancel1()
+			ctx2, cancel2 := context.WithCancel(context.Background())
+			defer cancel2()
+
+			first := call(ctx1)
+			time.Sleep(20 * time.Millisecond)
+			second := call(ctx2)
+			time.Sleep(20 * time.Millisecond)
+
+			if tt.cancelFirst {
+				cancel1()
+				if r := <-first; r.err != context.Canceled {
+					t.Fatalf("first caller got %v, want context.Canceled", r.err)
+				}
+			}
+			if tt.cancelSecond {
+				cancel2()
+				if r := <-second; r.err != context.Canceled {
+					t.Fatalf("second caller got %v, want context.Canceled", r.err)
+				}
+			}
+
+			select {
+			case err := <-fnErr:
+				if !tt.wantFnCancelled {
+					t.Fatalf("fn stopped with %v while callers were waiting", err)
+				}
+				if err != context.Canceled {
+					t.Fatalf("fn stopped with %v, want context.Canceled", err)
+				}
+				return
+			case <-time.After(20 * time.Millisecond):
+				if tt.wantFnCancelled {
+					t.Fatal("fn wasn't cancelled after every caller left")
+				}
+			}
+
+			close(release)
+			if !tt.cancelFirst {
+				if r := <-first; r.val != "pinned" || r.err != nil {
+					t.Fatalf("first caller got %v, %v", r.val, r.err)
+				}
+			}
+			if r := <-second; r.val != "pinned" || r.err != nil {
+				t.Fatalf("second caller got %v, %v", r.val, r.err)
+			}
+		})
+	}
+}
+
+func TestFlightGroupDoContextAbandoned(t *testing.T) {
+	var g flightGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+
+	go g.DoContext(ctx, "cid", func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+
+	// a caller after everybody left gets a call of its own, not the cancelled one
+	val, err := g.DoContext(context.Background(), "cid", func(ctx context.Context) (interface{}, error) {
+		return "fresh", nil
+	})
+	if val != "fresh" || err != nil {
+		t.Fatalf("DoContext() = %v, %v, want a fresh call", val, err)
+	}
+}
+
+func TestFlightGroupDoContextError(t *testing.T) {
+	var g flightGroup
+	failed := errors.New("pin failed")
+
+	_, err := g.DoContext(context.Background(), "cid", func(ctx context.Context) (interface{}, error) {
+		return nil, failed
+	})
+	if err != failed {
+		t.Fatalf("DoContext() error = %v, want %v", err, failed)
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		decimals int
+		currency string
+		want     string
+	}{
+		{500, 8, "BTC", "0.00000500 BTC"},
+		{123456789, 8, "BTC", "1.23456789 BTC"},
+		{100000000, 8, "BTC", "1.00000000 BTC"},
+		{0, 8, "BTC", "0.00000000 BTC"},
+		{-500, 8, "BTC", "-0.00000500 BTC"},
+		{500, 0, "sat", "500 sat"},
+		{5, 2, "USD", "0.05 USD"},
+		{1234, 2, "USD", "12.34 USD"},
+	}
+
+	for _, tt := range tests {
+		useSettings(t, func(s *Settings) {
+			s.AmountDecimals = tt.decimals
+			s.AmountCurrency = tt.currency
+		})
+
+		if got := formatAmount(tt.amount); got != tt.want {
+			t.Errorf("formatAmount(%d) = %q, want %q", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestFilterOutLocal(t *testing.T) {
+	got := filterOutLocal([]string{
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/10.0.0.2/tcp/4001",
+		"/ip4/192.168.1.2/tcp/4001",
+		"/ip6/::1/tcp/4001",
+		"/ip4/203.0.113.7/tcp/4001",
+	})
+	if len(got) != 1 || got[0] != "/ip4/203.0.113.7/tcp/4001" {
+		t.Fatalf("filterOutLocal() = %v", got)
+	}
+}
+
+func TestWaitBackground(t *testing.T) {
+	// a webhook delivery still going on when shutting down
+	delivered := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		delivered <- struct{}{}
+	}))
+	defer srv.Close()
+
+	goBackground(func() {
+		err := postWebhook(srv.URL, struct{}{})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-delivered:
+	default:
+		t.Fatal("waitBackground() returned before the delivery finished")
+	}
+}
+
+func TestWaitBackgroundDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	goBackground(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := waitBackground(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("waitBackground() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestQueuedEventsPersistedOnShutdown(t *testing.T) {
+	useTestDB(t)
+
+	for i := 0; i < 3; i++ {
+		goBackground(func() {
+			time.Sleep(20 * time.Millisecond)
+			recordEvent("pinned", "QmA", "", 1)
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	err = pg.Get(&n, `SELECT count(*) FROM events WHERE cid = 'QmA'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("%d events written, want 3", n)
+	}
+}
@@ -1,11 +1,121 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/c2h5oh/datasize"
+	shell "github.com/ipfs/go-ipfs-api"
 )
 
+type pinErrorClass string
+
+const (
+	pinErrUnknown      pinErrorClass = "unknown"
+	pinErrInvalid      pinErrorClass = "invalid"
+	pinErrUnresolvable pinErrorClass = "unresolvable"
+	pinErrNoSpace      pinErrorClass = "no_space"
+	pinErrUnreachable  pinErrorClass = "unreachable"
+	pinErrTooLarge     pinErrorClass = "too_large"
+	pinErrCancelled    pinErrorClass = "cancelled" // by us, not the content
+)
+
+type pinError struct {
+	Class pinErrorClass
+	Err   error
+}
+
+func (e *pinError) Error() string {
+	return string(e.Class) + ": " + e.Err.Error()
+}
+
+// retryable tells if trying the same pin again later could succeed.
+func (e *pinError) retryable() bool {
+	return e.Class != pinErrInvalid && e.Class != pinErrTooLarge
+}
+
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *pinError:
+		return e.retryable()
+	case *quotaError, *amountTooLowError:
+		return false
+	}
+	return err != errImplausibleDuration
+}
+
+// isInfraError tells if err comes from the node, the database or the like
+// rather than from the content being pinned.
+func isInfraError(err error) bool {
+	if perr, ok := err.(*pinError); ok {
+		return perr.Class == pinErrUnreachable || perr.Class == pinErrNoSpace ||
+			perr.Class == pinErrCancelled
+	}
+	return true
+}
+
+// errorClass names why processing a payment failed, so given up payments can
+// be told apart.
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case *pinError:
+		return string(e.Class)
+	case *quotaError:
+		return "over_quota"
+	case *amountTooLowError:
+		return "below_minimum"
+	}
+	if err == errImplausibleDuration {
+		return "implausible_duration"
+	}
+	return string(pinErrUnknown)
+}
+
+func classifyPinError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*pinError); ok {
+		return err
+	}
+
+	class := pinErrUnknown
+	msg := strings.ToLower(err.Error())
+
+	switch err.(type) {
+	case *url.Error, *net.OpError:
+		class = pinErrUnreachable
+	default:
+		switch {
+		case strings.Contains(msg, "connection refused"),
+			strings.Contains(msg, "no such host"):
+			class = pinErrUnreachable
+		case strings.Contains(msg, "no space left"),
+			strings.Contains(msg, "storage limit"):
+			class = pinErrNoSpace
+		case strings.Contains(msg, "invalid path"),
+			strings.Contains(msg, "invalid cid"),
+			strings.Contains(msg, "no link named"),
+			strings.Contains(msg, "selected encoding not supported"):
+			class = pinErrInvalid
+		case strings.Contains(msg, "context canceled"):
+			class = pinErrCancelled
+		case strings.Contains(msg, "not found"),
+			strings.Contains(msg, "deadline exceeded"):
+			class = pinErrUnresolvable
+		}
+	}
+
+	return &pinError{class, err}
+}
+
 func toCID(cid string) string {
 	if strings.Contains(cid, "/ipfs/") {
 		cid = strings.Split(cid, "/ipfs/")[1]
@@ -13,20 +123,236 @@ func toCID(cid string) string {
 	return strings.TrimSpace(cid)
 }
 
+// concurrent payments for the same cid share a single size lookup and pin.
+var sizeFlights, pinFlights flightGroup
+
 func size(cid string) (float64, error) {
-	stats, err := ipfs.ObjectStat(cid)
+	size, err := sizeFlights.Do(cid, func() (interface{}, error) {
+		stats, err := ipfs.ObjectStat(cid)
+		if err != nil {
+			return 0.0, classifyPinError(err)
+		}
+		return datasize.ByteSize(stats.CumulativeSize).GBytes(), nil
+	})
+	return size.(float64), err
+}
+
+func checkResolvable(cid string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stats struct{ Hash string }
+	err := ipfs.Request("object/stat", cid).Exec(ctx, &stats)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return &pinError{pinErrUnresolvable,
+			errors.New("cid couldn't be resolved on the network")}
+	}
+	return classifyPinError(err)
+}
+
+// resolvePath gives the cid of the dag at path inside cid, so only that part
+// of a bigger dag can be pinned and paid for.
+func resolvePath(cid, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ResolveTimeout)
+	defer cancel()
+
+	var res struct{ Path string }
+	err := ipfs.Request("resolve", "/ipfs/"+cid+"/"+path).Exec(ctx, &res)
 	if err != nil {
-		return 0, err
+		if ctx.Err() != nil {
+			return "", &pinError{pinErrUnresolvable,
+				errors.New("path couldn't be resolved on the network")}
+		}
+		return "", classifyPinError(err)
 	}
+	return toCID(res.Path), nil
+}
 
-	size := datasize.ByteSize(stats.CumulativeSize).GBytes()
-	return size, nil
+// pin pins cid recursively and returns the size the node actually stores for
+// it, or zero if that can't be told. a non-empty name is set as the pin's
+// name on the node, so its pin list can be matched back to orders. concurrent
+// pins of cid share the one started first, named after its order, which goes
+// on until all of them are cancelled.
+func pin(ctx context.Context, cid, name string) (float64, error) {
+	size, err := pinFlights.DoContext(ctx, cid, func(ctx context.Context) (interface{}, error) {
+		req := ipfs.Request("pin/add", cid).Option("recursive", true)
+		if name != "" {
+			req = req.Option("name", name)
+		}
+		err := req.Exec(ctx, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0.0, &pinError{pinErrCancelled, err}
+			}
+			return 0.0, classifyPinError(err)
+		}
+
+		// the content is pinned by now, so failing to measure it mustn't fail
+		// the pin. callers fall back to their estimate on a zero size.
+		stored, err := storedSize(cid)
+		if err != nil {
+			log.Warn().Err(err).Str("cid", cid).Msg("failed to get pinned size")
+			return 0.0, nil
+		}
+		return stored, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, &pinError{pinErrCancelled, err}
+		}
+		return 0, err
+	}
+	return size.(float64), nil
 }
 
-func pin(cid string) error {
-	return ipfs.Pin(cid)
+func storedSize(cid string) (float64, error) {
+	var stat struct {
+		Size      uint64
+		NumBlocks int
+	}
+	err := ipfs.Request("dag/stat", cid).
+		Option("progress", false).
+		Option("offline", true).
+		Exec(context.Background(), &stat)
+	if err != nil {
+		return 0, err
+	}
+	return datasize.ByteSize(stat.Size).GBytes(), nil
 }
 
 func unpin(cid string) error {
+	if remotePinning() {
+		err := remoteUnpin(cid)
+		if err != nil {
+			log.Warn().Err(err).Str("cid", cid).Msg("failed to remove remote pin")
+		}
+	}
 	return ipfs.Unpin(cid)
 }
+
+func nodeHasPin(cid string) (bool, error) {
+	var res struct {
+		Keys map[string]shell.PinInfo
+	}
+	err := ipfs.Request("pin/ls", cid).
+		Option("type", "recursive").
+		Exec(context.Background(), &res)
+	if err != nil {
+		if strings.Contains(err.Error(), "not pinned") {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(res.Keys) > 0, nil
+}
+
+// verifyUnpinned waits a little for the node to actually drop the pin, as
+// unpinning may return before the pin is gone.
+func verifyUnpinned(cid string) error {
+	for i := 1; i <= 3; i++ {
+		pinned, err := nodeHasPin(cid)
+		if err != nil {
+			return err
+		}
+		if !pinned {
+			return nil
+		}
+		time.Sleep(time.Duration(i) * time.Second)
+	}
+	return fmt.Errorf("%s still pinned after unpin", cid)
+}
+
+type RepoStat struct {
+	RepoSize   uint64
+	StorageMax uint64
+	NumObjects uint64
+}
+
+func repoStat() (stat RepoStat, err error) {
+	err = ipfs.Request("repo/stat").Exec(context.Background(), &stat)
+	return
+}
+
+// verifyRetrievable walks the whole dag of cid using only the blocks the node
+// has locally. it returns false if any of them is missing or unreadable.
+func verifyRetrievable(cid string) (bool, error) {
+	resp, err := ipfs.Request("refs", cid).
+		Option("recursive", true).
+		Option("offline", true).
+		Send(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return false, nil
+	}
+
+	dec := json.NewDecoder(resp.Output)
+	for {
+		var ref struct {
+			Ref string
+			Err string
+		}
+		err = dec.Decode(&ref)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if ref.Err != "" {
+			return false, nil
+		}
+	}
+}
+
+func dagExport(cid string) (io.ReadCloser, error) {
+	resp, err := ipfs.Request("dag/export", cid).Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		resp.Close()
+		return nil, resp.Error
+	}
+	return resp.Output, nil
+}
+
+var errInvalidCID = errors.New("invalid cid")
+
+// exportCAR streams cid as a CAR file from the node, as long as it's pinned
+// here, so it can't be used to download arbitrary content through us. cid
+// must be normalized already, as by toCID.
+func exportCAR(cid string, w io.Writer) error {
+	if cid == "" || strings.ContainsAny(cid, "/ ") {
+		return errInvalidCID
+	}
+
+	pinned, err := isPinned(cid)
+	if err != nil {
+		return err
+	}
+	if !pinned {
+		return errObjectNotFound
+	}
+
+	car, err := dagExport(cid)
+	if err != nil {
+		return err
+	}
+	defer car.Close()
+
+	_, err = io.Copy(w, car)
+	return err
+}
+
+func dagImport(car io.Reader) error {
+	return ipfs.Request("dag/import").
+		Option("pin-roots", false).
+		FileBody(car).
+		Exec(context.Background(), nil)
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// fakeNode is an ipfs node answering the commands used here from the content
+// it was given, for the rest of the test.
+type fakeNode struct {
+	sync.Mutex
+	// sizes in bytes of the content the node can fetch, by cid
+	sizes map[string]uint64
+	// sizes dag/stat reports when they differ from the above
+	stored map[string]uint64
+	// pinned cids and the names they were pinned with
+	pins  map[string]string
+	calls []fakeCall
+
+	repoSize, storageMax uint64
+
+	// handle, if set, gets every request first and tells if it answered it,
+	// e.g. with an error or after a delay.
+	handle func(w http.ResponseWriter, r *http.Request, call fakeCall) bool
+}
+
+type fakeCall struct {
+	Cmd     string
+	Arg     string
+	Options url.Values
+}
+
+func useFakeNode(t *testing.T) *fakeNode {
+	t.Helper()
+
+	node := &fakeNode{
+		sizes:  make(map[string]uint64),
+		stored: make(map[string]uint64),
+		pins:   make(map[string]string),
+	}
+	srv := httptest.NewServer(node)
+
+	saved := ipfs
+	ipfs = shell.NewShell(srv.URL)
+	t.Cleanup(func() {
+		ipfs = saved
+		srv.Close()
+	})
+	return node
+}
+
+// called lists the arguments cmd was called with, in order.
+func (n *fakeNode) called(cmd string) []string {
+	n.Lock()
+	defer n.Unlock()
+
+	args := make([]string, 0)
+	for _, c := range n.calls {
+		if c.Cmd == cmd {
+			args = append(args, c.Arg)
+		}
+	}
+	return args
+}
+
+func (n *fakeNode) pinned(cid string) bool {
+	n.Lock()
+	defer n.Unlock()
+	_, ok := n.pins[cid]
+	return ok
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	call := fakeCall{strings.TrimPrefix(r.URL.Path, "/api/v0/"), r.Form.Get("arg"), r.Form}
+
+	n.Lock()
+	n.calls = append(n.calls, call)
+	n.Unlock()
+
+	if n.handle != nil && n.handle(w, r, call) {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	size, known := n.sizes[call.Arg]
+	_, pinned := n.pins[call.Arg]
+	send := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	fail := func(msg string) {
+		w.WriteHeader(500)
+		send(struct{ Message string }{msg})
+	}
+
+	switch call.Cmd {
+	case "id":
+		send(struct{ ID string }{"fake"})
+	case "object/stat":
+		if !known {
+			fail("merkledag: not found")
+			return
+		}
+		send(struct {
+			Hash           string
+			CumulativeSize uint64
+		}{call.Arg, size})
+	case "dag/stat":
+		if stored, ok := n.stored[call.Arg]; ok {
+			size = stored
+		}
+		send(struct{ Size uint64 }{size})
+	case "pin/add":
+		if !known {
+			fail("merkledag: not found")
+			return
+		}
+		n.pins[call.Arg] = r.Form.Get("name")
+		send(struct{ Pins []string }{[]string{call.Arg}})
+	case "pin/rm":
+		if !pinned {
+			fail("not pinned or pinned indirectly")
+			return
+		}
+		delete(n.pins, call.Arg)
+		send(struct{ Pins []string }{[]string{call.Arg}})
+	case "pin/ls":
+		if call.Arg != "" && !pinned {
+			fail("path '" + call.Arg + "' is not pinned")
+			return
+		}
+		keys := make(map[string]shell.PinInfo)
+		for cid := range n.pins {
+			if call.Arg == "" || cid == call.Arg {
+				keys[cid] = shell.PinInfo{Type: shell.RecursivePin}
+			}
+		}
+		if r.Form.Get("stream") == "true" {
+			for cid := range keys {
+				send(struct{ Cid, Type string }{cid, shell.RecursivePin})
+			}
+			return
+		}
+		send(struct{ Keys map[string]shell.PinInfo }{keys})
+	case "repo/stat":
+		send(RepoStat{RepoSize: n.repoSize, StorageMax: n.storageMax})
+	case "refs":
+		if !known {
+			fail("merkledag: not found")
+			return
+		}
+		send(struct{ Ref string }{call.Arg})
+	case "dag/export":
+		if !known {
+			fail("merkledag: not found")
+			return
+		}
+		w.Write([]byte("car of " + call.Arg))
+	case "dag/import":
+		ioutil.ReadAll(r.Body)
+		send(struct{}{})
+	default:
+		w.WriteHeader(404)
+		send(struct{ Message string }{"unknown command " + call.Cmd})
+	}
+}
+
+func TestClassifyPinError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want pinErrorClass
+	}{
+		{"url error", &url.Error{Op: "Post", URL: "http://ipfs", Err: errors.New("eof")}, pinErrUnreachable},
+		{"net error", &net.OpError{Op: "dial", Err: errors.New("eof")}, pinErrUnreachable},
+		{"connection refused", errors.New("dial tcp: Connection refused"), pinErrUnreachable},
+		{"no such host", errors.New("lookup ipfs: no such host"), pinErrUnreachable},
+		{"no space", errors.New("write: no space left on device"), pinErrNoSpace},
+		{"storage limit", errors.New("pin: storage limit reached"), pinErrNoSpace},
+		{"invalid path", errors.New("invalid path \"x\""), pinErrInvalid},
+		{"invalid cid", errors.New("invalid cid: selected encoding not supported"), pinErrInvalid},
+		{"cancelled", errors.New("Post \"http://ipfs\": context canceled"), pinErrCancelled},
+		{"not found", errors.New("merkledag: not found"), pinErrUnresolvable},
+		{"deadline", errors.New("context deadline exceeded"), pinErrUnresolvable},
+		{"anything else", errors.New("something broke"), pinErrUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perr, ok := classifyPinError(tt.err).(*pinError)
+			if !ok {
+				t.Fatalf("classifyPinError() isn't a *pinError")
+			}
+			if perr.Class != tt.want || perr.Err != tt.err {
+				t.Fatalf("classifyPinError() = %v, want class %s", perr, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyPinErrorKeepsClass(t *testing.T) {
+	if classifyPinError(nil) != nil {
+		t.Fatal("classifyPinError(nil) != nil")
+	}
+
+	err := &pinError{pinErrTooLarge, errors.New("not found")}
+	if got := classifyPinError(err); got != err {
+		t.Fatalf("classifyPinError() = %v, want the error unchanged", got)
+	}
+}
+
+func TestPinErrorKinds(t *testing.T) {
+	tests := []struct {
+		class     pinErrorClass
+		retryable bool
+		infra     bool
+		status    int
+	}{
+		{pinErrUnknown, true, false, 500},
+		{pinErrInvalid, false, false, 400},
+		{pinErrUnresolvable, true, false, 400},
+		{pinErrNoSpace, true, true, 500},
+		{pinErrUnreachable, true, true, 503},
+		{pinErrTooLarge, false, false, 400},
+		{pinErrCancelled, true, true, 503},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.class), func(t *testing.T) {
+			err := &pinError{tt.class, errors.New("failed")}
+			if got := isRetryable(err); got != tt.retryable {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.retryable)
+			}
+			if got := isInfraError(err); got != tt.infra {
+				t.Errorf("isInfraError() = %v, want %v", got, tt.infra)
+			}
+			if got := errorStatus(err); got != tt.status {
+				t.Errorf("errorStatus() = %d, want %d", got, tt.status)
+			}
+			if got := errorClass(err); got != string(tt.class) {
+				t.Errorf("errorClass() = %s, want %s", got, tt.class)
+			}
+		})
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&quotaError{}, "over_quota"},
+		{&amountTooLowError{}, "below_minimum"},
+		{errImplausibleDuration, "implausible_duration"},
+		{errors.New("database is down"), "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestToCID(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"QmHash", "QmHash"},
+		{"  QmHash\n", "QmHash"},
+		{"/ipfs/QmHash", "QmHash"},
+		{"https://gateway.example/ipfs/QmHash", "QmHash"},
+		{"https://gateway.example/ipfs/ QmHash ", "QmHash"},
+	}
+
+	for _, tt := range tests {
+		if got := toCID(tt.in); got != tt.want {
+			t.Errorf("toCID(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyUnpinned(t *testing.T) {
+	tests := []struct {
+		name string
+		// how many times pin/ls still lists the pin, -1 for failing instead
+		listed  int
+		wantErr bool
+	}{
+		{"unpinned", 0, false},
+		{"reports pinned once then unpinned", 1, false},
+		{"node error", -1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := useFakeNode(t)
+			listed := 0
+			node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+				if call.Cmd != "pin/ls" {
+					return false
+				}
+				if tt.listed < 0 {
+					w.WriteHeader(500)
+					w.Write([]byte(`{"Message": "datastore closed"}`))
+					return true
+				}
+				if listed < tt.listed {
+					listed++
+					w.Write([]byte(`{"Keys": {"QmA": {"Type": "recursive"}}}`))
+					return true
+				}
+				return false
+			}
+
+			err := verifyUnpinned("QmA")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyUnpinned() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.listed >= 0 && listed != tt.listed {
+				t.Fatalf("pin listed %d times, want %d", listed, tt.listed)
+			}
+		})
+	}
+}
+
+func TestPinName(t *testing.T) {
+	node := useFakeNode(t)
+	node.sizes["QmA"] = 1 << 20
+	node.sizes["QmB"] = 1 << 20
+
+	_, err := pin(context.Background(), "QmA", "order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pin(context.Background(), "QmB", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range node.calls {
+		if c.Cmd != "pin/add" {
+			continue
+		}
+		name, named := c.Options["name"]
+		switch c.Arg {
+		case "QmA":
+			if !named || name[0] != "order1" {
+				t.Errorf("QmA pinned with name %q, want order1", name)
+			}
+		case "QmB":
+			if named {
+				t.Errorf("QmB pinned with name %q, want none", name)
+			}
+		}
+	}
+	if got := node.called("pin/add"); len(got) != 2 {
+		t.Fatalf("pin/add called with %v, want QmA and QmB", got)
+	}
+}
+
+func TestCheckResolvable(t *testing.T) {
+	node := useFakeNode(t)
+	node.sizes["QmA"] = 1 << 20
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Arg == "QmSlow" {
+			// nobody on the network has it, the node keeps looking
+			<-r.Context().Done()
+			return true
+		}
+		return false
+	}
+
+	tests := []struct {
+		cid       string
+		wantClass pinErrorClass
+	}{
+		{"QmA", ""},
+		{"QmMissing", pinErrUnresolvable},
+		{"QmSlow", pinErrUnresolvable},
+	}
+
+	for _, tt := range tests {
+		err := checkResolvable(tt.cid, 100*time.Millisecond)
+		if tt.wantClass == "" {
+			if err != nil {
+				t.Errorf("checkResolvable(%s) = %v", tt.cid, err)
+			}
+			continue
+		}
+		perr, ok := err.(*pinError)
+		if !ok || perr.Class != tt.wantClass {
+			t.Errorf("checkResolvable(%s) = %v, want a %s error", tt.cid, err, tt.wantClass)
+		}
+	}
+}
+
+func TestOrderCreateUnresolvable(t *testing.T) {
+	useSettings(t, func(s *Settings) {
+		s.RequireResolve = true
+		s.ResolveTimeout = 100 * time.Millisecond
+	})
+	useTestDB(t)
+	useFakeNode(t)
+
+	r := httptest.NewRequest("POST", "/api/order", strings.NewReader(`{"cid": "QmMissing", "amount": 1000}`))
+	w := httptest.NewRecorder()
+	orderCreate(w, r)
+
+	// rejected before any invoice exists
+	if w.Code != 400 {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	var n int
+	err := pg.Get(&n, `SELECT count(*) FROM payments`)
+	if err != nil || n != 0 {
+		t.Fatalf("%d payments (%v), want none", n, err)
+	}
+}
+
+func TestVerifyRetrievable(t *testing.T) {
+	node := useFakeNode(t)
+	node.sizes["QmHealthy"] = 1 << 20
+	node.sizes["QmCorrupt"] = 1 << 20
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "refs" && call.Arg == "QmCorrupt" {
+			// the walk gets partway before hitting a bad block
+			w.Write([]byte(`{"Ref": "QmChild1", "Err": ""}` + "\n"))
+			w.Write([]byte(`{"Ref": "", "Err": "block was not found locally (offline)"}` + "\n"))
+			return true
+		}
+		return false
+	}
+
+	tests := []struct {
+		cid  string
+		want bool
+	}{
+		{"QmHealthy", true},
+		{"QmCorrupt", false},
+		{"QmGone", false},
+	}
+	for _, tt := range tests {
+		ok, err := verifyRetrievable(tt.cid)
+		if err != nil {
+			t.Fatalf("verifyRetrievable(%s): %v", tt.cid, err)
+		}
+		if ok != tt.want {
+			t.Errorf("verifyRetrievable(%s) = %v, want %v", tt.cid, ok, tt.want)
+		}
+	}
+
+	// an unreachable node says nothing about the content
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	ipfs = shell.NewShell(srv.URL)
+	_, err := verifyRetrievable("QmHealthy")
+	if err == nil {
+		t.Fatal("verifyRetrievable() = nil error with the node unreachable")
+	}
+}
+
+// serveResolve makes node resolve the given paths, and no others.
+func serveResolve(node *fakeNode, paths map[string]string) {
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd != "resolve" {
+			return false
+		}
+		cid, ok := paths[call.Arg]
+		if !ok {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(struct{ Message string }{`no link named "missing" under QmDir`})
+			return true
+		}
+		json.NewEncoder(w).Encode(struct{ Path string }{"/ipfs/" + cid})
+		return true
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	useSettings(t, nil)
+	node := useFakeNode(t)
+	serveResolve(node, map[string]string{"/ipfs/QmDir/docs/a.txt": "QmSub"})
+
+	sub, err := resolvePath("QmDir", "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub != "QmSub" {
+		t.Fatalf("resolvePath() = %s, want QmSub", sub)
+	}
+
+	_, err = resolvePath("QmDir", "missing")
+	if perr, ok := err.(*pinError); !ok || perr.Class != pinErrInvalid {
+		t.Fatalf("resolvePath() = %v, want an invalid path", err)
+	}
+}
+
+func TestExportCARInvalid(t *testing.T) {
+	// refused before anything is looked up
+	for _, cid := range []string{"", "QmA/sub", "QmA QmB"} {
+		err := exportCAR(cid, ioutil.Discard)
+		if err != errInvalidCID {
+			t.Errorf("exportCAR(%q) = %v, want errInvalidCID", cid, err)
+		}
+	}
+}
+
+func TestExportCAR(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 0.001, now(), interval '1 day');
+    `)
+	node.sizes["QmA"] = 1 << 20
+	node.sizes["QmElse"] = 1 << 20
+
+	var car bytes.Buffer
+	err := exportCAR("QmA", &car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if car.String() != "car of QmA" {
+		t.Fatalf("car = %q", car.String())
+	}
+
+	// on the node, but not pinned here
+	err = exportCAR("QmElse", &car)
+	if err != errObjectNotFound {
+		t.Fatalf("exportCAR(QmElse) = %v, want errObjectNotFound", err)
+	}
+	if got := node.called("dag/export"); len(got) != 1 {
+		t.Fatalf("exported %v, want only QmA", got)
+	}
+
+	r := httptest.NewRequest("GET", "/api/object/QmA/car", nil)
+	r = mux.SetURLVars(r, map[string]string{"cid": "QmA"})
+	w := httptest.NewRecorder()
+	getObjectCAR(w, r)
+	if w.Code != 200 || w.Body.String() != "car of QmA" {
+		t.Fatalf("getObjectCAR() = %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.ipld.car" {
+		t.Fatalf("content type = %s", ct)
+	}
+
+	r = mux.SetURLVars(httptest.NewRequest("GET", "/api/object/QmElse/car", nil),
+		map[string]string{"cid": "QmElse"})
+	w = httptest.NewRecorder()
+	getObjectCAR(w, r)
+	if w.Code != 404 {
+		t.Fatalf("getObjectCAR(QmElse) status = %d, want 404", w.Code)
+	}
+}
@@ -12,10 +12,47 @@ import (
 
 const SEPARATOR = " ← "
 
-func splitDescription(desc string) (cid string, orderIds []string, note string) {
-	s := strings.SplitN(desc, SEPARATOR, 3)
-	orderIds = strings.Split(s[1], ",")
-	return s[0], orderIds, s[2]
+type orderDescription struct {
+	CID          string
+	ReusedOrders []string
+	Owner        string
+	Path         string // what cid was selected from, if it's part of a bigger dag
+	Encryption   string
+	Note         string
+}
+
+func (d orderDescription) String() string {
+	return strings.Join([]string{
+		d.CID, strings.Join(d.ReusedOrders, ","), d.Owner, d.Path, d.Encryption, d.Note,
+	}, SEPARATOR)
+}
+
+// descriptions are "cid ← orders ← owner ← path ← encryption ← note". older
+// invoices have only "cid ← orders ← note", no path or no encryption.
+func splitDescription(desc string) (d orderDescription) {
+	s := strings.SplitN(desc, SEPARATOR, 6)
+	d.CID = s[0]
+	d.ReusedOrders = strings.Split(s[1], ",")
+	switch len(s) {
+	case 3:
+		d.Note = s[2]
+	case 4:
+		d.Owner, d.Note = s[2], s[3]
+	case 5:
+		d.Owner, d.Path, d.Note = s[2], s[3], s[4]
+	default:
+		d.Owner, d.Path, d.Encryption, d.Note = s[2], s[3], s[4], s[5]
+	}
+	return
+}
+
+// encryptionSchemes are the client-side encryption schemes content can be
+// marked with. keys are never seen here.
+var encryptionSchemes = map[string]bool{
+	"age":            true,
+	"openpgp":        true,
+	"aes-256-gcm":    true,
+	"nacl-secretbox": true,
 }
 
 func isInvoicePaid(id string) bool {
@@ -36,11 +73,9 @@ func isInvoicePaid(id string) bool {
 }
 
 func makeInvoice(
-	cid string,
-	note string,
-	amount int64,
-	reusedOrders []string) (invoice string, order_id string, err error) {
-	description := cid + SEPARATOR + strings.Join(reusedOrders, ",") + SEPARATOR + note
+	d orderDescription,
+	amount int64) (invoice string, order_id string, err error) {
+	description := d.String()
 	callback_url := s.ServiceURL + "/callback/order"
 	order_id = cuid.New()
 
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitDescription(t *testing.T) {
+	tests := []struct {
+		name string
+		desc string
+		want orderDescription
+	}{
+		{"cid and note", "QmA ←  ← photos",
+			orderDescription{CID: "QmA", ReusedOrders: []string{""}, Note: "photos"}},
+		{"with owner", "QmA ← o1,o2 ← alice ← photos",
+			orderDescription{CID: "QmA", ReusedOrders: []string{"o1", "o2"}, Owner: "alice",
+				Note: "photos"}},
+		{"with path", "QmA ←  ← alice ← QmRoot/pics ← photos",
+			orderDescription{CID: "QmA", ReusedOrders: []string{""}, Owner: "alice",
+				Path: "QmRoot/pics", Note: "photos"}},
+		{"with encryption", "QmA ←  ← alice ← QmRoot/pics ← age ← photos",
+			orderDescription{CID: "QmA", ReusedOrders: []string{""}, Owner: "alice",
+				Path: "QmRoot/pics", Encryption: "age", Note: "photos"}},
+		{"separator in the note", "QmA ←  ←  ←  ←  ← left ← right",
+			orderDescription{CID: "QmA", ReusedOrders: []string{""}, Note: "left ← right"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitDescription(tt.desc); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitDescription(%q) = %+v, want %+v", tt.desc, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderDescriptionRoundTrip(t *testing.T) {
+	for _, d := range []orderDescription{
+		{CID: "QmA", ReusedOrders: []string{""}},
+		{CID: "QmA", ReusedOrders: []string{"o1"}, Owner: "alice", Path: "QmRoot/a",
+			Encryption: "openpgp", Note: "photos"},
+		{CID: "QmA", ReusedOrders: []string{"o1", "o2"}, Note: "a ← b"},
+	} {
+		if got := splitDescription(d.String()); !reflect.DeepEqual(got, d) {
+			t.Errorf("splitDescription(%q) = %+v, want %+v", d.String(), got, d)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dghubble/sling"
@@ -16,15 +23,55 @@ import (
 )
 
 type Settings struct {
-	ServiceName     string  `envconfig:"SERVICE_NAME" required:"true"`
-	ServiceURL      string  `envconfig:"SERVICE_URL" required:"true"`
-	Port            string  `envconfig:"PORT" required:"true"`
-	PostgresURL     string  `envconfig:"DATABASE_URL" required:"true"`
-	OpenNodeURL     string  `envconfig:"OPENNODE_URL" required:"true"`
-	OpenNodeKey     string  `envconfig:"OPENNODE_KEY" required:"true"`
-	IPFSAPIURL      string  `envconfig:"IPFS_API_URL" required:"true"`
-	AbsoluteMaxSize float64 `envconfig:"ABSOLUTE_MAX_SIZE" required:"true"`
-	PriceGB         int64   `envconfig:"PRICE_GB" required:"true"`
+	ServiceName         string        `envconfig:"SERVICE_NAME" required:"true"`
+	ServiceURL          string        `envconfig:"SERVICE_URL" required:"true"`
+	Port                string        `envconfig:"PORT" required:"true"`
+	PostgresURL         string        `envconfig:"DATABASE_URL" required:"true"`
+	OpenNodeURL         string        `envconfig:"OPENNODE_URL" required:"true"`
+	OpenNodeKey         string        `envconfig:"OPENNODE_KEY" required:"true"`
+	IPFSAPIURL          string        `envconfig:"IPFS_API_URL" required:"true"`
+	AbsoluteMaxSize     float64       `envconfig:"ABSOLUTE_MAX_SIZE" required:"true"`
+	PriceGB             int64         `envconfig:"PRICE_GB" required:"true"`
+	PriceCurrency       string        `envconfig:"PRICE_CURRENCY" default:"sat"`
+	MinAmount           int64         `envconfig:"MIN_AMOUNT"`
+	MinRenewalAmount    int64         `envconfig:"MIN_RENEWAL_AMOUNT"`
+	RateURL             string        `envconfig:"RATE_URL"`
+	RatePath            string        `envconfig:"RATE_PATH" default:"rate"`
+	RateMaxAge          time.Duration `envconfig:"RATE_MAX_AGE" default:"10m"`
+	RateMaxStale        time.Duration `envconfig:"RATE_MAX_STALE" default:"1h"`
+	MaxTotalGB          float64       `envconfig:"MAX_TOTAL_GB"`
+	MinFreeGB           float64       `envconfig:"MIN_FREE_GB"`
+	MaxOwnerGB          float64       `envconfig:"MAX_OWNER_GB"`
+	MaxInFlightGB       float64       `envconfig:"MAX_INFLIGHT_GB"`
+	MaxQueueWait        time.Duration `envconfig:"MAX_QUEUE_WAIT" default:"72h"`
+	MaxPinTries         int           `envconfig:"MAX_PIN_TRIES" default:"20"`
+	MaxInfraTries       int           `envconfig:"MAX_INFRA_TRIES" default:"100"`
+	ProcessBatchTimeout time.Duration `envconfig:"PROCESS_BATCH_TIMEOUT" default:"60m"`
+	RenewalDiscount     float64       `envconfig:"RENEWAL_DISCOUNT"`
+	RenewalPricing      string        `envconfig:"RENEWAL_PRICING" default:"current"`
+	MinDuration         time.Duration `envconfig:"MIN_DURATION"`
+	MaxDuration         time.Duration `envconfig:"MAX_DURATION"`
+	MaxLifespan         time.Duration `envconfig:"MAX_LIFESPAN"`
+	BackupDir           string        `envconfig:"BACKUP_DIR"`
+	VerifyUnpin         bool          `envconfig:"VERIFY_UNPIN"`
+	KeepTombstones      bool          `envconfig:"KEEP_TOMBSTONES" default:"true"`
+	ShutdownTimeout     time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+	RequireResolve      bool          `envconfig:"REQUIRE_RESOLVE"`
+	ResolveTimeout      time.Duration `envconfig:"RESOLVE_TIMEOUT" default:"20s"`
+	SummaryWebhookURL   string        `envconfig:"SUMMARY_WEBHOOK_URL"`
+	ReceiptWebhookURL   string        `envconfig:"RECEIPT_WEBHOOK_URL"`
+	GatewayURL          string        `envconfig:"GATEWAY_URL" default:"https://ipfs.io"`
+	AmountCurrency      string        `envconfig:"AMOUNT_CURRENCY" default:"sat"`
+	AmountDecimals      int           `envconfig:"AMOUNT_DECIMALS" default:"0"`
+	CIDBlockThreshold   int           `envconfig:"CID_BLOCK_THRESHOLD" default:"3"`
+	CIDBlockCoolOff     time.Duration `envconfig:"CID_BLOCK_COOL_OFF" default:"24h"`
+	DisplayTimezone     string        `envconfig:"DISPLAY_TIMEZONE" default:"UTC"`
+	MaxNotes            int           `envconfig:"MAX_NOTES" default:"10"`
+	MaxNoteLength       int           `envconfig:"MAX_NOTE_LENGTH" default:"140"`
+	ReconcileTimeout    time.Duration `envconfig:"RECONCILE_TIMEOUT" default:"10m"`
+	RemotePinningURL    string        `envconfig:"REMOTE_PINNING_URL"`
+	RemotePinningToken  string        `envconfig:"REMOTE_PINNING_TOKEN"`
+	CronSecret          string        `envconfig:"CRON_SECRET"`
 }
 
 var err error
@@ -33,6 +80,7 @@ var r *mux.Router
 var pg *sqlx.DB
 var on *sling.Sling
 var ipfs *shell.Shell
+var displayLocation = time.UTC
 var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
 func main() {
@@ -41,6 +89,16 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't process envconfig.")
 	}
 
+	err = validateSettings()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid settings.")
+	}
+
+	displayLocation, err = time.LoadLocation(s.DisplayTimezone)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't load the display timezone.")
+	}
+
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	log = log.With().Timestamp().Logger()
 
@@ -53,24 +111,81 @@ func main() {
 	// ipfs helper
 	ipfs = shell.NewShell(s.IPFSAPIURL)
 
+	// optional content backups
+	if s.BackupDir != "" {
+		backup = fsBackup{s.BackupDir}
+	}
+
 	// postgres connection
 	pg, err = sqlx.Connect("postgres", s.PostgresURL)
 	if err != nil {
 		log.Fatal().Err(err).Msg("couldn't connect to postgres")
 	}
 
+	// run a single command instead of the server
+	if len(os.Args) > 1 {
+		err = runCommand(os.Args[1:], os.Stdout)
+
+		// commands start background work too, e.g. receipts and remote pins
+		// of the payments they process, which must finish before exiting.
+		ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		werr := waitBackground(ctx)
+		cancel()
+		if werr != nil {
+			log.Warn().Err(werr).Msg("background work didn't finish before exiting")
+		}
+
+		if err != nil {
+			log.Fatal().Err(err).Str("command", os.Args[1]).Msg("command failed")
+		}
+		return
+	}
+
+	// resume whatever was being processed before a restart
+	err = releaseClaims()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to release claimed payments")
+	}
+	goBackground(func() {
+		err := processPayments()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to process payments on startup")
+		}
+	})
+
 	// static assets
 	box := packr.NewBox("./static")
 
 	// define routes
 	r = mux.NewRouter()
 	r.Path("/api/globals").Methods("GET").HandlerFunc(getGlobals)
+	r.Path("/api/health").Methods("GET").HandlerFunc(getHealth)
 	r.Path("/api/order").Methods("POST").HandlerFunc(orderCreate)
 	r.Path("/api/order/{orderId}").Methods("GET").HandlerFunc(orderStatus)
+	r.Path("/api/order/{orderId}").Methods("DELETE").HandlerFunc(orderCancel)
+	r.Path("/api/order/{orderId}/receipt").Methods("GET").HandlerFunc(orderReceipt)
 	r.Path("/api/objects").Methods("GET").HandlerFunc(listObjects)
+	r.Path("/api/objects/export").Methods("GET").HandlerFunc(exportObjectsStream)
+	r.Path("/api/objects/pinned").Methods("GET").HandlerFunc(listObjectsPinnedBetween)
+	r.Path("/api/objects/search").Methods("GET").HandlerFunc(searchObjects)
+	r.Path("/api/objects/next").Methods("GET").HandlerFunc(getNextExpiry)
+	r.Path("/api/objects/buckets").Methods("GET").HandlerFunc(listRemainingBuckets)
+	r.Path("/api/notes").Methods("GET").HandlerFunc(listNotes)
 	r.Path("/api/object/{cid}").Methods("GET").HandlerFunc(getObject)
+	r.Path("/api/object/{cid}/pinned").Methods("GET").HandlerFunc(getPinned)
+	r.Path("/api/object/{cid}/timeline").Methods("GET").HandlerFunc(getTimeline)
+	r.Path("/api/object/{cid}/erased").Methods("GET").HandlerFunc(listErased)
+	r.Path("/api/object/{cid}/renewal").Methods("GET").HandlerFunc(getRenewalPreview)
+	r.Path("/api/object/{cid}/car").Methods("GET").HandlerFunc(getObjectCAR)
+	r.Path("/api/estimate").Methods("GET").HandlerFunc(getEstimate)
+	r.Path("/api/pinset").Methods("GET").HandlerFunc(listPinset)
+	r.Path("/api/snapshot").Methods("GET").HandlerFunc(getSnapshot)
+	r.Path("/api/storage").Methods("GET").HandlerFunc(getStorageDrift)
 	r.Path("/callback/order").Methods("POST").HandlerFunc(paymentCallback)
-	r.Path("/cron/periodic").Methods("POST").HandlerFunc(periodicJob)
+	r.Path("/cron/periodic").Methods("POST").HandlerFunc(cronAuth(periodicJob, false))
+	r.Path("/cron/daily").Methods("POST").HandlerFunc(cronAuth(dailyJob, false))
+	r.Path("/cron/verify").Methods("POST").HandlerFunc(cronAuth(verifyJob, false))
+	r.Path("/cron/maintenance").Methods("POST").HandlerFunc(cronAuth(maintenanceMode, true))
 	r.PathPrefix("/").Methods("GET").Handler(http.FileServer(box))
 
 	// start the server
@@ -80,6 +195,122 @@ func main() {
 		WriteTimeout: 25 * time.Second,
 		ReadTimeout:  25 * time.Second,
 	}
-	log.Info().Str("port", s.Port).Msg("listening.")
-	srv.ListenAndServe()
+	go func() {
+		log.Info().Str("port", s.Port).Msg("listening.")
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("server failed")
+		}
+	}()
+
+	// on shutdown stop taking requests, then let the work they started
+	// (pins, event writes, webhook deliveries) finish within a deadline.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Info().Dur("timeout", s.ShutdownTimeout).Msg("shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to close open connections")
+	}
+
+	err = waitBackground(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("background work didn't finish before shutdown")
+	}
+}
+
+func validateSettings() error {
+	_, err := time.LoadLocation(s.DisplayTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid DISPLAY_TIMEZONE %q: %v", s.DisplayTimezone, err)
+	}
+
+	if s.PriceGB <= 0 {
+		return fmt.Errorf("PRICE_GB must be positive, got %d", s.PriceGB)
+	}
+	if s.MinAmount < 0 || s.MinRenewalAmount < 0 {
+		return fmt.Errorf("MIN_AMOUNT and MIN_RENEWAL_AMOUNT must not be negative, got %d and %d",
+			s.MinAmount, s.MinRenewalAmount)
+	}
+	if s.PriceCurrency != "sat" && s.RateURL == "" {
+		return fmt.Errorf("RATE_URL is required when PRICE_CURRENCY is %s",
+			s.PriceCurrency)
+	}
+	if s.RateMaxStale < s.RateMaxAge {
+		return fmt.Errorf("RATE_MAX_STALE must not be below RATE_MAX_AGE, got %v < %v",
+			s.RateMaxStale, s.RateMaxAge)
+	}
+	if s.RemotePinningURL != "" && s.RemotePinningToken == "" {
+		return fmt.Errorf("REMOTE_PINNING_TOKEN is required with REMOTE_PINNING_URL")
+	}
+	if s.RenewalPricing != "current" && s.RenewalPricing != "original" {
+		return fmt.Errorf("RENEWAL_PRICING must be 'current' or 'original', got %q",
+			s.RenewalPricing)
+	}
+	if s.RenewalDiscount < 0 || s.RenewalDiscount >= 1 {
+		return fmt.Errorf("RENEWAL_DISCOUNT must be in [0, 1), got %v", s.RenewalDiscount)
+	}
+	if s.AmountDecimals < 0 || s.AmountDecimals > 18 {
+		return fmt.Errorf("AMOUNT_DECIMALS must be between 0 and 18, got %d",
+			s.AmountDecimals)
+	}
+	if s.AbsoluteMaxSize <= 0 {
+		return fmt.Errorf("ABSOLUTE_MAX_SIZE must be positive, got %v",
+			s.AbsoluteMaxSize)
+	}
+	if s.MaxTotalGB < 0 {
+		return fmt.Errorf("MAX_TOTAL_GB must not be negative, got %v", s.MaxTotalGB)
+	}
+	if s.MinFreeGB < 0 {
+		return fmt.Errorf("MIN_FREE_GB must not be negative, got %v", s.MinFreeGB)
+	}
+	if s.MaxInFlightGB < 0 {
+		return fmt.Errorf("MAX_INFLIGHT_GB must not be negative, got %v", s.MaxInFlightGB)
+	}
+	if s.MaxOwnerGB < 0 {
+		return fmt.Errorf("MAX_OWNER_GB must not be negative, got %v", s.MaxOwnerGB)
+	}
+	if s.MaxLifespan < 0 {
+		return fmt.Errorf("MAX_LIFESPAN must not be negative, got %v", s.MaxLifespan)
+	}
+	if s.MaxPinTries <= 0 || s.MaxInfraTries <= 0 {
+		return fmt.Errorf("MAX_PIN_TRIES and MAX_INFRA_TRIES must be positive, got %d and %d",
+			s.MaxPinTries, s.MaxInfraTries)
+	}
+	if s.MaxNotes <= 0 || s.MaxNoteLength <= 0 {
+		return fmt.Errorf("MAX_NOTES and MAX_NOTE_LENGTH must be positive, got %d and %d",
+			s.MaxNotes, s.MaxNoteLength)
+	}
+	if s.ProcessBatchTimeout <= 0 {
+		return fmt.Errorf("PROCESS_BATCH_TIMEOUT must be positive, got %v",
+			s.ProcessBatchTimeout)
+	}
+	if s.MaxQueueWait < 0 {
+		return fmt.Errorf("MAX_QUEUE_WAIT must not be negative, got %v", s.MaxQueueWait)
+	}
+	if s.MinDuration < 0 || s.MaxDuration < 0 {
+		return errors.New("MIN_DURATION and MAX_DURATION must not be negative")
+	}
+	if s.MaxDuration > 0 && s.MinDuration > s.MaxDuration {
+		return fmt.Errorf("MIN_DURATION (%v) must not exceed MAX_DURATION (%v)",
+			s.MinDuration, s.MaxDuration)
+	}
+	if strings.TrimSpace(s.IPFSAPIURL) == "" {
+		return errors.New("IPFS_API_URL must not be empty")
+	}
+	if strings.TrimSpace(s.OpenNodeURL) == "" {
+		return errors.New("OPENNODE_URL must not be empty")
+	}
+	if strings.TrimSpace(s.ServiceURL) == "" {
+		return errors.New("SERVICE_URL must not be empty")
+	}
+	if port, err := strconv.Atoi(s.Port); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("PORT must be a valid port number, got %q", s.Port)
+	}
+	return nil
 }
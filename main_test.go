@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// useSettings sets s to the defaults plus the required settings, changed by
+// change, for the rest of the test.
+func useSettings(t *testing.T, change func(s *Settings)) {
+	t.Helper()
+
+	saved := s
+	t.Cleanup(func() { s = saved })
+
+	for k, v := range map[string]string{
+		"SERVICE_NAME":      "piln",
+		"SERVICE_URL":       "https://piln.example",
+		"PORT":              "5000",
+		"DATABASE_URL":      "postgres://localhost/piln",
+		"OPENNODE_URL":      "https://api.opennode.example",
+		"OPENNODE_KEY":      "key",
+		"IPFS_API_URL":      "http://localhost:5001",
+		"ABSOLUTE_MAX_SIZE": "10",
+		"PRICE_GB":          "1000",
+	} {
+		t.Setenv(k, v)
+	}
+
+	s = Settings{}
+	err := envconfig.Process("", &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change != nil {
+		change(&s)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s *Settings)
+		wantErr string
+	}{
+		{"defaults", nil, ""},
+		{"bad timezone", func(s *Settings) { s.DisplayTimezone = "Mars/Olympus" }, "DISPLAY_TIMEZONE"},
+		{"zero price", func(s *Settings) { s.PriceGB = 0 }, "PRICE_GB"},
+		{"negative minimums", func(s *Settings) { s.MinRenewalAmount = -1 }, "MIN_RENEWAL_AMOUNT"},
+		{"fiat without rate", func(s *Settings) { s.PriceCurrency = "usd" }, "RATE_URL"},
+		{"fiat with rate", func(s *Settings) {
+			s.PriceCurrency = "usd"
+			s.RateURL = "https://rates.example"
+		}, ""},
+		{"stale before max age", func(s *Settings) { s.RateMaxStale = time.Minute }, "RATE_MAX_STALE"},
+		{"remote without token", func(s *Settings) { s.RemotePinningURL = "https://pins.example" }, "REMOTE_PINNING_TOKEN"},
+		{"unknown renewal pricing", func(s *Settings) { s.RenewalPricing = "cheapest" }, "RENEWAL_PRICING"},
+		{"full discount", func(s *Settings) { s.RenewalDiscount = 1 }, "RENEWAL_DISCOUNT"},
+		{"too many decimals", func(s *Settings) { s.AmountDecimals = 19 }, "AMOUNT_DECIMALS"},
+		{"zero max size", func(s *Settings) { s.AbsoluteMaxSize = 0 }, "ABSOLUTE_MAX_SIZE"},
+		{"zero pin tries", func(s *Settings) { s.MaxPinTries = 0 }, "MAX_PIN_TRIES"},
+		{"zero notes", func(s *Settings) { s.MaxNotes = 0 }, "MAX_NOTES"},
+		{"zero batch timeout", func(s *Settings) { s.ProcessBatchTimeout = 0 }, "PROCESS_BATCH_TIMEOUT"},
+		{"no queue limit", func(s *Settings) { s.MaxQueueWait = 0 }, ""},
+		{"negative queue wait", func(s *Settings) { s.MaxQueueWait = -time.Hour }, "MAX_QUEUE_WAIT"},
+		{"min over max duration", func(s *Settings) {
+			s.MinDuration = 2 * time.Hour
+			s.MaxDuration = time.Hour
+		}, "MIN_DURATION"},
+		{"bad port", func(s *Settings) { s.Port = "http" }, "PORT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, tt.change)
+
+			err := validateSettings()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateSettings() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateSettings() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSettingsLeavesDisplayLocation(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.DisplayTimezone = "Europe/Lisbon" })
+
+	before := displayLocation
+	err := validateSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if displayLocation != before {
+		t.Fatalf("validateSettings changed displayLocation to %v", displayLocation)
+	}
+}
@@ -1,29 +1,114 @@
-CREATE TYPE status AS ENUM ('trying', 'pinned', 'given_up', 'repurposed');
+-- safe to run again on an existing database, it only adds what's missing.
+DO $$ BEGIN
+  CREATE TYPE status AS ENUM ('trying', 'queued', 'pinned', 'given_up', 'cancelled', 'repurposed');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
 
-CREATE TABLE payments (
+CREATE TABLE IF NOT EXISTS payments (
   order_id text PRIMARY KEY,
   cid text NOT NULL,
   note text,
   paid_at timestamp NOT NULL DEFAULT now(),
   amount int NOT NULL,
   status status NOT NULL DEFAULT 'trying',
-  tries int NOT NULL DEFAULT 0,
-  recycling text[] NOT NULL DEFAULT '{}'
+  tries int NOT NULL DEFAULT 0, -- failures of the content itself
+  infra_tries int NOT NULL DEFAULT 0, -- failures of the node, the database, etc.
+  recycling text[] NOT NULL DEFAULT '{}',
+  claimed_at timestamp,
+  last_try_at timestamp,
+  pinning_since timestamp,
+  owner text NOT NULL DEFAULT '',
+  path text NOT NULL DEFAULT '',
+  encryption text NOT NULL DEFAULT '',
+  price_gb numeric, -- satoshis per GB-day charged, before any renewal discount
+  given_up_at timestamp,
+  given_up_reason text, -- an error class, 'exhausted' or 'queue_timeout'
+  queued_at timestamp,
+  on_hold boolean NOT NULL DEFAULT false,
+  -- paid minus granted duration: positive is a surplus, negative a shortfall
+  clamped interval NOT NULL DEFAULT '0'
 );
 
-CREATE TABLE objects (
+CREATE TABLE IF NOT EXISTS objects (
   cid text PRIMARY KEY,
-  sizegb real NOT NULL,
+  sizegb double precision NOT NULL,
   pinned_at timestamp,
-  lifespan interval
+  lifespan interval,
+  notes text[] NOT NULL DEFAULT '{}',
+  health text NOT NULL DEFAULT 'healthy',
+  checked_at timestamp,
+  path text NOT NULL DEFAULT '', -- '<root cid>/<path>' when only part of a dag was pinned
+  encryption text NOT NULL DEFAULT '', -- client-side encryption scheme, if any
+  remote_request_id text -- the pin's id on the remote pinning service, if any
 );
+CREATE INDEX IF NOT EXISTS objects_cid_idx ON objects (cid text_pattern_ops); -- for prefix searches
 
-CREATE OR REPLACE FUNCTION notes(objects) RETURNS text[] AS $$
-  SELECT coalesce(array_remove(array_agg(DISTINCT note), ''), '{}') FROM payments
-  WHERE payments.cid = $1.cid
-    AND note IS NOT NULL
-    AND status = 'pinned';
-$$ LANGUAGE SQL;
+CREATE TABLE IF NOT EXISTS erased_objects (
+  cid text NOT NULL,
+  sizegb double precision NOT NULL,
+  pinned_at timestamp,
+  ends_at timestamp,
+  erased_at timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS erased_objects_cid_idx ON erased_objects (cid);
+
+CREATE TABLE IF NOT EXISTS events (
+  id serial PRIMARY KEY,
+  kind text NOT NULL,
+  cid text NOT NULL,
+  order_id text NOT NULL DEFAULT '',
+  sizegb double precision NOT NULL DEFAULT 0,
+  detail text NOT NULL DEFAULT '',
+  created_at timestamp NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at);
+CREATE INDEX IF NOT EXISTS events_cid_idx ON events (cid);
+
+-- migrate deployments created before the statuses and columns above existed.
+-- erased_objects and events are created above when missing.
+ALTER TYPE status ADD VALUE IF NOT EXISTS 'queued';
+ALTER TYPE status ADD VALUE IF NOT EXISTS 'cancelled';
+ALTER TABLE payments
+  ADD COLUMN IF NOT EXISTS infra_tries int NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS claimed_at timestamp,
+  ADD COLUMN IF NOT EXISTS last_try_at timestamp,
+  ADD COLUMN IF NOT EXISTS pinning_since timestamp,
+  ADD COLUMN IF NOT EXISTS owner text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS path text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS encryption text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS price_gb numeric,
+  ADD COLUMN IF NOT EXISTS given_up_at timestamp,
+  ADD COLUMN IF NOT EXISTS given_up_reason text,
+  ADD COLUMN IF NOT EXISTS queued_at timestamp,
+  ADD COLUMN IF NOT EXISTS on_hold boolean NOT NULL DEFAULT false,
+  ADD COLUMN IF NOT EXISTS clamped interval NOT NULL DEFAULT '0';
+ALTER TABLE objects
+  ADD COLUMN IF NOT EXISTS health text NOT NULL DEFAULT 'healthy',
+  ADD COLUMN IF NOT EXISTS checked_at timestamp,
+  ADD COLUMN IF NOT EXISTS path text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS encryption text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS remote_request_id text;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS detail text NOT NULL DEFAULT '';
+
+-- keep sizes in double precision so renewals compute the same durations
+ALTER TABLE objects ALTER COLUMN sizegb TYPE double precision;
+ALTER TABLE events ALTER COLUMN sizegb TYPE double precision;
+
+-- migrate from the notes(objects) function to the notes column. the notes are
+-- only filled in from the payments while the function is still there, later
+-- they're maintained on the column.
+ALTER TABLE objects ADD COLUMN IF NOT EXISTS notes text[] NOT NULL DEFAULT '{}';
+DO $$ BEGIN
+  IF to_regprocedure('notes(objects)') IS NOT NULL THEN
+    UPDATE objects SET notes = (
+      SELECT coalesce(array_remove(array_agg(DISTINCT note), ''), '{}') FROM payments
+      WHERE payments.cid = objects.cid
+        AND note IS NOT NULL
+        AND status = 'pinned'
+    );
+  END IF;
+END $$;
+DROP FUNCTION IF EXISTS notes(objects);
 
 select * from objects;
 select * from payments order by paid_at;
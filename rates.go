@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var errRateUnavailable = errors.New("no recent exchange rate available")
+
+var rateClient = &http.Client{Timeout: 10 * time.Second}
+
+var rate struct {
+	sync.Mutex
+	value     *big.Rat
+	fetchedAt time.Time
+}
+
+// satsPriceGB is PriceGB converted from PriceCurrency to satoshis. the rate is
+// refreshed after RateMaxAge, and a cached one is used while a refresh fails
+// for up to RateMaxStale.
+func satsPriceGB() (*big.Rat, error) {
+	price := new(big.Rat).SetInt64(s.PriceGB)
+	if s.PriceCurrency == "sat" {
+		return price, nil
+	}
+
+	rate.Lock()
+	defer rate.Unlock()
+
+	age := time.Since(rate.fetchedAt)
+	if rate.value == nil || age >= s.RateMaxAge {
+		value, err := fetchRate()
+		if err == nil {
+			rate.value, rate.fetchedAt = value, time.Now()
+			age = 0
+		} else if rate.value == nil || age >= s.RateMaxStale {
+			log.Warn().Err(err).Dur("age", age).Msg("failed to refresh exchange rate")
+			return nil, errRateUnavailable
+		} else {
+			log.Warn().Err(err).Dur("age", age).Msg("using a stale exchange rate")
+		}
+	}
+
+	return price.Mul(price, rate.value), nil
+}
+
+// fetchRate gets how many satoshis one unit of PriceCurrency is worth.
+func fetchRate() (*big.Rat, error) {
+	resp, err := rateClient.Get(s.RateURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("rate source returned %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := gjson.GetBytes(body, s.RatePath).String()
+	value, ok := new(big.Rat).SetString(raw)
+	if !ok || value.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid rate %q", raw)
+	}
+	return value, nil
+}
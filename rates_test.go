@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useRateSource serves rate as the sats of a dollar, or fails while rate is
+// empty, and returns how many times it was asked.
+func useRateSource(t *testing.T, rate *atomic.Value) *int32 {
+	t.Helper()
+
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		value := rate.Load().(string)
+		if value == "" {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte(`{"data": {"rate": "` + value + `"}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	useSettings(t, func(s *Settings) {
+		s.PriceCurrency = "usd"
+		s.PriceGB = 2
+		s.RateURL = srv.URL
+		s.RatePath = "data.rate"
+		s.RateMaxAge = 10 * time.Minute
+		s.RateMaxStale = time.Hour
+	})
+	return &fetches
+}
+
+// useCachedRate sets the cached rate, fetched age ago, for the rest of the
+// test.
+func useCachedRate(t *testing.T, value int64, age time.Duration) {
+	t.Helper()
+
+	rate.Lock()
+	saved, savedAt := rate.value, rate.fetchedAt
+	rate.value, rate.fetchedAt = nil, time.Time{}
+	if value != 0 {
+		rate.value, rate.fetchedAt = big.NewRat(value, 1), time.Now().Add(-age)
+	}
+	rate.Unlock()
+
+	t.Cleanup(func() {
+		rate.Lock()
+		rate.value, rate.fetchedAt = saved, savedAt
+		rate.Unlock()
+	})
+}
+
+func TestSatsPriceGB(t *testing.T) {
+	tests := []struct {
+		name        string
+		cached      int64
+		age         time.Duration
+		source      string
+		want        int64
+		wantFetches int32
+	}{
+		{"fresh", 3000, time.Minute, "4000", 6000, 0},
+		{"stale but refreshable", 3000, 20 * time.Minute, "4000", 8000, 1},
+		{"stale, refresh failing", 3000, 20 * time.Minute, "", 6000, 1},
+		{"too stale and unavailable", 3000, 2 * time.Hour, "", 0, 1},
+		{"never fetched and unavailable", 0, 0, "", 0, 1},
+		{"invalid rate", 0, 0, "-1", 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var source atomic.Value
+			source.Store(tt.source)
+			fetches := useRateSource(t, &source)
+			useCachedRate(t, tt.cached, tt.age)
+
+			price, err := satsPriceGB()
+			if tt.want == 0 {
+				if err != errRateUnavailable {
+					t.Fatalf("satsPriceGB() = %v, %v, want errRateUnavailable", price, err)
+				}
+			} else if err != nil || price.Cmp(big.NewRat(tt.want, 1)) != 0 {
+				t.Fatalf("satsPriceGB() = %v, %v, want %d", price, err, tt.want)
+			}
+			if n := atomic.LoadInt32(fetches); n != tt.wantFetches {
+				t.Fatalf("rate fetched %d times, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestSatsPriceGBRefreshed(t *testing.T) {
+	var source atomic.Value
+	source.Store("4000")
+	fetches := useRateSource(t, &source)
+	useCachedRate(t, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		_, err := satsPriceGB()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Fatalf("rate fetched %d times for three prices, want once", n)
+	}
+
+	// a refreshed rate is fresh again
+	useCachedRate(t, 3000, 20*time.Minute)
+	source.Store("5000")
+	for i := 0; i < 2; i++ {
+		price, err := satsPriceGB()
+		if err != nil || price.Cmp(big.NewRat(10000, 1)) != 0 {
+			t.Fatalf("satsPriceGB() = %v, %v, want 10000", price, err)
+		}
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Fatalf("rate fetched %d times, want it refreshed once", n)
+	}
+}
+
+func TestPaymentQueuedWithoutRate(t *testing.T) {
+	var source atomic.Value
+	source.Store("")
+	useRateSource(t, &source)
+	useCachedRate(t, 0, 0)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.sizes["QmA"] = 1 << 20
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	err = pg.Get(&status, `SELECT status FROM payments WHERE order_id = 'order1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "queued" {
+		t.Fatalf("status = %s without a rate, want queued", status)
+	}
+	if pins := node.called("pin/add"); len(pins) != 0 {
+		t.Fatalf("pinned %v without a rate", pins)
+	}
+
+	// and pinned once the rate is back
+	source.Store("1")
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.Get(&status, `SELECT status FROM payments WHERE order_id = 'order1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "pinned" {
+		t.Fatalf("status = %s with the rate back, want pinned", status)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var remoteClient = &http.Client{Timeout: 30 * time.Second}
+
+func remotePinning() bool {
+	return s.RemotePinningURL != ""
+}
+
+// remoteRequest calls the remote pinning service, following the IPFS Pinning
+// Service API.
+func remoteRequest(method, path string, payload interface{}) ([]byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method,
+		strings.TrimSuffix(s.RemotePinningURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.RemotePinningToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("remote pinning service returned %d: %s",
+			resp.StatusCode, gjson.GetBytes(res, "error.reason").String())
+	}
+	return res, nil
+}
+
+// remotePin asks the remote service to also pin cid and stores the request id
+// on the object so the remote pin can be removed with it.
+func remotePin(cid, name string) error {
+	res, err := remoteRequest("POST", "/pins", struct {
+		CID  string `json:"cid"`
+		Name string `json:"name,omitempty"`
+	}{cid, name})
+	if err != nil {
+		return err
+	}
+
+	requestId := gjson.GetBytes(res, "requestid").String()
+	if requestId == "" {
+		return fmt.Errorf("remote pinning service returned no request id")
+	}
+
+	_, err = pg.Exec(`
+UPDATE objects SET remote_request_id = $2 WHERE cid = $1
+    `, cid, requestId)
+	return err
+}
+
+// remoteUnpin removes the remote pin of cid, if it has one.
+func remoteUnpin(cid string) error {
+	requestId, err := remoteRequestId(cid)
+	if err != nil || requestId == "" {
+		// no object means it was never pinned remotely
+		return nil
+	}
+
+	// the id isn't cleared, the object is being deleted and its row may be
+	// locked by the erase.
+	return removeRemotePin(requestId)
+}
+
+func remoteRequestId(cid string) (requestId string, err error) {
+	err = pg.Get(&requestId, `
+SELECT coalesce(remote_request_id, '') FROM objects WHERE cid = $1
+    `, cid)
+	return
+}
+
+func removeRemotePin(requestId string) error {
+	_, err := remoteRequest("DELETE", "/pins/"+requestId, nil)
+	return err
+}
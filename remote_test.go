@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRemote is a remote pinning service keeping its pins by request id.
+type fakeRemote struct {
+	sync.Mutex
+	pins  map[string]string
+	calls []string
+	fail  bool
+}
+
+// useRemotePinning turns remote pinning on against a fake service for the
+// rest of the test. it changes the settings, so it goes before other changes.
+func useRemotePinning(t *testing.T) *fakeRemote {
+	t.Helper()
+
+	remote := &fakeRemote{pins: make(map[string]string)}
+	srv := httptest.NewServer(remote)
+	t.Cleanup(srv.Close)
+
+	useSettings(t, func(s *Settings) {
+		s.RemotePinningURL = srv.URL + "/"
+		s.RemotePinningToken = "token"
+	})
+	return remote
+}
+
+func (f *fakeRemote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error": {"reason": "UNAUTHORIZED"}}`))
+		return
+	}
+	if f.fail {
+		w.WriteHeader(500)
+		w.Write([]byte(`{"error": {"reason": "INTERNAL_SERVER_ERROR"}}`))
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/pins":
+		var pin struct{ CID string }
+		json.NewDecoder(r.Body).Decode(&pin)
+		requestId := "request-" + pin.CID
+		f.pins[requestId] = pin.CID
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(struct {
+			RequestId string `json:"requestid"`
+			Status    string `json:"status"`
+		}{requestId, "queued"})
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/pins/"):
+		requestId := strings.TrimPrefix(r.URL.Path, "/pins/")
+		if _, ok := f.pins[requestId]; !ok {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error": {"reason": "NOT_FOUND"}}`))
+			return
+		}
+		delete(f.pins, requestId)
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+func (f *fakeRemote) called() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeRemote) pinned(cid string) bool {
+	f.Lock()
+	defer f.Unlock()
+	for _, pinned := range f.pins {
+		if pinned == cid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRemoteRequestErrors(t *testing.T) {
+	remote := useRemotePinning(t)
+
+	err := removeRemotePin("unknown")
+	if err == nil || !strings.Contains(err.Error(), "404: NOT_FOUND") {
+		t.Fatalf("removeRemotePin(unknown) = %v, want a not found", err)
+	}
+
+	remote.Lock()
+	remote.fail = true
+	remote.Unlock()
+	_, err = remoteRequest("POST", "/pins", struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "INTERNAL_SERVER_ERROR") {
+		t.Fatalf("remoteRequest() = %v, want the service's reason", err)
+	}
+
+	s.RemotePinningToken = "wrong"
+	_, err = remoteRequest("POST", "/pins", struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("remoteRequest() = %v with a wrong token, want 401", err)
+	}
+}
+
+func TestRemotePinning(t *testing.T) {
+	remote := useRemotePinning(t)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.sizes["QmA"] = 1 << 30
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !remote.pinned("QmA") {
+		t.Fatal("QmA wasn't pinned remotely")
+	}
+	requestId, err := remoteRequestId("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestId != "request-QmA" {
+		t.Fatalf("remote request id = %q, want request-QmA", requestId)
+	}
+
+	// unpinning removes the remote pin too
+	pg.MustExec(`UPDATE objects SET pinned_at = now() - interval '2 days'`)
+	err = eraseEnded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.pinned("QmA") {
+		t.Fatal("remote pin left after erasing QmA")
+	}
+	want := "POST /pins,DELETE /pins/request-QmA"
+	if got := strings.Join(remote.called(), ","); got != want {
+		t.Fatalf("remote calls = %s, want %s", got, want)
+	}
+}
+
+func TestRemotePinningOff(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	if remotePinning() {
+		t.Fatal("remote pinning on without a url")
+	}
+
+	node.sizes["QmA"] = 1 << 30
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestId, err := remoteRequestId("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestId != "" {
+		t.Fatalf("remote request id = %q with remote pinning off", requestId)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+type ObjectResponse struct {
+	CID        string    `json:"cid"`
+	SizeGB     float64   `json:"sizegb"`
+	PinnedAt   time.Time `json:"pinned_at"`
+	EndsAt     time.Time `json:"ends_at"`
+	Notes      []string  `json:"notes"`
+	Path       string    `json:"path,omitempty"`
+	Encryption string    `json:"encryption,omitempty"`
+}
+
+type PaymentResponse struct {
+	OrderId string `json:"order_id"`
+	CID     string `json:"cid"`
+	Note    string `json:"note"`
+	PaidAt  string `json:"paid_at"`
+	Amount  int    `json:"amount"`
+	Status  string `json:"status"`
+}
+
+type PinsetEntryResponse struct {
+	CID    string    `json:"cid"`
+	EndsAt time.Time `json:"ends_at"`
+}
+
+type SnapshotEntryResponse struct {
+	CID       string    `json:"cid"`
+	SizeGB    float64   `json:"sizegb"`
+	PinnedAt  time.Time `json:"pinned_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Remaining int64     `json:"remaining_seconds"`
+}
+
+type ReceiptResponse struct {
+	OrderId         string    `json:"order_id"`
+	CID             string    `json:"cid"`
+	Amount          int64     `json:"amount"`
+	AmountFormatted string    `json:"amount_formatted"`
+	SizeGB          float64   `json:"sizegb"`
+	PinnedAt        time.Time `json:"pinned_at"`
+	EndsAt          time.Time `json:"ends_at"`
+	GatewayURL      string    `json:"gateway_url"`
+}
+
+func objectResponse(o *Object) *ObjectResponse {
+	if o == nil {
+		return nil
+	}
+
+	notes := []string(o.Notes)
+	if notes == nil {
+		notes = make([]string, 0)
+	}
+
+	return &ObjectResponse{
+		CID:        o.CID,
+		SizeGB:     o.SizeGB,
+		PinnedAt:   o.PinnedAt.In(displayLocation),
+		EndsAt:     o.EndsAt.In(displayLocation),
+		Notes:      notes,
+		Path:       o.Path,
+		Encryption: o.Encryption,
+	}
+}
+
+func objectsResponse(oo []Object) []ObjectResponse {
+	res := make([]ObjectResponse, len(oo))
+	for i := range oo {
+		res[i] = *objectResponse(&oo[i])
+	}
+	return res
+}
+
+func paymentResponse(p *Payment) *PaymentResponse {
+	if p == nil {
+		return nil
+	}
+
+	return &PaymentResponse{
+		OrderId: p.OrderId,
+		CID:     p.CID,
+		Note:    p.Note,
+		PaidAt:  p.PaidAt,
+		Amount:  p.Amount,
+		Status:  p.Status,
+	}
+}
+
+func receiptResponse(r *Receipt) *ReceiptResponse {
+	if r == nil {
+		return nil
+	}
+
+	return &ReceiptResponse{
+		OrderId:         r.OrderId,
+		CID:             r.CID,
+		Amount:          r.Amount,
+		AmountFormatted: formatAmount(r.Amount),
+		SizeGB:          r.SizeGB,
+		PinnedAt:        r.PinnedAt.In(displayLocation),
+		EndsAt:          r.EndsAt.In(displayLocation),
+		GatewayURL:      strings.TrimSuffix(s.GatewayURL, "/") + "/ipfs/" + r.CID,
+	}
+}
+
+func pinsetResponse(entries []PinsetEntry) []PinsetEntryResponse {
+	res := make([]PinsetEntryResponse, len(entries))
+	for i, e := range entries {
+		res[i] = PinsetEntryResponse{CID: e.CID, EndsAt: e.EndsAt.In(displayLocation)}
+	}
+	return res
+}
+
+func snapshotResponse(entries []SnapshotEntry) []SnapshotEntryResponse {
+	res := make([]SnapshotEntryResponse, len(entries))
+	for i, e := range entries {
+		res[i] = SnapshotEntryResponse{
+			CID:       e.CID,
+			SizeGB:    e.SizeGB,
+			PinnedAt:  e.PinnedAt.In(displayLocation),
+			EndsAt:    e.EndsAt.In(displayLocation),
+			Remaining: int64(e.Remaining / time.Second),
+		}
+	}
+	return res
+}
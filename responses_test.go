@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotResponse(t *testing.T) {
+	pinnedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []SnapshotEntry{
+		{CID: "QmA", SizeGB: 1, PinnedAt: pinnedAt, EndsAt: pinnedAt.Add(48 * time.Hour),
+			Remaining: 36*time.Hour + 1500*time.Millisecond},
+		{CID: "QmB", SizeGB: 0.5, PinnedAt: pinnedAt, EndsAt: pinnedAt.Add(time.Hour)},
+	}
+
+	res := snapshotResponse(entries)
+	if len(res) != 2 {
+		t.Fatalf("snapshotResponse() has %d entries, want 2", len(res))
+	}
+	if res[0].Remaining != 36*3600+1 || res[1].Remaining != 0 {
+		t.Fatalf("remaining = %d, %d, want whole seconds", res[0].Remaining, res[1].Remaining)
+	}
+	if !res[0].EndsAt.Equal(entries[0].EndsAt) {
+		t.Fatalf("ends_at = %v, want %v", res[0].EndsAt, entries[0].EndsAt)
+	}
+
+	body, err := json.Marshal(res[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"remaining_seconds":129601`) {
+		t.Fatalf("snapshot entry = %s, want remaining_seconds", body)
+	}
+
+	if res := snapshotResponse(nil); res == nil || len(res) != 0 {
+		t.Fatalf("snapshotResponse(nil) = %#v, want an empty list", res)
+	}
+}
+
+func TestReceiptResponse(t *testing.T) {
+	tests := []struct {
+		gateway string
+		want    string
+	}{
+		{"https://ipfs.io", "https://ipfs.io/ipfs/QmA"},
+		{"https://gateway.example/", "https://gateway.example/ipfs/QmA"},
+	}
+
+	for _, tt := range tests {
+		useSettings(t, func(s *Settings) {
+			s.GatewayURL = tt.gateway
+			s.AmountDecimals = 0
+			s.AmountCurrency = "sat"
+		})
+
+		r := &Receipt{OrderId: "order1", CID: "QmA", Amount: 1000, SizeGB: 1,
+			PinnedAt: time.Now(), EndsAt: time.Now().Add(24 * time.Hour)}
+		res := receiptResponse(r)
+		if res.GatewayURL != tt.want {
+			t.Errorf("gateway url = %q, want %q", res.GatewayURL, tt.want)
+		}
+		if res.AmountFormatted != "1000 sat" {
+			t.Errorf("amount = %q, want %q", res.AmountFormatted, "1000 sat")
+		}
+	}
+
+	if receiptResponse(nil) != nil {
+		t.Fatal("receiptResponse(nil) != nil")
+	}
+}
+
+func TestObjectResponseTimezone(t *testing.T) {
+	saved := displayLocation
+	defer func() { displayLocation = saved }()
+
+	pinnedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	o := &Object{CID: "QmA", SizeGB: 1, PinnedAt: pinnedAt, EndsAt: pinnedAt.Add(24 * time.Hour)}
+
+	tests := []struct {
+		zone       string
+		wantPinned string
+		wantEnds   string
+	}{
+		{"UTC", "2024-01-01T12:00:00Z", "2024-01-02T12:00:00Z"},
+		{"Asia/Tokyo", "2024-01-01T21:00:00+09:00", "2024-01-02T21:00:00+09:00"},
+		{"America/New_York", "2024-01-01T07:00:00-05:00", "2024-01-02T07:00:00-05:00"},
+	}
+
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		displayLocation = loc
+
+		res := objectResponse(o)
+		if !res.PinnedAt.Equal(pinnedAt) {
+			t.Errorf("%s: pinned_at = %v, not the same instant", tt.zone, res.PinnedAt)
+		}
+		body, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), `"pinned_at":"`+tt.wantPinned+`"`) ||
+			!strings.Contains(string(body), `"ends_at":"`+tt.wantEnds+`"`) {
+			t.Errorf("%s: object = %s, want it pinned at %s and ending at %s",
+				tt.zone, body, tt.wantPinned, tt.wantEnds)
+		}
+	}
+
+	// stored times aren't touched
+	if o.PinnedAt.Location() != time.UTC {
+		t.Fatalf("object pinned_at moved to %v", o.PinnedAt.Location())
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/lib/pq"
+)
+
+type Stats struct {
+	ActiveObjects int
+	StoredGB      float64
+	Payments      map[string]int
+}
+
+type DailySummary struct {
+	From             time.Time `json:"from"`
+	To               time.Time `json:"to"`
+	Pinned           int       `json:"pinned" db:"pinned"`
+	Renewed          int       `json:"renewed" db:"renewed"`
+	Erased           int       `json:"erased" db:"erased"`
+	GivenUp          int       `json:"given_up" db:"given_up"`
+	GBAdded          float64   `json:"gb_added" db:"gb_added"`
+	GBRemoved        float64   `json:"gb_removed" db:"gb_removed"`
+	Revenue          int64     `json:"revenue" db:"revenue"`
+	RevenueFormatted string    `json:"revenue_formatted"`
+}
+
+// realizedPricePerGBDay is the revenue of the payments pinned in the window
+// over the GB-days served in it, by objects and by those since erased.
+func realizedPricePerGBDay(from, to time.Time) (float64, error) {
+	var revenue int64
+	err := pg.Get(&revenue, `
+SELECT coalesce(sum(p.amount - (
+  -- reused orders were already counted when they were first paid
+  SELECT coalesce(sum(r.amount), 0) FROM payments AS r
+  WHERE r.order_id = any(p.recycling)
+)), 0)
+FROM payments AS p
+WHERE p.status = 'pinned'
+  AND p.paid_at >= $1 AND p.paid_at < $2
+    `, from.UTC(), to.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	var gbdays float64
+	err = pg.Get(&gbdays, `
+SELECT coalesce(sum(
+  sizegb * extract(epoch FROM least(ends_at, $2) - greatest(pinned_at, $1)) / 86400
+), 0)
+FROM (
+  SELECT sizegb, pinned_at, pinned_at + lifespan AS ends_at FROM objects
+  UNION ALL
+  SELECT sizegb, pinned_at, least(ends_at, erased_at) FROM erased_objects
+) AS served
+WHERE pinned_at < $2 AND ends_at > $1
+    `, from.UTC(), to.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	if gbdays == 0 {
+		return 0, nil
+	}
+	return float64(revenue) / gbdays, nil
+}
+
+func dailySummary(to time.Time) (summary DailySummary, err error) {
+	from := to.Add(-24 * time.Hour)
+	err = pg.Get(&summary, `
+SELECT
+  count(*) FILTER (WHERE kind = 'pinned') AS pinned,
+  count(*) FILTER (WHERE kind = 'renewed') AS renewed,
+  count(*) FILTER (WHERE kind = 'erased') AS erased,
+  count(*) FILTER (WHERE kind = 'given_up') AS given_up,
+  coalesce(sum(sizegb) FILTER (WHERE kind = 'pinned'), 0) AS gb_added,
+  coalesce(sum(sizegb) FILTER (WHERE kind = 'erased'), 0) AS gb_removed,
+  (
+    -- reused orders were already counted when they were first paid
+    SELECT coalesce(sum(p.amount - (
+      SELECT coalesce(sum(r.amount), 0) FROM payments AS r
+      WHERE r.order_id = any(p.recycling)
+    )), 0)
+    FROM payments AS p
+    WHERE p.paid_at >= $1 AND p.paid_at < $2
+  ) AS revenue
+FROM events
+WHERE created_at >= $1 AND created_at < $2
+    `, from, to)
+	summary.From = from
+	summary.To = to
+	summary.RevenueFormatted = formatAmount(summary.Revenue)
+	return
+}
+
+func emitDailySummary() error {
+	summary, err := dailySummary(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("pinned", summary.Pinned).
+		Int("renewed", summary.Renewed).
+		Int("erased", summary.Erased).
+		Int("given_up", summary.GivenUp).
+		Float64("gb_added", summary.GBAdded).
+		Float64("gb_removed", summary.GBRemoved).
+		Str("revenue", summary.RevenueFormatted).
+		Msg("daily summary")
+
+	if s.SummaryWebhookURL != "" {
+		return postWebhook(s.SummaryWebhookURL, summary)
+	}
+	return nil
+}
+
+func expiryHistogram(from, to time.Time) (map[time.Time]int, error) {
+	var rows []struct {
+		Day   time.Time `db:"day"`
+		Count int       `db:"count"`
+	}
+	err := pg.Select(&rows, `
+SELECT date_trunc('day', pinned_at + lifespan) AS day, count(*) AS count
+FROM objects
+WHERE pinned_at + lifespan >= $1 AND pinned_at + lifespan < $2
+GROUP BY day
+    `, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	histogram := make(map[time.Time]int, len(rows))
+	for _, row := range rows {
+		// in utc so the days can be looked up with the ones callers make
+		histogram[row.Day.UTC()] = row.Count
+	}
+	return histogram, nil
+}
+
+func fetchStats() (st Stats, err error) {
+	err = pg.Get(&st.ActiveObjects, `
+SELECT count(*) FROM objects WHERE pinned_at + lifespan > now()
+    `)
+	if err != nil {
+		return
+	}
+
+	st.StoredGB, err = usedGB()
+	if err != nil {
+		return
+	}
+
+	var counts []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}
+	err = pg.Select(&counts, `
+SELECT status, count(*) AS count FROM payments GROUP BY status
+    `)
+	if err != nil {
+		return
+	}
+
+	st.Payments = make(map[string]int, len(counts))
+	for _, c := range counts {
+		st.Payments[c.Status] = c.Count
+	}
+	return
+}
+
+type StorageDrift struct {
+	NodeGB     float64 `json:"node_gb"`
+	DatabaseGB float64 `json:"database_gb"`
+	DeltaGB    float64 `json:"delta_gb"`
+}
+
+func storageDrift() (drift StorageDrift, err error) {
+	stat, err := repoStat()
+	if err != nil {
+		return
+	}
+
+	drift.DatabaseGB, err = usedGB()
+	if err != nil {
+		return
+	}
+
+	drift.NodeGB = datasize.ByteSize(stat.RepoSize).GBytes()
+	drift.DeltaGB = drift.NodeGB - drift.DatabaseGB
+	return drift, nil
+}
+
+type RemainingBucket struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	CIDs  []string `json:"cids"`
+}
+
+var remainingBuckets = []string{"<1d", "1-7d", "7-30d", ">30d"}
+
+// objectsByRemainingBucket groups the active objects by how long they have
+// left, soonest ending first within each bucket.
+func objectsByRemainingBucket() ([]RemainingBucket, error) {
+	var rows []struct {
+		Name string         `db:"name"`
+		CIDs pq.StringArray `db:"cids"`
+	}
+	err := pg.Select(&rows, `
+SELECT name, array_agg(cid ORDER BY ends_at) AS cids
+FROM (
+  SELECT cid, pinned_at + lifespan AS ends_at,
+    CASE
+      WHEN pinned_at + lifespan < now() + interval '1 day' THEN '<1d'
+      WHEN pinned_at + lifespan < now() + interval '7 days' THEN '1-7d'
+      WHEN pinned_at + lifespan < now() + interval '30 days' THEN '7-30d'
+      ELSE '>30d'
+    END AS name
+  FROM objects
+  WHERE pinned_at + lifespan > now()
+) AS o
+GROUP BY name
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string][]string, len(rows))
+	for _, row := range rows {
+		byName[row.Name] = row.CIDs
+	}
+
+	buckets := make([]RemainingBucket, len(remainingBuckets))
+	for i, name := range remainingBuckets {
+		cids := byName[name]
+		if cids == nil {
+			cids = make([]string, 0)
+		}
+		buckets[i] = RemainingBucket{name, len(cids), cids}
+	}
+	return buckets, nil
+}
+
+// retryDistribution counts the pinned payments by how many tries of theirs
+// failed before the one that pinned them.
+func retryDistribution() (map[int]int, error) {
+	var rows []struct {
+		Tries int `db:"tries"`
+		Count int `db:"count"`
+	}
+	err := pg.Select(&rows, `
+SELECT tries, count(*) AS count FROM payments
+WHERE status = 'pinned'
+GROUP BY tries
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	distribution := make(map[int]int, len(rows))
+	for _, row := range rows {
+		distribution[row.Tries] = row.Count
+	}
+	return distribution, nil
+}
+
+type DailyProjection struct {
+	Day        time.Time `json:"day" db:"day"`
+	Objects    int       `json:"objects" db:"objects"`
+	ExpiringGB float64   `json:"expiring_gb" db:"expiring_gb"`
+}
+
+const maxProjectionDays = 366
+
+// projectedCapacity tells how much space frees up on each of the next days
+// as objects expire, assuming none of them is renewed.
+func projectedCapacity(days int) ([]DailyProjection, error) {
+	if days < 1 || days > maxProjectionDays {
+		return nil, fmt.Errorf("days must be between 1 and %d, got %d",
+			maxProjectionDays, days)
+	}
+
+	projections := make([]DailyProjection, 0, days)
+	err := pg.Select(&projections, `
+SELECT d.day, count(o.cid) AS objects, coalesce(sum(o.sizegb), 0) AS expiring_gb
+FROM generate_series(
+  date_trunc('day', now()),
+  date_trunc('day', now()) + make_interval(days := $1 - 1),
+  interval '1 day'
+) AS d (day)
+LEFT JOIN objects AS o
+  ON o.pinned_at + o.lifespan >= greatest(d.day, now())
+ AND o.pinned_at + o.lifespan < d.day + interval '1 day'
+GROUP BY d.day
+ORDER BY d.day
+    `, days)
+	return projections, err
+}
+
+// revenueAtRisk is what was paid for the objects ending within the given
+// time, i.e. the revenue that has to be renewed to be kept.
+func revenueAtRisk(within time.Duration) (revenue int, err error) {
+	err = pg.Get(&revenue, `
+SELECT coalesce(sum(p.amount), 0)
+FROM payments AS p
+INNER JOIN objects AS o ON o.cid = p.cid
+WHERE `+currentPayments+`
+  AND o.pinned_at + o.lifespan > now()
+  AND o.pinned_at + o.lifespan <= now() + make_interval(secs := $1)
+    `, within.Seconds())
+	return
+}
+
+// averages are over active objects, durations being their whole lifespans.
+func averages() (avgSizeGB float64, avgDuration time.Duration, err error) {
+	var res struct {
+		SizeGB float64 `db:"sizegb"`
+		Secs   float64 `db:"secs"`
+	}
+	err = pg.Get(&res, `
+SELECT
+  coalesce(avg(sizegb), 0) AS sizegb,
+  coalesce(avg(extract(epoch FROM lifespan)), 0) AS secs
+FROM objects
+WHERE pinned_at + lifespan > now()
+    `)
+	if err != nil {
+		return
+	}
+	return res.SizeGB, time.Duration(res.Secs) * time.Second, nil
+}
+
+// oldestUnprocessedAge is how long the oldest pending payment has waited, or
+// zero when nothing is pending. payments on hold wait on purpose, so they're
+// left out.
+func oldestUnprocessedAge() (time.Duration, error) {
+	var secs float64
+	err := pg.Get(&secs, `
+SELECT coalesce(extract(epoch FROM now() - min(paid_at)), 0)
+FROM payments
+WHERE status IN ('trying', 'queued') AND NOT on_hold
+    `)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+type NoteCount struct {
+	Note    string `json:"note" db:"note"`
+	Objects int    `json:"objects" db:"objects"`
+}
+
+// distinctNotes counts the active objects carrying each note, most used first.
+func distinctNotes() (nn []NoteCount, err error) {
+	nn = make([]NoteCount, 0)
+	err = pg.Select(&nn, `
+SELECT note, count(DISTINCT cid) AS objects
+FROM objects, unnest(notes) AS note
+WHERE pinned_at + lifespan > now()
+GROUP BY note
+ORDER BY objects DESC, note ASC
+    `)
+	return
+}
+
+type SnapshotEntry struct {
+	CID       string        `db:"cid"`
+	SizeGB    float64       `db:"sizegb"`
+	PinnedAt  time.Time     `db:"pinned_at"`
+	EndsAt    time.Time     `db:"ends_at"`
+	Remaining time.Duration `db:"-"`
+}
+
+// snapshot is the objects that were active at the given time, with their
+// remaining lifespans then. lifespans are the ones bought by the payments made
+// by then, so later renewals don't count. objects since erased come from their
+// tombstones, ending when they were erased if that was early. objects paid for
+// before prices were recorded fall back to their current lifespans.
+func snapshot(at time.Time) ([]SnapshotEntry, error) {
+	// timestamps are stored in UTC, and an offset would be dropped
+	at = at.UTC()
+
+	// a row per payment of each object pinned at the time, in the order they
+	// were made. the payments of an object are those made since its cid was
+	// last erased before it.
+	var rows []struct {
+		SnapshotEntry
+		N        int             `db:"n"`
+		ErasedAt sql.NullTime    `db:"erased_at"`
+		Amount   sql.NullInt64   `db:"amount"`
+		PriceGB  sql.NullString  `db:"price_gb"`
+		Clamped  sql.NullFloat64 `db:"clamped_secs"`
+	}
+	err := pg.Select(&rows, `
+WITH c AS (
+  SELECT row_number() OVER () AS n, * FROM (
+    SELECT cid, sizegb, pinned_at, pinned_at + lifespan AS ends_at,
+      NULL::timestamp AS erased_at
+    FROM objects
+    WHERE pinned_at <= $1
+    UNION ALL
+    SELECT cid, sizegb, pinned_at, ends_at, erased_at
+    FROM erased_objects
+    WHERE pinned_at <= $1 AND erased_at > $1
+  ) AS u
+)
+SELECT c.n, c.cid, c.sizegb, c.pinned_at, c.ends_at, c.erased_at,
+  p.amount, p.price_gb::text AS price_gb, extract(epoch FROM p.clamped) AS clamped_secs
+FROM c
+LEFT JOIN payments AS p ON p.cid = c.cid
+  AND p.status = 'pinned'
+  AND p.paid_at <= $1
+  AND p.paid_at > coalesce(greatest(
+    (SELECT max(erased_at) FROM erased_objects AS t
+     WHERE t.cid = c.cid AND t.erased_at < coalesce(c.erased_at, 'infinity')),
+    (SELECT max(created_at) FROM events AS e
+     WHERE e.cid = c.cid AND e.kind = 'erased'
+       AND e.created_at < coalesce(c.erased_at, 'infinity'))
+  ), '-infinity')
+ORDER BY c.n, p.paid_at
+    `, at)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]SnapshotEntry, 0)
+	for i := 0; i < len(rows); {
+		first := rows[i]
+		var payments []lifespanPayment
+		for ; i < len(rows) && rows[i].N == first.N; i++ {
+			if rows[i].Amount.Valid {
+				payments = append(payments, lifespanPayment{
+					CID:     rows[i].CID,
+					Amount:  rows[i].Amount.Int64,
+					PriceGB: rows[i].PriceGB,
+					Clamped: rows[i].Clamped.Float64,
+				})
+			}
+		}
+
+		entry := first.SnapshotEntry
+		if len(payments) > 0 {
+			lifespan, err := expectedLifespan(payments, entry.SizeGB)
+			if err == nil {
+				entry.EndsAt = entry.PinnedAt.Add(lifespan)
+			} else if err != errUnknownPrice {
+				log.Warn().Err(err).Str("cid", entry.CID).
+					Msg("can't tell the lifespan paid by then, using the current one")
+			}
+		}
+		if first.ErasedAt.Valid && first.ErasedAt.Time.Before(entry.EndsAt) {
+			entry.EndsAt = first.ErasedAt.Time
+		}
+		if !entry.EndsAt.After(at) {
+			continue
+		}
+
+		entry.Remaining = entry.EndsAt.Sub(at)
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].EndsAt.Before(entries[j].EndsAt)
+	})
+	return entries, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProjectedCapacityDays(t *testing.T) {
+	// out of range days are refused before anything is queried
+	for _, days := range []int{-1, 0, maxProjectionDays + 1, 100000} {
+		_, err := projectedCapacity(days)
+		if err == nil {
+			t.Errorf("projectedCapacity(%d) = nil error", days)
+		}
+	}
+}
+
+func TestProjectedCapacity(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	for _, days := range []int{1, 30, maxProjectionDays} {
+		projections, err := projectedCapacity(days)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(projections) != days {
+			t.Errorf("projectedCapacity(%d) has %d days", days, len(projections))
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	// reconstruct a past snapshot from seeded history, at 1 GB and 100 a
+	// GB-day so every 100 paid is a day.
+	now := time.Now().UTC().Truncate(time.Second)
+	day := 24 * time.Hour
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, price_gb, paid_at) VALUES
+  -- renewed after the snapshot, which mustn't count
+  ('a1', 'QmA', 1000, 'pinned', 100, $1::timestamp - interval '10 days'),
+  ('a2', 'QmA', 1000, 'pinned', 100, $1::timestamp - interval '2 days'),
+  -- erased after the snapshot
+  ('b1', 'QmB', 700, 'pinned', 100, $1::timestamp - interval '10 days'),
+  -- pinned after the snapshot
+  ('c1', 'QmC', 1000, 'pinned', 100, $1::timestamp - interval '1 day'),
+  -- erased before the snapshot
+  ('d1', 'QmD', 300, 'pinned', 100, $1::timestamp - interval '10 days'),
+  -- pinned again after an earlier pin was erased
+  ('e1', 'QmE', 2000, 'pinned', 100, $1::timestamp - interval '12 days'),
+  ('e2', 'QmE', 1000, 'pinned', 100, $1::timestamp - interval '7 days');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 1, $1::timestamp - interval '10 days', interval '20 days'),
+  ('QmC', 1, $1::timestamp - interval '1 day', interval '10 days'),
+  ('QmE', 1, $1::timestamp - interval '7 days', interval '10 days');
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at, erased_at) VALUES
+  ('QmB', 1, $1::timestamp - interval '10 days', $1::timestamp - interval '3 days',
+    $1::timestamp - interval '2 days'),
+  ('QmD', 1, $1::timestamp - interval '10 days', $1::timestamp - interval '7 days',
+    $1::timestamp - interval '6 days'),
+  ('QmE', 1, $1::timestamp - interval '12 days', $1::timestamp - interval '8 days',
+    $1::timestamp - interval '8 days');
+    `, now)
+
+	at := now.Add(-5 * day)
+	entries, err := snapshot(at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		cid       string
+		remaining time.Duration
+	}{
+		{"QmB", 2 * day},
+		{"QmA", 5 * day},
+		{"QmE", 8 * day},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("snapshot() = %+v, want %d entries", entries, len(want))
+	}
+	for i, w := range want {
+		if entries[i].CID != w.cid || entries[i].Remaining != w.remaining {
+			t.Errorf("entry %d = %s with %v left, want %s with %v",
+				i, entries[i].CID, entries[i].Remaining, w.cid, w.remaining)
+		}
+	}
+
+	// the same instant elsewhere is the same snapshot
+	elsewhere, err := snapshot(at.In(time.FixedZone("UTC+2", 2*60*60)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elsewhere) != len(entries) {
+		t.Fatalf("snapshot() in another zone has %d entries, want %d", len(elsewhere), len(entries))
+	}
+}
+
+func TestRealizedPricePerGBDay(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, paid_at, recycling) VALUES
+  ('old', 'QmOld', 100, 'repurposed', $1::timestamp - interval '30 days', '{}'),
+  ('a1', 'QmA', 1000, 'pinned', $1::timestamp - interval '5 days', '{}'),
+  -- 100 of it was paid with the old order
+  ('b1', 'QmB', 400, 'pinned', $1::timestamp - interval '3 days', '{old}'),
+  ('c1', 'QmC', 5000, 'given_up', $1::timestamp - interval '3 days', '{}'),
+  ('d1', 'QmD', 5000, 'pinned', $1::timestamp - interval '20 days', '{}');
+-- 5 GB-days in the window
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, $1::timestamp - interval '5 days', interval '10 days');
+-- 4 days at 2 GB before it was erased early
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at, erased_at)
+VALUES ('QmB', 2, $1::timestamp - interval '20 days', $1::timestamp - interval '5 days',
+  $1::timestamp - interval '6 days');
+    `, now)
+
+	got, err := realizedPricePerGBDay(now.Add(-10*24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1300 over 13 GB-days
+	if math.Abs(got-100) > 1e-6 {
+		t.Fatalf("realizedPricePerGBDay() = %v, want 100", got)
+	}
+}
+
+func TestDailySummary(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	to := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, paid_at, recycling) VALUES
+  ('old', 'QmOld', 300, 'repurposed', '2024-02-20 10:00', '{}'),
+  ('a1', 'QmA', 1000, 'pinned', '2024-03-01 01:00', '{}'),
+  -- 300 of it was paid on an earlier day
+  ('b1', 'QmB', 500, 'pinned', '2024-03-01 12:00', '{old}'),
+  ('c1', 'QmC', 2000, 'given_up', '2024-03-01 23:59', '{}'),
+  -- the days either side
+  ('d1', 'QmD', 7000, 'pinned', '2024-02-29 23:59', '{}'),
+  ('e1', 'QmE', 7000, 'pinned', '2024-03-02 00:00', '{}');
+INSERT INTO events (kind, cid, order_id, sizegb, created_at) VALUES
+  ('pinned', 'QmA', 'a1', 1.5, '2024-03-01 01:05'),
+  ('renewed', 'QmB', 'b1', 2, '2024-03-01 12:05'),
+  ('given_up', 'QmC', 'c1', 0, '2024-03-01 23:59'),
+  ('erased', 'QmX', '', 3, '2024-03-01 06:00'),
+  ('erased', 'QmY', '', 0.5, '2024-03-01 07:00'),
+  ('pinned', 'QmD', 'd1', 4, '2024-02-29 23:59'),
+  ('pinned', 'QmE', 'e1', 4, '2024-03-02 00:00');
+    `)
+
+	summary, err := dailySummary(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !summary.From.Equal(to.Add(-24*time.Hour)) || !summary.To.Equal(to) {
+		t.Errorf("window = %v to %v", summary.From, summary.To)
+	}
+	if summary.Pinned != 1 || summary.Renewed != 1 || summary.Erased != 2 || summary.GivenUp != 1 {
+		t.Errorf("pinned, renewed, erased, given up = %d, %d, %d, %d, want 1, 1, 2, 1",
+			summary.Pinned, summary.Renewed, summary.Erased, summary.GivenUp)
+	}
+	if summary.GBAdded != 1.5 || summary.GBRemoved != 3.5 {
+		t.Errorf("GB added, removed = %v, %v, want 1.5, 3.5", summary.GBAdded, summary.GBRemoved)
+	}
+	if summary.Revenue != 3200 {
+		t.Errorf("revenue = %d, want 3200", summary.Revenue)
+	}
+}
+
+func TestExpiryHistogram(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 1, '2024-03-01 00:00', interval '1 day'),
+  ('QmB', 1, '2024-03-01 12:00', interval '23 hours 59 minutes'),
+  ('QmC', 1, '2024-03-01 08:00', interval '2 days'),
+  ('QmD', 1, '2024-02-20 00:00', interval '12 days 5 hours'),
+  -- either side of the range
+  ('QmEarly', 1, '2024-02-25 00:00', interval '5 days'),
+  ('QmLate', 1, '2024-03-01 00:00', interval '4 days');
+    `)
+
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	histogram, err := expiryHistogram(day(2), day(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[time.Time]int{day(2): 2, day(3): 2, day(4): 0}
+	for d, n := range want {
+		if histogram[d] != n {
+			t.Errorf("%s: %d expiring, want %d", d.Format("2006-01-02"), histogram[d], n)
+		}
+	}
+	if len(histogram) != 2 {
+		t.Errorf("expiryHistogram() = %v, want 2 days", histogram)
+	}
+}
+
+func TestObjectsByRemainingBucket(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmHours', 1, now(), interval '12 hours'),
+  ('QmDays', 1, now(), interval '3 days'),
+  ('QmDay', 1, now(), interval '25 hours'),
+  ('QmWeeks', 1, now(), interval '14 days'),
+  ('QmMonths', 1, now(), interval '90 days'),
+  ('QmEnded', 1, now() - interval '2 days', interval '1 day');
+    `)
+
+	buckets, err := objectsByRemainingBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		name string
+		cids string
+	}{
+		{"<1d", "QmHours"},
+		{"1-7d", "QmDay,QmDays"},
+		{"7-30d", "QmWeeks"},
+		{">30d", "QmMonths"},
+	}
+	if len(buckets) != len(want) {
+		t.Fatalf("got %d buckets, want %d", len(buckets), len(want))
+	}
+	for i, b := range buckets {
+		cids := strings.Join(b.CIDs, ",")
+		if b.Name != want[i].name || cids != want[i].cids || b.Count != len(b.CIDs) {
+			t.Errorf("bucket %d = %s %d %s, want %s %s", i, b.Name, b.Count, cids, want[i].name, want[i].cids)
+		}
+	}
+}
+
+func TestRetryDistribution(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, tries) VALUES
+  ('order1', 'QmA', 1000, 'pinned', 0),
+  ('order2', 'QmB', 1000, 'pinned', 0),
+  ('order3', 'QmC', 1000, 'pinned', 1),
+  ('order4', 'QmD', 1000, 'pinned', 3),
+  ('order5', 'QmE', 1000, 'pinned', 3),
+  ('order6', 'QmF', 1000, 'pinned', 3),
+  -- not pinned, not counted
+  ('order7', 'QmG', 1000, 'given_up', 5),
+  ('order8', 'QmH', 1000, 'trying', 1);
+    `)
+
+	got, err := retryDistribution()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{0: 2, 1: 1, 3: 3}
+	if len(got) != len(want) {
+		t.Fatalf("retryDistribution() = %v, want %v", got, want)
+	}
+	for tries, n := range want {
+		if got[tries] != n {
+			t.Fatalf("retryDistribution() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRevenueAtRisk(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmSoon', 1, $1::timestamp - interval '1 day', interval '3 days'),
+  ('QmLater', 1, $1::timestamp, interval '10 days'),
+  ('QmEnded', 1, $1::timestamp - interval '2 days', interval '1 day');
+INSERT INTO payments (order_id, cid, amount, status, paid_at) VALUES
+  ('order1', 'QmSoon', 1000, 'pinned', $1::timestamp - interval '1 day'),
+  ('order2', 'QmSoon', 500, 'pinned', $1::timestamp - interval '1 hour'),
+  -- paid for an earlier object with the same cid, erased since
+  ('order3', 'QmSoon', 700, 'pinned', $1::timestamp - interval '30 days'),
+  ('order4', 'QmSoon', 900, 'given_up', $1::timestamp - interval '1 hour'),
+  ('order5', 'QmLater', 2000, 'pinned', $1::timestamp),
+  ('order6', 'QmEnded', 3000, 'pinned', $1::timestamp - interval '2 days');
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at, erased_at)
+VALUES ('QmSoon', 1, $1::timestamp - interval '30 days', $1::timestamp - interval '20 days',
+  $1::timestamp - interval '19 days');
+    `, now)
+
+	tests := []struct {
+		within time.Duration
+		want   int
+	}{
+		{time.Hour, 0},
+		{7 * 24 * time.Hour, 1500},
+		{30 * 24 * time.Hour, 3500},
+	}
+
+	for _, tt := range tests {
+		got, err := revenueAtRisk(tt.within)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("revenueAtRisk(%v) = %d, want %d", tt.within, got, tt.want)
+		}
+	}
+}
+
+func TestAverages(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	sizegb, duration, err := averages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizegb != 0 || duration != 0 {
+		t.Fatalf("averages() without objects = %v, %v", sizegb, duration)
+	}
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 1, now(), interval '1 day'),
+  ('QmB', 2, now() - interval '1 day', interval '3 days'),
+  ('QmC', 6, now(), interval '8 days'),
+  ('QmEnded', 100, now() - interval '100 days', interval '1 day');
+    `)
+
+	sizegb, duration, err = averages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizegb != 3 || duration != 4*24*time.Hour {
+		t.Fatalf("averages() = %v GB, %v, want 3 GB, 96h", sizegb, duration)
+	}
+}
+
+func TestOldestUnprocessedAge(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	age, err := oldestUnprocessedAge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age != 0 {
+		t.Fatalf("oldestUnprocessedAge() with nothing pending = %v", age)
+	}
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, paid_at, on_hold) VALUES
+  ('recent', 'QmA', 1000, 'trying', now() - interval '5 minutes', false),
+  ('queued', 'QmB', 1000, 'queued', now() - interval '2 hours', false),
+  -- waiting on purpose or done, not counted
+  ('held', 'QmC', 1000, 'trying', now() - interval '3 days', true),
+  ('pinned', 'QmD', 1000, 'pinned', now() - interval '10 days', false),
+  ('given_up', 'QmE', 1000, 'given_up', now() - interval '10 days', false);
+    `)
+
+	age, err = oldestUnprocessedAge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age < 2*time.Hour || age > 2*time.Hour+time.Minute {
+		t.Fatalf("oldestUnprocessedAge() = %v, want 2h", age)
+	}
+}
+
+func TestDistinctNotes(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes) VALUES
+  ('QmA', 1, now(), interval '1 day', '{photos,2023}'),
+  ('QmB', 1, now(), interval '1 day', '{photos}'),
+  ('QmC', 1, now(), interval '1 day', '{videos}'),
+  ('QmD', 1, now(), interval '1 day', '{}'),
+  ('QmEnded', 1, now() - interval '2 days', interval '1 day', '{photos,old}');
+    `)
+
+	nn, err := distinctNotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(nn))
+	for i, n := range nn {
+		got[i] = fmt.Sprintf("%s:%d", n.Note, n.Objects)
+	}
+	// shared notes first, then the others by name
+	if want := "photos:2, 2023:1, videos:1"; strings.Join(got, ", ") != want {
+		t.Fatalf("distinctNotes() = %v, want %s", got, want)
+	}
+}
+
+func TestStorageDrift(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	// 1.5 GB more on the node than the objects account for
+	node.repoSize = 5 << 29
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 0.75, now(), interval '1 day'),
+  ('QmB', 0.25, now(), interval '1 day');
+    `)
+
+	w := httptest.NewRecorder()
+	getStorageDrift(w, httptest.NewRequest("GET", "/api/storage", nil))
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var drift StorageDrift
+	err := json.NewDecoder(w.Body).Decode(&drift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.NodeGB != 2.5 || drift.DatabaseGB != 1 || drift.DeltaGB != 1.5 {
+		t.Fatalf("drift = %+v, want 2.5 on the node, 1 in the database", drift)
+	}
+}
+
+func TestStorageDriftNodeDown(t *testing.T) {
+	useSettings(t, nil)
+	node := useFakeNode(t)
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		w.WriteHeader(502)
+		return true
+	}
+
+	w := httptest.NewRecorder()
+	getStorageDrift(w, httptest.NewRequest("GET", "/api/storage", nil))
+	if w.Code != 500 {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	if got := errorMessage(t, w); got != "failed to compute storage drift" {
+		t.Fatalf("error = %q", got)
+	}
+}
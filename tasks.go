@@ -1,28 +1,67 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/lib/pq"
 )
 
+type claimedPayment struct {
+	OrderId    string `db:"order_id"`
+	CID        string `db:"cid"`
+	Amount     int64  `db:"amount"`
+	Note       string `db:"note"`
+	Owner      string `db:"owner"`
+	Path       string `db:"path"`
+	Encryption string `db:"encryption"`
+	Resumed    bool   `db:"resumed"`
+}
+
+// maintenance is set while the node is being worked on, so payments aren't
+// processed and objects aren't erased until it's unset.
+var maintenance int32
+
+func setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&maintenance, v)
+	log.Info().Bool("on", on).Msg("maintenance mode")
+}
+
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
 func processPayments() error {
-	pg.Exec(`UPDATE payments SET status = 'given_up' WHERE tries > 20`)
+	if inMaintenance() {
+		log.Info().Msg("in maintenance, not processing payments")
+		return nil
+	}
 
-	payments := make([]struct {
-		OrderId string `db:"order_id"`
-		CID     string `db:"cid"`
-		Amount  int64  `db:"amount"`
-	}, 0)
-	err = pg.Select(&payments, `
-UPDATE payments
-SET tries = payments.tries + 1
-WHERE status = 'trying'
-RETURNING order_id, cid, amount
-    `)
-	if err != nil && err != sql.ErrNoRows {
+	// exhausted payments must be given up before claiming, or they'd be
+	// tried once more.
+	err := giveUpExhausted()
+	if err != nil {
+		return err
+	}
+
+	payments, err := claimPayments("")
+	if err != nil {
 		return err
 	}
 
@@ -31,112 +70,1649 @@ RETURNING order_id, cid, amount
 		return nil
 	}
 
+	// pins still running at the deadline are cancelled and tried again later
+	ctx, cancel := context.WithTimeout(context.Background(), s.ProcessBatchTimeout)
+	defer cancel()
+
 	jobs := make(chan error, len(payments))
 	for _, payment := range payments {
-		go func(orderId string, cid string, amount int64) {
-			logger := log.With().
-				Str("order_id", orderId).
-				Int64("amount", amount).
-				Str("cid", cid).Logger()
+		go func(p claimedPayment) {
+			jobs <- processClaimedPayment(ctx, p)
+		}(payment)
+	}
+
+	allfinished := make(chan bool, 1)
+	go func() {
+		// every job reports exactly once
+		for range payments {
+			<-jobs
+		}
+		allfinished <- true
+	}()
+
+	select {
+	case _ = <-allfinished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("processing payments timed out after %v", s.ProcessBatchTimeout)
+	}
+}
 
-			var err error
-			var sizegb float64
+// processPayment processes a single order right away, as when its payment
+// has just been confirmed, instead of waiting for the next periodic pass.
+func processPayment(orderId string) error {
+	if inMaintenance() {
+		// the payment stays pending and is processed after maintenance
+		log.Info().Str("order_id", orderId).Msg("in maintenance, not processing payment")
+		return nil
+	}
 
-			logger.Debug().Msg("processing payment")
+	payments, err := claimPayments(orderId)
+	if err != nil {
+		return err
+	}
+	if len(payments) == 0 {
+		return fmt.Errorf("payment %s is not pending or is being processed", orderId)
+	}
 
-			if o, err := fetchObject(cid); err == nil && o != nil {
-				logger.Info().Msg("object already pinned. no need to pin again.")
-				sizegb = o.SizeGB
-				goto savingOnDatabase
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), s.ProcessBatchTimeout)
+	defer cancel()
+	return processClaimedPayment(ctx, payments[0])
+}
 
-			sizegb, err = size(cid)
-			if err != nil {
-				jobs <- err
-				logger.Error().Err(err).Msg("failed to get size")
-				return
+// releaseClaims frees payments claimed before a restart, so their
+// processing resumes right away instead of waiting for the claims to expire.
+// the interrupted processing counts as a try, so a payment that keeps taking
+// the process down is eventually given up.
+func releaseClaims() error {
+	_, err := pg.Exec(`
+UPDATE payments SET claimed_at = NULL, infra_tries = infra_tries + 1
+WHERE claimed_at IS NOT NULL AND status IN ('trying', 'queued')
+    `)
+	return err
+}
+
+// giveUpExhausted is a statement of its own rather than part of the claim, as
+// both would update the same rows and a statement can't see its own updates.
+// a zero MaxQueueWait lets payments wait in the queue for as long as it takes.
+func giveUpExhausted() error {
+	_, err := pg.Exec(`
+WITH g AS (
+  UPDATE payments
+  SET status = 'given_up', given_up_at = now(),
+      given_up_reason = CASE
+        WHEN tries >= $2 THEN 'exhausted'
+        WHEN infra_tries >= $3 THEN 'infra_exhausted'
+        ELSE 'queue_timeout'
+      END
+  WHERE NOT on_hold
+    AND (tries >= $2 OR infra_tries >= $3
+      OR (status = 'queued' AND $1 > 0 AND queued_at < now() - make_interval(secs := $1)))
+    AND status IN ('trying', 'queued')
+  RETURNING order_id, cid, given_up_reason
+)
+INSERT INTO events (kind, cid, order_id, detail)
+SELECT 'given_up', cid, order_id, given_up_reason FROM g
+    `, s.MaxQueueWait.Seconds(), s.MaxPinTries, s.MaxInfraTries)
+	return err
+}
+
+// claimPayments marks pending payments as being processed and returns them.
+// an empty orderId claims every pending payment. taking over an expired claim
+// counts as a try, as whoever held it never finished.
+func claimPayments(orderId string) ([]claimedPayment, error) {
+	payments := make([]claimedPayment, 0)
+	err := pg.Select(&payments, `
+UPDATE payments
+SET claimed_at = now(),
+    last_try_at = now(),
+    infra_tries = infra_tries + CASE WHEN claimed_at IS NULL THEN 0 ELSE 1 END
+WHERE order_id IN (
+  SELECT order_id FROM payments
+  WHERE status IN ('trying', 'queued')
+    AND NOT on_hold
+    AND tries < $2 AND infra_tries < $3
+    -- processing is cancelled after a batch timeout, so claims outlasting two
+    -- were left by a crash
+    AND (claimed_at IS NULL OR claimed_at < now() - make_interval(secs := $4))
+    AND ($1 = '' OR order_id = $1)
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING order_id, cid, amount, coalesce(note, '') AS note, owner, path, encryption,
+  pinning_since IS NOT NULL AS resumed
+    `, orderId, s.MaxPinTries, s.MaxInfraTries, 2*s.ProcessBatchTimeout.Seconds())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// pins interrupted by a restart go first, their blocks are mostly
+	// fetched already.
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].Resumed && !payments[j].Resumed
+	})
+	return payments, nil
+}
+
+func processClaimedPayment(parent context.Context, p claimedPayment) (err error) {
+	orderId, cid, amount, note := p.OrderId, p.CID, p.Amount, p.Note
+
+	logger := log.With().
+		Str("order_id", orderId).
+		Str("amount", formatAmount(amount)).
+		Str("cid", cid).Logger()
+
+	var sizegb, measured float64
+	var renewal bool
+	var priceGB *big.Rat
+
+	ctx, done := trackInFlight(parent, orderId)
+	defer done()
+
+	// the owner's quota is held until the object is saved, so concurrent
+	// payments of the owner see this one
+	releaseQuota := func() {}
+	defer func() { releaseQuota() }()
+
+	defer pg.Exec(`
+UPDATE payments SET claimed_at = NULL WHERE order_id = $1
+    `, orderId)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if !isRetryable(err) {
+			logger.Warn().Err(err).Msg("giving up payment")
+			giveUp(orderId, errorClass(err))
+			return
+		}
+
+		// problems on our side have a budget of their own, so they don't
+		// give up on payments for content that's fine.
+		column := "tries"
+		if isInfraError(err) {
+			column = "infra_tries"
+		}
+		pg.Exec(`
+UPDATE payments SET `+column+` = `+column+` + 1 WHERE order_id = $1
+    `, orderId)
+	}()
+
+	logger.Debug().Msg("processing payment")
+
+	priceGB, err = satsPriceGB()
+	if err == errRateUnavailable {
+		// not the payer's fault, wait for the rate source to come back.
+		logger.Info().Msg("no exchange rate, queueing payment")
+		return queuePayment(orderId)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o, err := fetchObject(cid); err == nil && o != nil && validSize(o.SizeGB) {
+		logger.Info().Msg("object already pinned. no need to pin again.")
+		sizegb = o.SizeGB
+		renewal = true
+		err = checkMinAmount(amount, renewal)
+		if err != nil {
+			logger.Info().Err(err).Msg("")
+			return err
+		}
+		releaseQuota, err = reserveOwnerQuota(p.Owner, cid, sizegb)
+		if err != nil {
+			logger.Info().Err(err).Msg("")
+			return err
+		}
+		goto savingOnDatabase
+	}
+
+	err = checkMinAmount(amount, renewal)
+	if err != nil {
+		logger.Info().Err(err).Msg("")
+		return err
+	}
+
+	sizegb, err = size(cid)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to get size")
+		return err
+	}
+
+	logger = logger.With().Float64("sizegb", sizegb).Logger()
+
+	err = checkPinSize(sizegb, amount, priceGB)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return err
+	}
+
+	releaseQuota, err = reserveOwnerQuota(p.Owner, cid, sizegb)
+	if err != nil {
+		logger.Info().Err(err).Msg("")
+		return err
+	}
+
+	if !admitPin(sizegb) {
+		// try again on the next run, this doesn't count as a try.
+		logger.Info().Msg("too much being pinned already, deferring payment")
+		return nil
+	}
+	defer pinFinished(sizegb)
+
+	// the reservation is held until the object row is saved, so
+	// concurrent payments see this pin in the capacity check.
+	err = reserveCapacity(sizegb)
+	if err == errCapacityFull {
+		logger.Info().Msg("no capacity left, queueing payment")
+		return queuePayment(orderId)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("can't reserve capacity")
+		return err
+	}
+	defer releaseCapacity(sizegb)
+
+	if p.Resumed {
+		logger.Info().Msg("resuming interrupted pin")
+	}
+	// out of the queue, if it was in it, now that there's room
+	_, err = pg.Exec(`
+UPDATE payments
+SET status = 'trying', queued_at = NULL, pinning_since = coalesce(pinning_since, now())
+WHERE order_id = $1 AND status IN ('trying', 'queued')
+    `, orderId)
+	if err != nil {
+		return err
+	}
+
+	measured, err = pin(ctx, cid, orderId)
+	if err != nil {
+		logger.Error().Err(err).Msg("pin failed")
+		return err
+	}
+	logger.Info().Float64("sizegb", sizegb).Float64("measured", measured).
+		Msg("pinned")
+
+	if validSize(measured) && measured > sizegb {
+		// the estimate was short. what the node actually stores must fit
+		// the limits too, and the difference is held like the estimate.
+		extra := measured - sizegb
+		err = checkPinSize(measured, amount, priceGB)
+		if err == nil {
+			var releaseExtra func()
+			releaseExtra, err = reserveOwnerQuota(p.Owner, cid, extra)
+			release := releaseQuota
+			releaseQuota = func() { release(); releaseExtra() }
+		}
+		if err == nil {
+			err = reserveCapacity(extra)
+			if err == nil {
+				defer releaseCapacity(extra)
+			}
+		}
+		if err != nil {
+			logger.Warn().Err(err).Float64("measured", measured).
+				Msg("stored size over the limits, unpinning")
+			// unless another payment has saved it meanwhile
+			if o, ferr := fetchObject(cid); ferr == nil && o == nil {
+				uerr := unpin(cid)
+				if uerr != nil {
+					logger.Warn().Err(uerr).Msg("failed to unpin")
+				}
 			}
+			if err == errCapacityFull {
+				return queuePayment(orderId)
+			}
+			return err
+		}
+	}
 
-			logger = logger.With().Float64("sizegb", sizegb).Logger()
+	// charge for what the node actually stores
+	if validSize(measured) {
+		sizegb = measured
+	}
 
-			if sizegb > float64(amount)/float64(s.PriceGB) {
-				err = fmt.Errorf("object too big for the payment: %v > %v / %v",
-					sizegb, amount, s.PriceGB)
-			} else if sizegb > s.AbsoluteMaxSize {
-				err = fmt.Errorf("object absolutely too big: %v > %v",
-					sizegb, s.AbsoluteMaxSize)
+savingOnDatabase:
+	// another payment for cid may have pinned it meanwhile, so whether this
+	// one renews it is only settled when saving, and it's priced then.
+	saved, inserted, err := saveObject(orderId, cid, p.Path, p.Encryption, sizegb, note,
+		func(existing bool) (*big.Rat, time.Duration, time.Duration, error) {
+			charged := priceGB
+			if existing {
+				var err error
+				charged, err = renewalPriceGB(cid, priceGB)
+				if err != nil {
+					return nil, 0, 0, err
+				}
 			}
+
+			duration, err := paymentDuration(amount, sizegb, charged, existing)
 			if err != nil {
 				logger.Error().Err(err).Msg("")
-				jobs <- err
-				return
+				return nil, 0, 0, err
+			}
+			granted := clampDuration(duration)
+			if granted != duration {
+				logger.Info().Dur("duration", duration).Dur("granted", granted).
+					Msg("duration clamped")
+			}
+			return charged, granted, duration - granted, nil
+		})
+	if err != nil {
+		return err
+	}
+	if !saved {
+		// cancelled while we were pinning. drop the pin unless the object
+		// exists because of some other payment.
+		logger.Info().Msg("payment cancelled, not saving object")
+		if o, err := fetchObject(cid); err == nil && o == nil && !renewal {
+			err = unpin(cid)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to unpin cancelled object")
+			}
+		}
+		return nil
+	}
+
+	if renewal && inserted {
+		// the object was erased between us finding it and saving. the erase
+		// holds the object's row until it's done, so its pin is gone by now.
+		logger.Warn().Msg("object erased while renewing, pinning it again")
+		_, err := pin(ctx, cid, orderId)
+		if err != nil {
+			// it's saved, reconciling will repin it
+			logger.Error().Err(err).Msg("failed to pin again")
+		}
+	}
+
+	if s.ReceiptWebhookURL != "" {
+		goBackground(func() { emitReceipt(orderId) })
+	}
+
+	if !inserted {
+		recordEvent("renewed", cid, orderId, sizegb)
+	} else {
+		recordEvent("pinned", cid, orderId, sizegb)
+
+		// exporting a big dag takes a while, the order doesn't wait for it.
+		goBackground(func() {
+			err := saveBackup(cid)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to save backup")
 			}
+		})
 
-			err = pin(cid)
+		if remotePinning() {
+			err := remotePin(cid, orderId)
 			if err != nil {
-				logger.Error().Err(err).Msg("pin failed")
-				jobs <- err
-				return
+				logger.Warn().Err(err).Msg("failed to pin on the remote service")
 			}
-			logger.Info().Float64("sizegb", sizegb).
-				Msg("pinned")
+		}
+	}
+	return nil
+}
+
+// pricing prices a payment being saved, as a renewal if its object exists by
+// then: the price charged, the lifespan granted and what was clamped off it.
+type pricing func(renewal bool) (priceGB *big.Rat, granted, clamped time.Duration, err error)
+
+// saveObject marks the payment as pinned and adds its lifespan to the object.
+// the content is already pinned at this point, so only this write is retried.
+// it does nothing if the payment isn't pending anymore, so retrying after an
+// ambiguous failure can't add the same lifespan twice and a cancelled payment
+// is never saved.
+func saveObject(orderId, cid, path, encryption string, sizegb float64, note string,
+	price pricing) (saved, inserted bool, err error) {
+	for attempt := 1; ; attempt++ {
+		var priced bool
+		saved, inserted, priced, err = trySaveObject(orderId, cid, path, encryption,
+			sizegb, note, price)
+		if err == nil || !priced || attempt == 3 {
+			// failing to price won't go any better the next time
+			return saved, inserted, err
+		}
 
-		savingOnDatabase:
-			duration := time.Hour * time.Duration(
-				float64(amount)/float64(s.PriceGB/24)/sizegb,
-			)
+		log.Warn().Err(err).Str("order_id", orderId).Int("attempt", attempt).
+			Msg("failed to save pinned object, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func trySaveObject(orderId, cid, path, encryption string, sizegb float64, note string,
+	price pricing) (saved, inserted, priced bool, err error) {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return false, false, true, err
+	}
+	defer tx.Rollback()
+
+	// payments for the same cid are saved one at a time, so only the first
+	// one creates the object and the others are priced as renewals. the
+	// object's row is locked as well, an erase holding it decides whether
+	// it still exists.
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, cid)
+	if err != nil {
+		return false, false, true, err
+	}
+	var existing bool
+	err = tx.Get(&existing, `SELECT true FROM objects WHERE cid = $1 FOR UPDATE`, cid)
+	if err != nil && err != sql.ErrNoRows {
+		return false, false, true, err
+	}
+
+	priceGB, granted, clamped, err := price(existing)
+	if err != nil {
+		return false, false, false, err
+	}
 
-			_, err = pg.Exec(`
+	var res struct {
+		Saved    bool `db:"saved"`
+		Inserted bool `db:"inserted"`
+	}
+	err = tx.Get(&res, `
 WITH c AS (
   UPDATE payments
-  SET status = 'pinned'
-  WHERE order_id = $1
+  SET status = 'pinned', clamped = make_interval(secs := $6), pinning_since = NULL,
+    price_gb = $8
+  WHERE order_id = $1 AND status IN ('trying', 'queued')
+  RETURNING order_id
+), o AS (
+  INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes, path, encryption)
+  SELECT $2, $3, now(), make_interval(secs := $4), array_remove(ARRAY[$5::text], ''),
+    $7, $9
+  FROM c
+  ON CONFLICT (cid)
+    DO UPDATE SET
+      lifespan = objects.lifespan + make_interval(secs := $4),
+      notes = CASE WHEN $5 = '' OR $5 = any(objects.notes)
+          OR coalesce(array_length(objects.notes, 1), 0) >= $10
+        THEN objects.notes
+        ELSE array_append(objects.notes, $5::text)
+      END
+  RETURNING xmax = 0 AS inserted
 )
-INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
-VALUES ($2, $3, now(), make_interval(secs := $4))
-ON CONFLICT (cid)
-  DO UPDATE SET lifespan = objects.lifespan + make_interval(secs := $4)
-            `, orderId, cid, sizegb, duration.Seconds())
-			jobs <- err
-			return
-		}(payment.OrderId, payment.CID, payment.Amount)
+SELECT
+  EXISTS (SELECT 1 FROM c) AS saved,
+  coalesce((SELECT inserted FROM o), false) AS inserted
+    `, orderId, cid, sizegb, granted.Seconds(), note, clamped.Seconds(), path,
+		priceGB.FloatString(8), encryption, s.MaxNotes)
+	if err != nil {
+		return false, false, true, err
 	}
+	return res.Saved, res.Inserted, true, tx.Commit()
+}
 
-	allfinished := make(chan bool, 1)
-	go func() {
-		for _ = range jobs {
+// in-flight orders can be aborted when their payment is cancelled.
+var inflight struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}
 
-		}
-		allfinished <- true
-	}()
+func trackInFlight(parent context.Context, orderId string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
 
-	select {
-	case _ = <-allfinished:
-		return nil
-	case <-time.After(60 * time.Minute):
-		return errors.New("timeout")
+	inflight.Lock()
+	if inflight.cancels == nil {
+		inflight.cancels = make(map[string]context.CancelFunc)
+	}
+	inflight.cancels[orderId] = cancel
+	inflight.Unlock()
+
+	return ctx, func() {
+		inflight.Lock()
+		delete(inflight.cancels, orderId)
+		inflight.Unlock()
+		cancel()
 	}
 }
 
-func eraseEnded() error {
-	var cids []string
-	err := pg.Select(&cids, `
-SELECT cid FROM objects WHERE pinned_at + lifespan < now()
-    `)
+func abortInFlight(orderId string) {
+	inflight.Lock()
+	cancel, ok := inflight.cancels[orderId]
+	inflight.Unlock()
+
+	if ok {
+		log.Info().Str("order_id", orderId).Msg("aborting in-flight order")
+		cancel()
+	}
+}
+
+// originalPriceGB is the price the object was first pinned at, or nil if it
+// wasn't recorded.
+func originalPriceGB(cid string) (*big.Rat, error) {
+	var price sql.NullString
+	err := pg.Get(&price, `
+SELECT p.price_gb::text FROM payments AS p
+INNER JOIN objects AS o ON o.cid = p.cid
+WHERE p.cid = $1 AND p.status = 'pinned' AND p.paid_at <= o.pinned_at
+  AND p.price_gb IS NOT NULL
+ORDER BY p.paid_at DESC
+LIMIT 1
+    `, cid)
+	if err == sql.ErrNoRows || (err == nil && !price.Valid) {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Debug().Str("cids", strings.Join(cids, ",")).Msg("erasing ended")
-	for _, cid := range cids {
-		err = unpin(cid)
-		if err != nil {
-			return err
+	original, ok := new(big.Rat).SetString(price.String)
+	if !ok {
+		return nil, fmt.Errorf("invalid recorded price %q", price.String)
+	}
+	return original, nil
+}
+
+// renewalPriceGB is the price a renewal of cid is charged at: the current
+// price, or the original one with RenewalPricing set so and it was recorded.
+func renewalPriceGB(cid string, current *big.Rat) (*big.Rat, error) {
+	if s.RenewalPricing != "original" {
+		return current, nil
+	}
+	original, err := originalPriceGB(cid)
+	if err != nil || original == nil {
+		return current, err
+	}
+	return original, nil
+}
+
+type amountTooLowError struct {
+	Amount  int64
+	Min     int64
+	Renewal bool
+}
+
+func (e *amountTooLowError) Error() string {
+	if e.Renewal {
+		return fmt.Sprintf("renewal amount below the minimum: %s < %s",
+			formatAmount(e.Amount), formatAmount(e.Min))
+	}
+	return fmt.Sprintf("amount below the minimum: %s < %s",
+		formatAmount(e.Amount), formatAmount(e.Min))
+}
+
+// checkMinAmount applies MinAmount to first pins and MinRenewalAmount to
+// renewals, which can be smaller as the object is already there.
+func checkMinAmount(amount int64, renewal bool) error {
+	min := s.MinAmount
+	if renewal {
+		min = s.MinRenewalAmount
+	}
+	if amount < min {
+		return &amountTooLowError{amount, min, renewal}
+	}
+	return nil
+}
+
+// pricePerGBDay is priceGB, with RenewalDiscount taken off for renewals.
+func pricePerGBDay(priceGB *big.Rat, renewal bool) *big.Rat {
+	price := new(big.Rat).Set(priceGB)
+	if renewal && s.RenewalDiscount > 0 {
+		discount := new(big.Rat).SetFloat64(s.RenewalDiscount)
+		price.Mul(price, discount.Sub(big.NewRat(1, 1), discount))
+	}
+	return price
+}
+
+// affordableGB is how many GB amount pays for a day at priceGB.
+// checkPinSize fails if sizegb can't be pinned at all, or not with amount.
+func checkPinSize(sizegb float64, amount int64, priceGB *big.Rat) error {
+	if !validSize(sizegb) {
+		return &pinError{pinErrInvalid,
+			fmt.Errorf("invalid object size: %v", sizegb)}
+	}
+	if sizegb > affordableGB(amount, priceGB) {
+		return &pinError{pinErrTooLarge,
+			fmt.Errorf("object too big for the payment: %v > %v / %v",
+				sizegb, amount, priceGB.FloatString(2))}
+	}
+	if sizegb > s.AbsoluteMaxSize {
+		return &pinError{pinErrTooLarge,
+			fmt.Errorf("object absolutely too big: %v > %v",
+				sizegb, s.AbsoluteMaxSize)}
+	}
+	return nil
+}
+
+// queuePayment has a pending payment wait for whatever it's missing.
+func queuePayment(orderId string) error {
+	_, err := pg.Exec(`
+UPDATE payments
+SET status = 'queued', queued_at = coalesce(queued_at, now())
+WHERE order_id = $1 AND status IN ('trying', 'queued')
+    `, orderId)
+	return err
+}
+
+func affordableGB(amount int64, priceGB *big.Rat) float64 {
+	gb, _ := new(big.Rat).Quo(new(big.Rat).SetInt64(amount), priceGB).Float64()
+	return gb
+}
+
+var errImplausibleDuration = errors.New("payment duration out of the plausible range")
+
+// paymentDuration is how long amount pays for sizegb at priceGB per GB-day,
+// truncated to whole seconds. the math is done with exact rationals, so that
+// truncation is the only rounding: many small renewals fall short of a single
+// big payment by less than a second each.
+// durations that are negative, don't fit a time.Duration or go over
+// MaxLifespan fail with errImplausibleDuration.
+func paymentDuration(amount int64, sizegb float64, priceGB *big.Rat, renewal bool) (time.Duration, error) {
+	if !validSize(sizegb) {
+		return 0, nil
+	}
+	if amount < 0 {
+		return 0, errImplausibleDuration
+	}
+
+	pricePerSecond := new(big.Rat).SetFloat64(sizegb)
+	pricePerSecond.Mul(pricePerSecond, pricePerGBDay(priceGB, renewal))
+	pricePerSecond.Quo(pricePerSecond, big.NewRat(24*60*60, 1))
+
+	secs := new(big.Rat).SetInt64(amount)
+	secs.Quo(secs, pricePerSecond)
+
+	maxSecs := int64(math.MaxInt64 / int64(time.Second))
+	if s.MaxLifespan > 0 {
+		maxSecs = int64(s.MaxLifespan / time.Second)
+	}
+
+	whole := new(big.Int).Quo(secs.Num(), secs.Denom())
+	if !whole.IsInt64() || whole.Int64() > maxSecs {
+		return 0, errImplausibleDuration
+	}
+	return time.Duration(whole.Int64()) * time.Second, nil
+}
+
+// clampDuration bounds a payment's duration to the configured limits.
+func clampDuration(duration time.Duration) time.Duration {
+	if s.MinDuration > 0 && duration < s.MinDuration {
+		return s.MinDuration
+	}
+	if s.MaxDuration > 0 && duration > s.MaxDuration {
+		return s.MaxDuration
+	}
+	return duration
+}
+
+// validSize tells if sizegb can be used to compute a lifespan.
+func validSize(sizegb float64) bool {
+	return sizegb > 0 && !math.IsNaN(sizegb) && !math.IsInf(sizegb, 0)
+}
+
+// set while eraseEnded runs, so overlapping runs don't unpin the same objects.
+var erasing int32
+
+func eraseEnded() error {
+	if inMaintenance() {
+		log.Info().Msg("in maintenance, not erasing")
+		return nil
+	}
+
+	if !atomic.CompareAndSwapInt32(&erasing, 0, 1) {
+		log.Info().Msg("erase already running, skipping")
+		return nil
+	}
+	defer atomic.StoreInt32(&erasing, 0)
+
+	// ended objects are only deleted once their pins are removed, so there's
+	// nothing to do while the node can't be reached.
+	if !ipfs.IsUp() {
+		log.Warn().Msg("ipfs node is unreachable, skipping erase")
+		return nil
+	}
+
+	var ended []struct {
+		CID    string  `db:"cid"`
+		SizeGB float64 `db:"sizegb"`
+	}
+	err := pg.Select(&ended, `
+SELECT cid, sizegb FROM objects WHERE pinned_at + lifespan < now()
+    `)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Int("n", len(ended)).Msg("erasing ended")
+	failed := 0
+	for _, o := range ended {
+		// one object failing mustn't keep the ones after it from being erased
+		erased, err := eraseObject(o.CID)
+		if err != nil {
+			log.Warn().Err(err).Str("cid", o.CID).Msg("failed to erase object")
+			failed++
+			continue
+		}
+		if erased {
+			recordEvent("erased", o.CID, "", o.SizeGB)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to erase %d of %d ended objects", failed, len(ended))
+	}
+	return nil
+}
+
+func emitReceipt(orderId string) {
+	receipt, err := fetchReceipt(orderId)
+	if err == nil {
+		err = postWebhook(s.ReceiptWebhookURL, receiptResponse(receipt))
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("order_id", orderId).Msg("failed to emit receipt")
+	}
+}
+
+// eraseObject unpins and deletes cid if it's still ended. the row is locked
+// throughout, so a renewal committed first makes it skip the object and one
+// committed later waits until the object is gone.
+func eraseObject(cid string) (erased bool, err error) {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var ended bool
+	err = tx.Get(&ended, `
+SELECT true FROM objects
+WHERE cid = $1 AND pinned_at + lifespan < now()
+FOR UPDATE
+    `, cid)
+	if err == sql.ErrNoRows {
+		log.Info().Str("cid", cid).Msg("object renewed, not erasing")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// an earlier erase may have unpinned it already and failed afterwards
+	err = unpin(cid)
+	if err != nil && !strings.Contains(err.Error(), "not pinned") {
+		return false, err
+	}
+
+	if s.VerifyUnpin {
+		err = verifyUnpinned(cid)
+		if err != nil {
+			log.Warn().Err(err).Str("cid", cid).
+				Msg("unpin not confirmed, keeping object")
+			return false, nil
+		}
+	}
+
+	_, err = tx.Exec(`
+WITH erased AS (
+  DELETE FROM objects WHERE cid = $1
+  RETURNING cid, sizegb, pinned_at, pinned_at + lifespan AS ends_at
+)
+INSERT INTO erased_objects (cid, sizegb, pinned_at, ends_at)
+SELECT cid, sizegb, pinned_at, ends_at FROM erased WHERE $2
+    `, cid, s.KeepTombstones)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func giveUp(orderId, reason string) error {
+	_, err := pg.Exec(`
+WITH g AS (
+  UPDATE payments
+  SET status = 'given_up', given_up_at = now(), given_up_reason = $2
+  WHERE order_id = $1 AND status IN ('trying', 'queued')
+  RETURNING order_id, cid
+)
+INSERT INTO events (kind, cid, order_id, detail)
+SELECT 'given_up', cid, order_id, $2 FROM g
+    `, orderId, reason)
+	return err
+}
+
+// DeadLetterFilter selects given up payments. empty fields match everything,
+// the time range is by when they were given up.
+type DeadLetterFilter struct {
+	Reason string
+	From   time.Time
+	To     time.Time
+}
+
+// requeueDeadLetters puts the given up payments matching filter back to be
+// processed with a fresh retry budget, e.g. after fixing what made them fail.
+func requeueDeadLetters(filter DeadLetterFilter) (n int, err error) {
+	err = pg.Get(&n, `
+WITH r AS (
+  UPDATE payments
+  SET status = 'trying', tries = 0, infra_tries = 0, queued_at = NULL, claimed_at = NULL,
+      given_up_at = NULL, given_up_reason = NULL
+  WHERE status = 'given_up'
+    AND ($1 = '' OR given_up_reason = $1)
+    AND ($2::timestamp IS NULL OR given_up_at >= $2)
+    AND ($3::timestamp IS NULL OR given_up_at < $3)
+  RETURNING order_id, cid
+), e AS (
+  INSERT INTO events (kind, cid, order_id)
+  SELECT 'requeued', cid, order_id FROM r
+)
+SELECT count(*) FROM r
+    `, filter.Reason,
+		pq.NullTime{Time: filter.From.UTC(), Valid: !filter.From.IsZero()},
+		pq.NullTime{Time: filter.To.UTC(), Valid: !filter.To.IsZero()})
+	return
+}
+
+type ReconcileReport struct {
+	MissingOnNode []string
+	UnknownOnNode []string
+}
+
+// reconcileBatch is how many of the node's pins are held in memory at once.
+const reconcileBatch = 1000
+
+// reconcile diffs the node's pins against the active objects. the pin list is
+// streamed into a temporary table in batches and diffed there, so big pinsets
+// aren't loaded into memory.
+func reconcile(ctx context.Context) (report ReconcileReport, err error) {
+	tx, err := pg.BeginTxx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+CREATE TEMPORARY TABLE node_pins (cid text PRIMARY KEY) ON COMMIT DROP
+    `)
+	if err != nil {
+		return
+	}
+
+	resp, err := ipfs.Request("pin/ls").
+		Option("type", "recursive").
+		Option("stream", true).
+		Send(ctx)
+	if err != nil {
+		return
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return report, resp.Error
+	}
+
+	batch := make([]string, 0, reconcileBatch)
+	flush := func() error {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO node_pins SELECT unnest($1::text[]) ON CONFLICT DO NOTHING
+        `, pq.Array(batch))
+		batch = batch[:0]
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Output)
+	for {
+		var pin struct{ Cid, Type string }
+		err = dec.Decode(&pin)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if pin.Type != shell.RecursivePin {
+			continue
+		}
+
+		batch = append(batch, pin.Cid)
+		if len(batch) == reconcileBatch {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return
+	}
+
+	err = tx.SelectContext(ctx, &report.MissingOnNode, `
+SELECT cid FROM objects AS o
+WHERE pinned_at + lifespan > now()
+  AND NOT EXISTS (SELECT 1 FROM node_pins AS n WHERE n.cid = o.cid)
+ORDER BY cid
+    `)
+	if err != nil {
+		return
+	}
+
+	err = tx.SelectContext(ctx, &report.UnknownOnNode, `
+SELECT cid FROM node_pins AS n
+WHERE NOT EXISTS (
+  SELECT 1 FROM objects AS o
+  WHERE o.cid = n.cid AND pinned_at + lifespan > now()
+)
+ORDER BY cid
+    `)
+	return
+}
+
+type IntegrityReport struct {
+	// cids whose object is gone while the payments of its last pin still have
+	// time left. requeueing processes those payments again.
+	Missing []string
+	// pinned payments without an object that can't be tied to a pin with time
+	// left, e.g. as their object was erased before erasures were recorded, or
+	// whose time is up. they're only reported.
+	Unresolved []string
+	// objects no pinned payment paid for
+	Unpaid []string
+}
+
+// livePin is the last pin of a cid whose object is missing, when nothing
+// recorded erasing it since.
+type livePin struct {
+	CID      string    `db:"cid"`
+	OrderId  string    `db:"order_id"`
+	SizeGB   float64   `db:"sizegb"`
+	PinnedAt time.Time `db:"pinned_at"`
+}
+
+// checkIntegrity looks for payments and objects that don't match each other.
+// with requeue, the payments of the last pin of an object found missing are
+// processed again, which pins their cid and recreates the object. they're
+// granted their lifespans again from then, so only those with time left are.
+func checkIntegrity(requeue bool) (report IntegrityReport, err error) {
+	var pins []livePin
+	err = pg.Select(&pins, `
+SELECT DISTINCT ON (e.cid) e.cid, e.order_id, e.sizegb, e.created_at AS pinned_at
+FROM events AS e
+WHERE e.kind = 'pinned'
+  AND EXISTS (SELECT 1 FROM payments AS p WHERE p.cid = e.cid AND p.status = 'pinned')
+  AND NOT EXISTS (SELECT 1 FROM objects AS o WHERE o.cid = e.cid)
+ORDER BY e.cid, e.created_at DESC
+    `)
+	if err != nil {
+		return
+	}
+
+	live := make([]string, 0)
+	for _, last := range pins {
+		orders, err := livePinOrders(last)
+		if err != nil {
+			return report, err
+		}
+		if len(orders) == 0 {
+			continue
+		}
+		live = append(live, orders...)
+		report.Missing = append(report.Missing, last.CID)
+	}
+
+	err = pg.Select(&report.Unresolved, `
+SELECT order_id FROM payments AS p
+WHERE status = 'pinned'
+  AND NOT order_id = any($1)
+  AND NOT EXISTS (SELECT 1 FROM objects AS o WHERE o.cid = p.cid)
+  AND NOT EXISTS (
+    SELECT 1 FROM events AS e
+    WHERE e.cid = p.cid AND e.kind = 'erased' AND e.created_at > p.paid_at
+  )
+  AND NOT EXISTS (
+    SELECT 1 FROM erased_objects AS t
+    WHERE t.cid = p.cid AND t.erased_at > p.paid_at
+  )
+ORDER BY paid_at
+    `, pq.Array(live))
+	if err != nil {
+		return
+	}
+
+	unpaid, err := fetchUnpaidObjects()
+	if err != nil {
+		return
+	}
+	for _, o := range unpaid {
+		report.Unpaid = append(report.Unpaid, o.CID)
+	}
+
+	if requeue && len(live) > 0 {
+		_, err = pg.Exec(`
+WITH r AS (
+  UPDATE payments
+  SET status = 'trying', tries = 0, infra_tries = 0, claimed_at = NULL,
+    pinning_since = NULL
+  WHERE order_id = any($1) AND status = 'pinned'
+  RETURNING order_id, cid
+)
+INSERT INTO events (kind, cid, order_id, detail)
+SELECT 'requeued', cid, order_id, 'object missing' FROM r
+        `, pq.Array(live))
+		if err != nil {
+			return
+		}
+		log.Info().Int("n", len(live)).Msg("requeued payments with missing objects")
+	}
+
+	return report, nil
+}
+
+// livePinOrders gives the orders of the last pin if it still has time left:
+// the one in its 'pinned' event and those with 'renewed' events after it,
+// priced as they were and counted from when it was pinned.
+func livePinOrders(last livePin) (orders []string, err error) {
+	var erased bool
+	err = pg.Get(&erased, `
+SELECT EXISTS (
+  SELECT 1 FROM events
+  WHERE cid = $1 AND kind = 'erased' AND created_at > $2
+) OR EXISTS (
+  SELECT 1 FROM erased_objects WHERE cid = $1 AND erased_at > $2
+)
+    `, last.CID, last.PinnedAt)
+	if err != nil || erased || !validSize(last.SizeGB) {
+		return nil, err
+	}
+
+	var payments []struct {
+		lifespanPayment
+		OrderId string `db:"order_id"`
+	}
+	err = pg.Select(&payments, `
+SELECT p.order_id, p.cid, p.amount, p.price_gb::text AS price_gb,
+  extract(epoch FROM p.clamped) AS clamped_secs
+FROM payments AS p
+WHERE p.cid = $1 AND p.status = 'pinned'
+  AND (p.order_id = $2 OR p.order_id IN (
+    SELECT order_id FROM events
+    WHERE cid = $1 AND kind = 'renewed' AND created_at > $3
+  ))
+-- the pin first, then its renewals
+ORDER BY p.order_id = $2 DESC, p.paid_at
+    `, last.CID, last.OrderId, last.PinnedAt)
+	if err != nil || len(payments) == 0 || payments[0].OrderId != last.OrderId {
+		return nil, err
+	}
+
+	paid := make([]lifespanPayment, len(payments))
+	for i, p := range payments {
+		paid[i] = p.lifespanPayment
+		orders = append(orders, p.OrderId)
+	}
+
+	lifespan, err := expectedLifespan(paid, last.SizeGB)
+	if err == errUnknownPrice {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !last.PinnedAt.Add(lifespan).After(time.Now()) {
+		// its time is up, it would have been erased by now
+		return nil, nil
+	}
+	return orders, nil
+}
+
+func repinMissing() error {
+	if inMaintenance() {
+		log.Info().Msg("in maintenance, not repinning")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ReconcileTimeout)
+	defer cancel()
+
+	report, err := reconcile(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, cid := range report.MissingOnNode {
+		logger := log.With().Str("cid", cid).Logger()
+		logger.Warn().Msg("object missing from node, repinning")
+
+		_, err = pin(context.Background(), cid, "")
+		if err != nil && backup != nil {
+			logger.Warn().Err(err).Msg("repin failed, restoring from backup")
+			err = restoreBackup(cid, "")
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to repin missing object")
+		}
+	}
+
+	return nil
+}
+
+// dedupeObjects merges objects stored under different forms of the same cid,
+// e.g. from before cids were normalized, into one under the canonical cid.
+// nothing is unpinned, the node pinned the same content whatever the form.
+func dedupeObjects() (int, error) {
+	var cids []string
+	err := pg.Select(&cids, `SELECT cid FROM objects`)
+	if err != nil {
+		return 0, err
+	}
+
+	groups := make(map[string][]string)
+	for _, cid := range cids {
+		canonical := toCID(cid)
+		groups[canonical] = append(groups[canonical], cid)
+	}
+
+	merged := 0
+	for canonical, dups := range groups {
+		if len(dups) == 1 && dups[0] == canonical {
+			continue
+		}
+
+		log.Info().Str("cid", canonical).Str("duplicates", strings.Join(dups, ",")).
+			Msg("merging duplicate objects")
+
+		err = mergeObjects(canonical, dups)
+		if err == errMergeConflict {
+			log.Warn().Str("cid", canonical).Msg("duplicates differ, not merging")
+			continue
+		}
+		if err != nil {
+			return merged, err
+		}
+		merged += len(dups) - 1
+	}
+
+	return merged, nil
+}
+
+var errMergeConflict = errors.New("duplicate objects have different paths or encryption")
+
+// mergeObjects replaces dups with a single canonical object. duplicates that
+// were pinned from different paths or encrypted with different schemes aren't
+// the same object to their payers, so those fail with errMergeConflict.
+func mergeObjects(canonical string, dups []string) error {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var distinct struct {
+		Paths   int `db:"paths"`
+		Schemes int `db:"schemes"`
+	}
+	err = tx.Get(&distinct, `
+SELECT
+  count(DISTINCT nullif(path, '')) AS paths,
+  count(DISTINCT nullif(encryption, '')) AS schemes
+FROM objects WHERE cid = any($1)
+    `, pq.Array(dups))
+	if err != nil {
+		return err
+	}
+	if distinct.Paths > 1 || distinct.Schemes > 1 {
+		return errMergeConflict
+	}
+
+	// the merged object ends after the sum of the remaining lifespans and
+	// keeps the notes of all of them.
+	_, err = tx.Exec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes, path, encryption)
+SELECT $2, max(sizegb), min(pinned_at),
+  now() + sum(greatest(pinned_at + lifespan - now(), interval '0')) - min(pinned_at),
+  (
+    SELECT coalesce(array_agg(DISTINCT note), '{}')
+    FROM objects, unnest(notes) AS note
+    WHERE cid = any($1)
+  ),
+  max(path), max(encryption)
+FROM objects WHERE cid = any($1)
+ON CONFLICT (cid) DO UPDATE SET
+  sizegb = excluded.sizegb,
+  pinned_at = excluded.pinned_at,
+  lifespan = excluded.lifespan,
+  notes = excluded.notes,
+  path = excluded.path,
+  encryption = excluded.encryption
+    `, pq.Array(dups), canonical)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+DELETE FROM objects WHERE cid = any($1) AND cid != $2
+    `, pq.Array(dups), canonical)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+UPDATE payments SET cid = $2 WHERE cid = any($1)
+    `, pq.Array(dups), canonical)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrateCID moves the remaining lifespan of oldCID to newCID, e.g. when the
+// content was re-uploaded with fixes. newCID is checked and pinned like any
+// other pin before anything changes in the database, and oldCID only unpinned
+// after it's committed.
+func migrateCID(oldCID, newCID string) error {
+	oldCID, newCID = toCID(oldCID), toCID(newCID)
+	if newCID == "" || newCID == oldCID {
+		return errInvalidCID
+	}
+
+	o, err := fetchObject(oldCID)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		return errObjectNotFound
+	}
+
+	existing, err := fetchObject(newCID)
+	if err != nil {
+		return err
+	}
+
+	sizegb, err := size(newCID)
+	if err != nil {
+		return err
+	}
+	err = checkMigrationSize(oldCID, newCID, o.SizeGB, sizegb)
+	if err != nil {
+		return err
+	}
+
+	if !admitPin(sizegb) {
+		return errCapacityFull
+	}
+	defer pinFinished(sizegb)
+
+	// the old object is counted until it's deleted, so only what the new one
+	// takes on top of it is reserved.
+	growth := 0.0
+	if existing == nil && sizegb > o.SizeGB {
+		growth = sizegb - o.SizeGB
+	}
+	err = reserveCapacity(growth)
+	if err != nil {
+		return err
+	}
+	defer releaseCapacity(growth)
+
+	// the old object's row, and with it the id of its remote pin, is gone
+	// once the lifespan is moved.
+	var oldRequestId string
+	if remotePinning() {
+		oldRequestId, err = remoteRequestId(oldCID)
+		if err != nil {
+			return err
+		}
+	}
+
+	measured, err := pin(context.Background(), newCID, "")
+	if err != nil {
+		return err
+	}
+	if validSize(measured) && measured != sizegb {
+		err = checkMigrationSize(oldCID, newCID, o.SizeGB, measured)
+		if err != nil {
+			if existing == nil {
+				unpin(newCID)
+			}
+			return err
+		}
+		sizegb = measured
+	}
+
+	err = moveLifespan(oldCID, newCID, sizegb)
+	if err != nil {
+		if existing == nil {
+			unpin(newCID)
+		}
+		return err
+	}
+
+	err = unpin(oldCID)
+	if err != nil {
+		log.Warn().Err(err).Str("cid", oldCID).Msg("failed to unpin migrated object")
+	}
+	if oldRequestId != "" {
+		err = removeRemotePin(oldRequestId)
+		if err != nil {
+			log.Warn().Err(err).Str("cid", oldCID).Msg("failed to remove remote pin")
+		}
+	}
+	if remotePinning() && existing == nil {
+		err = remotePin(newCID, "")
+		if err != nil {
+			log.Warn().Err(err).Str("cid", newCID).Msg("failed to pin on the remote service")
+		}
+	}
+
+	recordEvent("migrated", newCID, "", sizegb)
+	return nil
+}
+
+// checkMigrationSize applies the checks of a pin to newCID taking over from
+// oldCID, with the owners of oldCID's payments as the owners of newCID.
+func checkMigrationSize(oldCID, newCID string, oldSizeGB, sizegb float64) error {
+	if !validSize(sizegb) {
+		return &pinError{pinErrInvalid, fmt.Errorf("invalid object size: %v", sizegb)}
+	}
+	if sizegb > s.AbsoluteMaxSize {
+		return &pinError{pinErrTooLarge,
+			fmt.Errorf("object absolutely too big: %v > %v", sizegb, s.AbsoluteMaxSize)}
+	}
+
+	var owners []string
+	err := pg.Select(&owners, `
+SELECT DISTINCT owner FROM payments WHERE cid = $1 AND status = 'pinned' AND owner != ''
+    `, oldCID)
+	if err != nil {
+		return err
+	}
+	// the old object already counts towards the quotas and goes away
+	growth := sizegb - oldSizeGB
+	if growth <= 0 {
+		return nil
+	}
+	for _, owner := range owners {
+		err = checkOwnerQuota(owner, newCID, growth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveLifespan(oldCID, newCID string, sizegb float64) error {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes, path, encryption)
+SELECT $2, $3, now(), greatest(pinned_at + lifespan - now(), interval '0'),
+  notes, '', encryption
+FROM objects WHERE cid = $1
+ON CONFLICT (cid) DO UPDATE SET
+  lifespan = objects.lifespan + excluded.lifespan
+    `, oldCID, newCID, sizegb)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM objects WHERE cid = $1`, oldCID)
+	if err != nil {
+		return err
+	}
+
+	// the payments go along so the new object's history stays complete
+	_, err = tx.Exec(`
+UPDATE payments SET cid = $2 WHERE cid = $1
+    `, oldCID, newCID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type lifespanPayment struct {
+	CID     string         `db:"cid"`
+	Amount  int64          `db:"amount"`
+	PriceGB sql.NullString `db:"price_gb"`
+	Clamped float64        `db:"clamped_secs"`
+}
+
+// currentLifespanPayments are the payments of the objects pinned now, by cid
+// and in the order they were made. an empty cid gets those of every object.
+func currentLifespanPayments(cid string) (pp []lifespanPayment, err error) {
+	err = pg.Select(&pp, `
+SELECT p.cid, p.amount, p.price_gb::text AS price_gb,
+  extract(epoch FROM p.clamped) AS clamped_secs
+FROM payments AS p
+INNER JOIN objects AS o ON o.cid = p.cid
+WHERE ($1 = '' OR p.cid = $1) AND `+currentPayments+`
+ORDER BY p.cid, p.paid_at
+    `, cid)
+	return
+}
+
+// recomputeLifespan rewrites the lifespan of cid with the one its payments
+// bought, to repair it. lifespans are also changed on purpose, e.g. by
+// extendAll, shrinkLifespan or migrateCID, and those changes are lost.
+func recomputeLifespan(cid string) error {
+	o, err := fetchObject(cid)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		return errObjectNotFound
+	}
+	if !validSize(o.SizeGB) {
+		return fmt.Errorf("invalid object size: %v", o.SizeGB)
+	}
+
+	payments, err := currentLifespanPayments(cid)
+	if err != nil {
+		return err
+	}
+
+	lifespan, err := expectedLifespan(payments, o.SizeGB)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("cid", cid).Int("payments", len(payments)).
+		Dur("lifespan", lifespan).Dur("was", o.EndsAt.Sub(o.PinnedAt)).
+		Msg("recomputed lifespan")
+
+	_, err = pg.Exec(`
+UPDATE objects SET lifespan = make_interval(secs := $2) WHERE cid = $1
+    `, cid, lifespan.Seconds())
+	return err
+}
+
+var errUnknownPrice = errors.New("the price of a payment wasn't recorded")
+
+// expectedLifespan is the lifespan the given payments of one object, in the
+// order they were made, buy for sizegb. each is priced as it was charged: at
+// its recorded price, the first one as the pin and the others as renewals,
+// minus what was clamped off. payments from before prices were recorded fail
+// with errUnknownPrice.
+func expectedLifespan(payments []lifespanPayment, sizegb float64) (time.Duration, error) {
+	var lifespan time.Duration
+	for i, p := range payments {
+		if !p.PriceGB.Valid {
+			return 0, errUnknownPrice
+		}
+		priceGB, ok := new(big.Rat).SetString(p.PriceGB.String)
+		if !ok || priceGB.Sign() <= 0 {
+			return 0, fmt.Errorf("invalid recorded price %q", p.PriceGB.String)
+		}
+
+		duration, err := paymentDuration(p.Amount, sizegb, priceGB, i > 0)
+		if err != nil {
+			return 0, err
+		}
+
+		duration -= time.Duration(math.Round(p.Clamped)) * time.Second
+		if lifespan > math.MaxInt64-duration {
+			return 0, errImplausibleDuration
+		}
+		lifespan += duration
+	}
+	return lifespan, nil
+}
+
+// findInconsistentObjects lists the objects whose lifespan differs from what
+// their payments buy by more than tolerance, as a fraction of the latter.
+// lifespans changed on purpose, e.g. by extendAll, are listed too. objects
+// with payments from before prices were recorded can't be checked and aren't.
+func findInconsistentObjects(tolerance float64) ([]Object, error) {
+	var oo []Object
+	err := withNotesFallback(func() error {
+		return pg.Select(&oo, `
+SELECT `+objectColumns()+`
+FROM objects AS o
+ORDER BY cid
+    `)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payments, err := currentLifespanPayments("")
+	if err != nil {
+		return nil, err
+	}
+	byCID := make(map[string][]lifespanPayment)
+	for _, p := range payments {
+		byCID[p.CID] = append(byCID[p.CID], p)
+	}
+
+	inconsistent := make([]Object, 0)
+	for _, o := range oo {
+		if !validSize(o.SizeGB) {
+			inconsistent = append(inconsistent, o)
+			continue
+		}
+
+		expected, err := expectedLifespan(byCID[o.CID], o.SizeGB)
+		if err == errUnknownPrice {
+			continue
+		}
+		actual := o.EndsAt.Sub(o.PinnedAt)
+		if err != nil ||
+			math.Abs(actual.Seconds()-expected.Seconds()) > tolerance*expected.Seconds() {
+			inconsistent = append(inconsistent, o)
+		}
+	}
+	return inconsistent, nil
+}
+
+// previewRenewal tells when cid would end if it were renewed with amount now,
+// priced and checked as processing the renewal would. renewals extend the
+// current lifespan, so an object that has ended but wasn't erased yet is only
+// extended from when it ended.
+func previewRenewal(cid string, amount int) (time.Time, error) {
+	o, err := fetchObject(cid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if o == nil {
+		return time.Time{}, errObjectNotFound
+	}
+	if !validSize(o.SizeGB) {
+		return time.Time{}, fmt.Errorf("invalid object size: %v", o.SizeGB)
+	}
+
+	err = checkMinAmount(int64(amount), true)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	priceGB, err := satsPriceGB()
+	if err != nil {
+		return time.Time{}, err
+	}
+	priceGB, err = renewalPriceGB(cid, priceGB)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	duration, err := paymentDuration(int64(amount), o.SizeGB, priceGB, true)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return o.EndsAt.Add(clampDuration(duration)), nil
+}
+
+// estimateDuration tells how long amount would pin cid for if it were paid
+// now, as a renewal when cid is already pinned, priced and checked as
+// processing the payment would. cids that can't be found on the network fail
+// with an unresolvable *pinError.
+func estimateDuration(cid string, amount int) (time.Duration, error) {
+	priceGB, err := satsPriceGB()
+	if err != nil {
+		return 0, err
+	}
+
+	o, err := fetchObject(cid)
+	if err != nil {
+		return 0, err
+	}
+	if o != nil && validSize(o.SizeGB) {
+		err = checkMinAmount(int64(amount), true)
+		if err != nil {
+			return 0, err
+		}
+		priceGB, err = renewalPriceGB(cid, priceGB)
+		if err != nil {
+			return 0, err
+		}
+		duration, err := paymentDuration(int64(amount), o.SizeGB, priceGB, true)
+		return clampDuration(duration), err
+	}
+
+	err = checkMinAmount(int64(amount), false)
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkResolvable(cid, s.ResolveTimeout)
+	if err != nil {
+		return 0, err
+	}
+
+	sizegb, err := size(cid)
+	if err != nil {
+		return 0, err
+	}
+	if !validSize(sizegb) {
+		return 0, &pinError{pinErrInvalid, fmt.Errorf("invalid object size: %v", sizegb)}
+	}
+	if sizegb > affordableGB(int64(amount), priceGB) || sizegb > s.AbsoluteMaxSize {
+		return 0, &pinError{pinErrTooLarge,
+			fmt.Errorf("object too big for the payment: %v", sizegb)}
+	}
+
+	duration, err := paymentDuration(int64(amount), sizegb, priceGB, false)
+	return clampDuration(duration), err
+}
+
+func verifyObjects() error {
+	var cids []string
+	err := pg.Select(&cids, `
+SELECT cid FROM objects WHERE pinned_at + lifespan > now()
+    `)
+	if err != nil {
+		return err
+	}
+
+	for _, cid := range cids {
+		ok, err := verifyRetrievable(cid)
+		if err != nil {
+			// can't tell, the node is probably unreachable
+			return err
+		}
+
+		health := "healthy"
+		if !ok {
+			health = "dead"
+			log.Warn().Str("cid", cid).Msg("pinned object is not retrievable")
 		}
 
 		_, err = pg.Exec(`
-DELETE FROM objects WHERE cid = $1
-        `, cid)
+UPDATE objects SET health = $2, checked_at = now() WHERE cid = $1
+        `, cid, health)
 		if err != nil {
 			return err
 		}
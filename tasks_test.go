@@ -0,0 +1,1951 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPaymentDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s *Settings)
+		amount  int64
+		sizegb  float64
+		renewal bool
+		want    time.Duration
+		wantErr error
+	}{
+		{"a day", nil, 1000, 1, false, 24 * time.Hour, nil},
+		{"half the size lasts twice", nil, 1000, 0.5, false, 48 * time.Hour, nil},
+		{"truncated to seconds", nil, 1, 1, false, 86 * time.Second, nil},
+		{"zero amount", nil, 0, 1, false, 0, nil},
+		{"invalid size", nil, 1000, 0, false, 0, nil},
+		{"nan size", nil, 1000, math.NaN(), false, 0, nil},
+		{"renewal without discount", nil, 1000, 1, true, 24 * time.Hour, nil},
+		{"discounted renewal", func(s *Settings) { s.RenewalDiscount = 0.5 },
+			1000, 1, true, 48 * time.Hour, nil},
+		{"discount is only for renewals", func(s *Settings) { s.RenewalDiscount = 0.5 },
+			1000, 1, false, 24 * time.Hour, nil},
+		{"negative amount", nil, -1, 1, false, 0, errImplausibleDuration},
+		{"over max lifespan", func(s *Settings) { s.MaxLifespan = 24 * time.Hour },
+			2000, 1, false, 0, errImplausibleDuration},
+		{"at max lifespan", func(s *Settings) { s.MaxLifespan = 24 * time.Hour },
+			1000, 1, false, 24 * time.Hour, nil},
+		{"overflow", nil, math.MaxInt64, 1e-9, false, 0, errImplausibleDuration},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, tt.change)
+
+			got, err := paymentDuration(tt.amount, tt.sizegb, big.NewRat(1000, 1), tt.renewal)
+			if err != tt.wantErr {
+				t.Fatalf("paymentDuration() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("paymentDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentDurationFractionalPrice(t *testing.T) {
+	useSettings(t, nil)
+
+	// 1000 sats at 3/7 sats per GB-day, exactly 201600000 seconds
+	got, err := paymentDuration(1000, 1, big.NewRat(3, 7), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 201600000 * time.Second; got != want {
+		t.Fatalf("paymentDuration() = %v, want %v", got, want)
+	}
+}
+
+func TestPaymentDurationRenewalsDrift(t *testing.T) {
+	useSettings(t, nil)
+	priceGB := big.NewRat(1000, 1)
+
+	single, err := paymentDuration(1000, 1, priceGB, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var many time.Duration
+	for i := 0; i < 1000; i++ {
+		d, err := paymentDuration(1, 1, priceGB, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		many += d
+	}
+
+	// each payment loses what it bought past its last whole second
+	if drift := single - many; drift < 0 || drift >= 1000*time.Second {
+		t.Fatalf("1000 small payments = %v, one big one = %v", many, single)
+	}
+}
+
+func TestClampDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		duration time.Duration
+		want     time.Duration
+	}{
+		{"no bounds", 0, 0, time.Minute, time.Minute},
+		{"below min", time.Hour, 0, time.Minute, time.Hour},
+		{"above max", 0, time.Hour, 2 * time.Hour, time.Hour},
+		{"within", time.Minute, time.Hour, 30 * time.Minute, 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, func(s *Settings) {
+				s.MinDuration = tt.min
+				s.MaxDuration = tt.max
+			})
+
+			if got := clampDuration(tt.duration); got != tt.want {
+				t.Fatalf("clampDuration(%v) = %v, want %v", tt.duration, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckMinAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		renewal bool
+		wantMin int64
+	}{
+		{"first pin at minimum", 100, false, 0},
+		{"first pin below minimum", 50, false, 100},
+		{"renewal below first-pin minimum", 50, true, 0},
+		{"renewal below renewal minimum", 5, true, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, func(s *Settings) {
+				s.MinAmount = 100
+				s.MinRenewalAmount = 10
+			})
+
+			err := checkMinAmount(tt.amount, tt.renewal)
+			if tt.wantMin == 0 {
+				if err != nil {
+					t.Fatalf("checkMinAmount() = %v, want nil", err)
+				}
+				return
+			}
+
+			low, ok := err.(*amountTooLowError)
+			if !ok {
+				t.Fatalf("checkMinAmount() = %v, want an *amountTooLowError", err)
+			}
+			if low.Min != tt.wantMin || low.Renewal != tt.renewal {
+				t.Fatalf("checkMinAmount() = %+v, want min %d", low, tt.wantMin)
+			}
+			if isRetryable(err) || errorStatus(err) != 400 {
+				t.Fatalf("amounts too low must be given up and rejected")
+			}
+		})
+	}
+}
+
+func TestExpectedLifespan(t *testing.T) {
+	price := func(p string) sql.NullString { return sql.NullString{String: p, Valid: true} }
+
+	tests := []struct {
+		name     string
+		payments []lifespanPayment
+		want     time.Duration
+		wantErr  error
+	}{
+		{"none", nil, 0, nil},
+		{"each at its own price", []lifespanPayment{
+			{Amount: 1000, PriceGB: price("1000")},
+			{Amount: 1000, PriceGB: price("500")},
+		}, 120 * time.Hour, nil},
+		{"later payments are discounted renewals", []lifespanPayment{
+			{Amount: 1000, PriceGB: price("1000")},
+			{Amount: 500, PriceGB: price("1000")},
+		}, 48 * time.Hour, nil},
+		{"clamped time isn't counted", []lifespanPayment{
+			{Amount: 1000, PriceGB: price("1000"), Clamped: 3600},
+		}, 23 * time.Hour, nil},
+		{"fractional recorded price", []lifespanPayment{
+			{Amount: 1, PriceGB: price("0.5")},
+		}, 48 * time.Hour, nil},
+		{"price not recorded", []lifespanPayment{
+			{Amount: 1000, PriceGB: price("1000")},
+			{Amount: 1000},
+		}, 0, errUnknownPrice},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, func(s *Settings) { s.RenewalDiscount = 0.5 })
+
+			got, err := expectedLifespan(tt.payments, 1)
+			if err != tt.wantErr {
+				t.Fatalf("expectedLifespan() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("expectedLifespan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectedLifespanInvalidPrice(t *testing.T) {
+	useSettings(t, nil)
+
+	for _, p := range []string{"", "abc", "0", "-5"} {
+		payments := []lifespanPayment{{Amount: 1000, PriceGB: sql.NullString{String: p, Valid: true}}}
+		_, err := expectedLifespan(payments, 1)
+		if err == nil || err == errUnknownPrice {
+			t.Errorf("expectedLifespan() with price %q = %v, want an invalid price error", p, err)
+		}
+	}
+}
+
+func TestValidSize(t *testing.T) {
+	for _, sizegb := range []float64{0, -1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if validSize(sizegb) {
+			t.Errorf("validSize(%v) = true", sizegb)
+		}
+	}
+	for _, sizegb := range []float64{1e-9, 0.5, 1, 1000} {
+		if !validSize(sizegb) {
+			t.Errorf("validSize(%v) = false", sizegb)
+		}
+	}
+}
+
+func TestAffordableGB(t *testing.T) {
+	if got := affordableGB(500, big.NewRat(1000, 1)); got != 0.5 {
+		t.Fatalf("affordableGB() = %v, want 0.5", got)
+	}
+}
+
+func TestSaveObjectOnce(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	tests := []struct {
+		name         string
+		orderId, cid string
+		again        bool // saving the payment of the previous step again
+		cancelled    bool
+		wantSaved    bool
+		wantInserted bool
+		wantLifespan time.Duration
+	}{
+		{"first pin", "order1", "QmA", false, false, true, true, 24 * time.Hour},
+		{"first pin again", "order1", "QmA", true, false, false, false, 24 * time.Hour},
+		{"renewal", "order2", "QmA", false, false, true, false, 48 * time.Hour},
+		{"renewal again", "order2", "QmA", true, false, false, false, 48 * time.Hour},
+		{"cancelled", "order3", "QmB", false, true, false, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.again {
+				err := savePayment(tt.orderId, 1000, orderDescription{CID: tt.cid})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.cancelled {
+				err := cancelPayment(tt.orderId)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var pricedAsRenewal bool
+			saved, inserted, err := saveObject(tt.orderId, tt.cid, "", "", 1, "",
+				func(renewal bool) (*big.Rat, time.Duration, time.Duration, error) {
+					pricedAsRenewal = renewal
+					return big.NewRat(1000, 1), 24 * time.Hour, 0, nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// whatever isn't inserted goes into an existing object
+			if !tt.cancelled && pricedAsRenewal == tt.wantInserted {
+				t.Fatalf("priced as a renewal = %v", pricedAsRenewal)
+			}
+			if saved != tt.wantSaved || inserted != tt.wantInserted {
+				t.Fatalf("saveObject() = %v, %v, want %v, %v",
+					saved, inserted, tt.wantSaved, tt.wantInserted)
+			}
+
+			var secs float64
+			err = pg.Get(&secs, `
+SELECT coalesce(sum(extract(epoch FROM lifespan)), 0) FROM objects WHERE cid = $1
+            `, tt.cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Duration(secs) * time.Second; got != tt.wantLifespan {
+				t.Fatalf("lifespan = %v, want %v", got, tt.wantLifespan)
+			}
+		})
+	}
+}
+
+func TestClaimPayments(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	for _, orderId := range []string{"order1", "order2", "order3"} {
+		err := savePayment(orderId, 1000, orderDescription{CID: "Qm" + orderId})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another pass holds order1 while claiming
+	tx, err := pg.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`SELECT 1 FROM payments WHERE order_id = 'order1' FOR UPDATE`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		orderId string
+		before  func()
+		want    []string
+	}{
+		{"one order", "order2", nil, []string{"order2"}},
+		{"skips locked and claimed", "", nil, []string{"order3"}},
+		{"unlocked", "", func() { tx.Rollback() }, []string{"order1"}},
+		{"claims don't expire early", "", nil, []string{}},
+		{"expired claims are taken over", "", func() {
+			pg.MustExec(`UPDATE payments SET claimed_at = now() - interval '1 day'
+                         WHERE order_id = 'order2'`)
+		}, []string{"order2"}},
+		{"released claims", "", func() {
+			err := releaseClaims()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"order1", "order2", "order3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+
+			payments, err := claimPayments(tt.orderId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(payments))
+			for i, p := range payments {
+				got[i] = p.OrderId
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("claimPayments(%q) = %v, want %v", tt.orderId, got, tt.want)
+			}
+		})
+	}
+
+	// taking over order2's claim and every restart count as interrupted tries
+	var tries []int
+	err = pg.Select(&tries, `SELECT infra_tries FROM payments ORDER BY order_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tries) != 3 || tries[0] != 1 || tries[1] != 2 || tries[2] != 1 {
+		t.Fatalf("infra_tries = %v, want [1 2 1]", tries)
+	}
+}
+
+func TestRecomputeLifespan(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.RenewalDiscount = 0.5 })
+	useTestDB(t)
+
+	// a tampered lifespan is corrected from two payments
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, price_gb, paid_at) VALUES
+  ('order1', 'QmA', 1000, 'pinned', 1000, now() - interval '2 hours'),
+  ('order2', 'QmA', 500, 'pinned', 1000, now() - interval '1 hour');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now() - interval '2 hours', interval '1 hour');
+    `)
+
+	err := recomputeLifespan("QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var secs float64
+	err = pg.Get(&secs, `SELECT extract(epoch FROM lifespan) FROM objects WHERE cid = 'QmA'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(secs) * time.Second; got != 48*time.Hour {
+		t.Fatalf("lifespan = %v, want 48h", got)
+	}
+
+	if err := recomputeLifespan("QmB"); err != errObjectNotFound {
+		t.Fatalf("recomputeLifespan() of a missing object = %v, want %v", err, errObjectNotFound)
+	}
+}
+
+func TestRenewalPricing(t *testing.T) {
+	// both modes with a price change in between the pin and the renewal
+	tests := []struct {
+		mode      string
+		wantPrice string
+		wantAdded time.Duration
+	}{
+		{"current", "2000.00000000", 12 * time.Hour},
+		{"original", "1000.00000000", 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useSettings(t, func(s *Settings) { s.RenewalPricing = tt.mode })
+			useTestDB(t)
+
+			pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, price_gb, paid_at)
+VALUES ('order1', 'QmA', 1000, 'pinned', 1000, now() - interval '2 hours');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 1, now() - interval '1 hour', interval '24 hours');
+            `)
+			s.PriceGB = 2000
+
+			err := savePayment("order2", 1000, orderDescription{CID: "QmA"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = processPayment("order2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var res struct {
+				Price    string  `db:"price_gb"`
+				Status   string  `db:"status"`
+				Lifespan float64 `db:"lifespan"`
+			}
+			err = pg.Get(&res, `
+SELECT p.price_gb::text AS price_gb, p.status::text AS status,
+  extract(epoch FROM o.lifespan) AS lifespan
+FROM payments AS p, objects AS o
+WHERE p.order_id = 'order2' AND o.cid = 'QmA'
+            `)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != "pinned" {
+				t.Fatalf("status = %s, want pinned", res.Status)
+			}
+			if res.Price != tt.wantPrice {
+				t.Fatalf("recorded price = %s, want %s", res.Price, tt.wantPrice)
+			}
+			added := time.Duration(res.Lifespan)*time.Second - 24*time.Hour
+			if added != tt.wantAdded {
+				t.Fatalf("renewal added %v, want %v", added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestQueuedUntilErased(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxTotalGB = 1 })
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	// the node is full with an object that has ended but wasn't erased yet
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmOld', 1, now() - interval '2 days', interval '1 day')
+    `)
+	node.sizes["QmOld"] = 1 << 30
+	node.pins["QmOld"] = ""
+	node.sizes["QmNew"] = 1 << 29
+
+	err := savePayment("order1", 1000, orderDescription{CID: "QmNew"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		t.Helper()
+		var status string
+		err := pg.Get(&status, `SELECT status FROM payments WHERE order_id = 'order1'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != "queued" {
+		t.Fatalf("status = %s with the node full, want queued", got)
+	}
+	if node.pinned("QmNew") {
+		t.Fatal("pinned without capacity")
+	}
+
+	err = eraseEnded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.pinned("QmOld") {
+		t.Fatal("ended object still pinned after erasing")
+	}
+
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != "pinned" {
+		t.Fatalf("status = %s after the erase freed space, want pinned", got)
+	}
+	if !node.pinned("QmNew") {
+		t.Fatal("queued payment wasn't pinned")
+	}
+}
+
+func TestProcessPayment(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.sizes["QmA"] = 1 << 30
+	node.sizes["QmB"] = 1 << 30
+	node.sizes["QmBroken"] = 1 << 30
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "pin/add" && call.Arg == "QmBroken" {
+			w.WriteHeader(500)
+			w.Write([]byte(`{"Message": "datastore closed"}`))
+			return true
+		}
+		return false
+	}
+	for _, cid := range []string{"QmA", "QmB", "QmBroken"} {
+		err := savePayment("order-"+cid, 1000, orderDescription{CID: cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type state struct {
+		Status  string `db:"status"`
+		Tries   int    `db:"tries"`
+		Claimed bool   `db:"claimed"`
+	}
+	payment := func(orderId string) (st state) {
+		t.Helper()
+		err := pg.Get(&st, `
+SELECT status, tries + infra_tries AS tries, claimed_at IS NOT NULL AS claimed
+FROM payments WHERE order_id = $1
+        `, orderId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// only the given order is processed
+	err := processPayment("order-QmA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := payment("order-QmA"); st.Status != "pinned" || st.Claimed {
+		t.Fatalf("order-QmA = %+v, want pinned", st)
+	}
+	if st := payment("order-QmB"); st.Status != "trying" || st.Tries != 0 {
+		t.Fatalf("order-QmB = %+v, want untouched", st)
+	}
+	if pins := node.called("pin/add"); strings.Join(pins, ",") != "QmA" {
+		t.Fatalf("pinned %v, want only QmA", pins)
+	}
+
+	// a failure counts a try and leaves it for the next pass
+	err = processPayment("order-QmBroken")
+	if err == nil {
+		t.Fatal("processPayment() = nil with the pin failing")
+	}
+	if st := payment("order-QmBroken"); st.Status != "trying" || st.Tries != 1 || st.Claimed {
+		t.Fatalf("order-QmBroken = %+v, want trying again after a try", st)
+	}
+
+	// nothing left to do for these
+	for _, orderId := range []string{"order-QmA", "order-unknown"} {
+		err = processPayment(orderId)
+		if err == nil {
+			t.Errorf("processPayment(%s) = nil, want an error", orderId)
+		}
+	}
+}
+
+func TestQueuedPaymentsRunOutOfTries(t *testing.T) {
+	useSettings(t, func(s *Settings) {
+		s.MaxQueueWait = 0
+		s.MaxPinTries = 2
+	})
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, queued_at, tries)
+VALUES ('order1', 'QmA', 1000, 'queued', now() - interval '1 year', 2)
+    `)
+
+	payments, err := claimPayments("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 0 {
+		t.Fatalf("claimed %d payments over the tries budget", len(payments))
+	}
+
+	err = giveUpExhausted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reason string
+	err = pg.Get(&reason, `
+SELECT coalesce(given_up_reason, '') FROM payments WHERE order_id = 'order1' AND status = 'given_up'
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "exhausted" {
+		t.Fatalf("given up for %q, want exhausted", reason)
+	}
+}
+
+func TestGiveUpAtTriesCap(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.MaxPinTries = 6 })
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.sizes["QmCap"] = 1 << 30
+	node.sizes["QmLast"] = 1 << 30
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, tries) VALUES
+  ('at-cap', 'QmCap', 1000, 'trying', 6),
+  -- one try left
+  ('last-try', 'QmLast', 1000, 'trying', 5);
+    `)
+
+	err := processPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []struct {
+		OrderId string `db:"order_id"`
+		Status  string `db:"status"`
+		Tries   int    `db:"tries"`
+		Reason  string `db:"reason"`
+	}
+	err = pg.Select(&rows, `
+SELECT order_id, status, tries, coalesce(given_up_reason, '') AS reason
+FROM payments ORDER BY order_id
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(rows))
+	for i, r := range rows {
+		got[i] = fmt.Sprintf("%s %s %d %s", r.OrderId, r.Status, r.Tries, r.Reason)
+	}
+	// given up as it was, without another try counted
+	want := "at-cap given_up 6 exhausted,last-try pinned 5 "
+	if strings.Join(got, ",") != want {
+		t.Fatalf("payments = %q, want %q", got, want)
+	}
+	if pins := node.called("pin/add"); strings.Join(pins, ",") != "QmLast" {
+		t.Fatalf("pinned %v, want only QmLast", pins)
+	}
+}
+
+// streamPins makes node stream n generated recursive pins, QmPin0 and on,
+// without holding them anywhere. a negative n streams until the request ends.
+func streamPins(node *fakeNode, n int) {
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd != "pin/ls" {
+			return false
+		}
+		enc := json.NewEncoder(w)
+		for i := 0; n < 0 || i < n; i++ {
+			if r.Context().Err() != nil {
+				return true
+			}
+			enc.Encode(struct{ Cid, Type string }{fmt.Sprintf("QmPin%d", i), "recursive"})
+		}
+		return true
+	}
+}
+
+func TestReconcileLargePinset(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+SELECT 'QmPin' || i, 0.001, now(), interval '1 day' FROM generate_series(0, 49999, 2) AS i;
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmLost', 1, now(), interval '1 day');
+    `)
+	streamPins(node, 50000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	report, err := reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.MissingOnNode, ",") != "QmLost" {
+		t.Fatalf("missing on node = %v, want QmLost", report.MissingOnNode)
+	}
+	// the odd ones
+	if len(report.UnknownOnNode) != 25000 {
+		t.Fatalf("%d unknown to the database, want 25000", len(report.UnknownOnNode))
+	}
+}
+
+func TestReconcileDeadline(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	// a pinset too big to get through
+	streamPins(node, -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := reconcile(ctx)
+	if err == nil {
+		t.Fatal("reconcile() = nil going past its deadline")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("reconcile() took %s with a 500ms deadline", took)
+	}
+}
+
+func TestRequeueDeadLetters(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	day := 24 * time.Hour
+	tests := []struct {
+		name   string
+		filter DeadLetterFilter
+		want   string
+	}{
+		{"everything", DeadLetterFilter{}, "old-unreachable,recent-exhausted,recent-unreachable"},
+		{"by class", DeadLetterFilter{Reason: "unreachable"}, "old-unreachable,recent-unreachable"},
+		{"since", DeadLetterFilter{From: now.Add(-2 * day)}, "recent-exhausted,recent-unreachable"},
+		{"before", DeadLetterFilter{To: now.Add(-2 * day)}, "old-unreachable"},
+		{"class and range", DeadLetterFilter{Reason: "unreachable", From: now.Add(-2 * day), To: now},
+			"recent-unreachable"},
+		// the same instant written elsewhere
+		{"range in another zone", DeadLetterFilter{From: now.Add(-2 * day).In(time.FixedZone("", -8*3600))},
+			"recent-exhausted,recent-unreachable"},
+		{"nothing matching", DeadLetterFilter{Reason: "too_large"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, nil)
+			useTestDB(t)
+
+			pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, tries, given_up_at, given_up_reason) VALUES
+  ('old-unreachable', 'QmA', 1000, 'given_up', 3, $1::timestamp - interval '5 days', 'unreachable'),
+  ('recent-unreachable', 'QmB', 1000, 'given_up', 3, $1::timestamp - interval '1 day', 'unreachable'),
+  ('recent-exhausted', 'QmC', 1000, 'given_up', 20, $1::timestamp - interval '1 hour', 'exhausted');
+INSERT INTO payments (order_id, cid, amount, status, tries)
+VALUES ('pending', 'QmD', 1000, 'trying', 3);
+            `, now)
+
+			n, err := requeueDeadLetters(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var requeued []string
+			err = pg.Select(&requeued, `
+SELECT order_id FROM payments
+WHERE status = 'trying' AND tries = 0 AND given_up_reason IS NULL
+ORDER BY order_id
+            `)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(requeued, ","); got != tt.want || n != len(requeued) {
+				t.Fatalf("requeueDeadLetters() = %d, requeued %q, want %q", n, got, tt.want)
+			}
+
+			var events int
+			err = pg.Get(&events, `SELECT count(*) FROM events WHERE kind = 'requeued'`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if events != n {
+				t.Fatalf("%d requeued events for %d payments", events, n)
+			}
+		})
+	}
+}
+
+func TestRenewalRacingErase(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	// both just ended, and both renewed while the erase runs
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status) VALUES
+  ('first-QmA', 'QmA', 1000, 'pinned'),
+  ('first-QmB', 'QmB', 1000, 'pinned');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 1, now() - interval '1 day 1 minute', interval '1 day'),
+  ('QmB', 1, now() - interval '1 day 1 minute', interval '1 day');
+    `)
+	for _, cid := range []string{"QmA", "QmB"} {
+		node.sizes[cid] = 1 << 30
+		node.pins[cid] = ""
+	}
+
+	// the erase of whichever comes first holds on unpinning it
+	unpinning := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "pin/rm" {
+			once.Do(func() {
+				close(unpinning)
+				<-release
+			})
+		}
+		return false
+	}
+
+	erased := make(chan error, 1)
+	go func() { erased <- eraseEnded() }()
+	select {
+	case <-unpinning:
+	case <-time.After(5 * time.Second):
+		t.Fatal("erase never unpinned")
+	}
+
+	var wg sync.WaitGroup
+	for _, cid := range []string{"QmA", "QmB"} {
+		err := savePayment("renewal-"+cid, 1000, orderDescription{CID: cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(orderId string) {
+			defer wg.Done()
+			err := processPayment(orderId)
+			if err != nil {
+				t.Error(err)
+			}
+		}("renewal-" + cid)
+	}
+	// the renewal of the object being erased waits for the erase
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	err := <-erased
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// either the renewal won, or it came after the erase and pinned again
+	for _, cid := range []string{"QmA", "QmB"} {
+		o, err := fetchObject(cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o == nil || !o.EndsAt.After(time.Now().Add(23*time.Hour)) {
+			t.Errorf("%s = %+v, want it renewed for a day", cid, o)
+		}
+		if !node.pinned(cid) {
+			t.Errorf("%s unpinned despite its renewal", cid)
+		}
+	}
+	var status []string
+	err = pg.Select(&status, `SELECT status FROM payments WHERE order_id LIKE 'renewal-%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(status, ",") != "pinned,pinned" {
+		t.Fatalf("renewals = %v, want both pinned", status)
+	}
+}
+
+func TestEraseEndedKeepsGoing(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.VerifyUnpin = true })
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmUnpinned', 1, now() - interval '2 days', interval '1 day'),
+  ('QmBroken', 1, now() - interval '2 days', interval '1 day'),
+  ('QmPinned', 1, now() - interval '2 days', interval '1 day')
+    `)
+	// QmUnpinned was unpinned by an erase that failed before deleting it
+	node.pins["QmBroken"] = ""
+	node.pins["QmPinned"] = ""
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "pin/rm" && call.Arg == "QmBroken" {
+			w.WriteHeader(500)
+			w.Write([]byte(`{"Message": "datastore closed"}`))
+			return true
+		}
+		return false
+	}
+
+	err := eraseEnded()
+	if err == nil {
+		t.Fatal("eraseEnded() = nil with an object failing to unpin")
+	}
+
+	var left []string
+	err = pg.Select(&left, `SELECT cid FROM objects ORDER BY cid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(left, ",") != "QmBroken" {
+		t.Fatalf("objects left = %v, want only QmBroken", left)
+	}
+	if node.pinned("QmPinned") {
+		t.Fatal("QmPinned still pinned")
+	}
+}
+
+func TestEraseEndedNodeUnreachable(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmA', 1, now() - interval '2 days', interval '1 day'),
+  ('QmB', 1, now() - interval '2 days', interval '1 day')
+    `)
+	node.pins["QmA"] = ""
+	node.pins["QmB"] = ""
+	// the node is down behind its gateway
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		w.WriteHeader(502)
+		return true
+	}
+
+	err := eraseEnded()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	err = pg.Get(&n, `SELECT count(*) FROM objects`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("%d objects left, want both", n)
+	}
+	if rm := node.called("pin/rm"); len(rm) != 0 {
+		t.Fatalf("unpinned %v with the node down", rm)
+	}
+}
+
+func TestEraseEndedOnce(t *testing.T) {
+	useSettings(t, nil)
+	node := useFakeNode(t)
+
+	// the first run holds on its node check until released
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "id" {
+			once.Do(func() {
+				close(entered)
+				<-release
+			})
+			// down, so the runs stop before the database
+			w.WriteHeader(502)
+		}
+		return true
+	}
+
+	first := make(chan error, 1)
+	go func() { first <- eraseEnded() }()
+	<-entered
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := eraseEnded()
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(node.called("id")); n != 1 {
+		t.Fatalf("%d runs got past the guard, want 1", n)
+	}
+
+	close(release)
+	err := <-first
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the guard is released with the run
+	err = eraseEnded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(node.called("id")); n != 2 {
+		t.Fatalf("a run after the first didn't proceed, %d runs", n)
+	}
+}
+
+func TestMigrateCID(t *testing.T) {
+	// a remote pinning service that only takes in and removes pins
+	var remote struct {
+		sync.Mutex
+		calls []string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote.Lock()
+		remote.calls = append(remote.calls, r.Method+" "+r.URL.Path)
+		remote.Unlock()
+		if r.Method == "POST" {
+			w.Write([]byte(`{"requestid": "new-request"}`))
+		}
+	}))
+	defer srv.Close()
+
+	useSettings(t, func(s *Settings) {
+		s.RemotePinningURL = srv.URL
+		s.RemotePinningToken = "token"
+	})
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status) VALUES ('order1', 'QmOld', 1000, 'pinned');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, remote_request_id)
+VALUES ('QmOld', 0.5, now() - interval '1 day', interval '3 days', 'old-request')
+    `)
+	node.sizes["QmOld"] = 1 << 29
+	node.pins["QmOld"] = ""
+	node.sizes["QmNew"] = 1 << 29
+	node.sizes["QmHuge"] = 11 << 30
+
+	old, err := fetchObject("QmOld")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// over AbsoluteMaxSize, it's refused before pinning
+	err = migrateCID("QmOld", "QmHuge")
+	if perr, ok := err.(*pinError); !ok || perr.Class != pinErrTooLarge {
+		t.Fatalf("migrateCID() to a huge cid = %v, want too large", err)
+	}
+	if node.pinned("QmHuge") {
+		t.Fatal("huge cid pinned")
+	}
+
+	// lifespan preserved and old CID unpinned
+	err = migrateCID("QmOld", "QmNew")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := fetchObject("QmNew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil {
+		t.Fatal("no object for the new cid")
+	}
+	if d := o.EndsAt.Sub(old.EndsAt); d < -time.Minute || d > time.Minute {
+		t.Fatalf("new object ends at %v, the old one at %v", o.EndsAt, old.EndsAt)
+	}
+	if gone, err := fetchObject("QmOld"); err != nil || gone != nil {
+		t.Fatalf("old object still there: %v, %v", gone, err)
+	}
+	if node.pinned("QmOld") || !node.pinned("QmNew") {
+		t.Fatalf("node pins = %v, want only QmNew", node.pins)
+	}
+
+	var cid string
+	err = pg.Get(&cid, `SELECT cid FROM payments WHERE order_id = 'order1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != "QmNew" {
+		t.Fatalf("payment moved to %s, want QmNew", cid)
+	}
+
+	remote.Lock()
+	calls := strings.Join(remote.calls, ", ")
+	remote.Unlock()
+	if calls != "DELETE /pins/old-request, POST /pins" {
+		t.Fatalf("remote calls = %s", calls)
+	}
+	requestId, err := remoteRequestId("QmNew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestId != "new-request" {
+		t.Fatalf("new object's remote request id = %q", requestId)
+	}
+}
+
+func TestSameCIDFirstPins(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.RenewalDiscount = 0.5 })
+	useTestDB(t)
+	node := useFakeNode(t)
+	backups := useMemBackup(t)
+
+	node.sizes["QmA"] = 1 << 30
+	// slow enough for both payments to be pinning at once
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "pin/add" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+
+	for _, orderId := range []string{"order1", "order2"} {
+		err := savePayment(orderId, 1000, orderDescription{CID: "QmA"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// two same-CID payments → single pin call
+	err := processPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := node.called("pin/add"); len(calls) != 1 {
+		t.Fatalf("pin/add called %d times, want once", len(calls))
+	}
+
+	var kinds []string
+	err = pg.Select(&kinds, `SELECT kind FROM events WHERE cid = 'QmA' ORDER BY kind`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(kinds, ",") != "pinned,renewed" {
+		t.Fatalf("events = %v, want a pin and a renewal", kinds)
+	}
+	if backups.puts != 1 {
+		t.Fatalf("backed up %d times, want once", backups.puts)
+	}
+
+	// the second one is priced as a renewal
+	var secs float64
+	err = pg.Get(&secs, `SELECT extract(epoch FROM lifespan) FROM objects WHERE cid = 'QmA'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(secs) * time.Second; got != 72*time.Hour {
+		t.Fatalf("lifespan = %v, want 72h", got)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, price_gb, paid_at, tries) VALUES
+  ('order1', 'QmA', 1000, 'pinned', 1000, $1::timestamp - interval '2 hours', 1),
+  ('order2', 'QmB', 1000, 'pinned', 1000, $1::timestamp - interval '2 hours', 0),
+  ('order3', 'QmC', 1000, 'pinned', 1000, $1::timestamp - interval '3 days', 0),
+  ('order5', 'QmE', 1000, 'pinned', 1000, $1::timestamp - interval '2 hours', 0),
+  ('order6', 'QmF', 1000, 'pinned', 1000, $1::timestamp - interval '2 hours', 0);
+INSERT INTO events (kind, cid, order_id, sizegb, created_at) VALUES
+  ('pinned', 'QmA', 'order1', 1, $1::timestamp - interval '2 hours'),
+  ('pinned', 'QmC', 'order3', 1, $1::timestamp - interval '3 days'),
+  ('pinned', 'QmE', 'order5', 1, $1::timestamp - interval '2 hours'),
+  ('erased', 'QmE', '', 1, $1::timestamp - interval '1 hour');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmD', 1, $1::timestamp, interval '1 day'),
+  ('QmF', 1, $1::timestamp - interval '2 hours', interval '1 day');
+    `, now)
+
+	status := func(order string) string {
+		t.Helper()
+		var status string
+		err := pg.Get(&status, `SELECT status FROM payments WHERE order_id = $1`, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	tests := []struct {
+		name string
+		got  func(r IntegrityReport) []string
+		want []string
+	}{
+		// its object is gone while the pin has time left
+		{"missing", func(r IntegrityReport) []string { return r.Missing }, []string{"QmA"}},
+		// nothing ties QmB to a pin, QmC's time is up, QmE was erased
+		{"unresolved", func(r IntegrityReport) []string { return r.Unresolved }, []string{"order3", "order2"}},
+		{"unpaid", func(r IntegrityReport) []string { return r.Unpaid }, []string{"QmD"}},
+	}
+
+	report, err := checkIntegrity(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tt.got(report), ","); got != strings.Join(tt.want, ",") {
+			t.Errorf("%s = %q, want %q", tt.name, got, strings.Join(tt.want, ","))
+		}
+	}
+	if got := status("order1"); got != "pinned" {
+		t.Fatalf("status after checking = %s, want pinned", got)
+	}
+
+	report, err = checkIntegrity(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(report.Missing, ","); got != "QmA" {
+		t.Fatalf("missing = %q, want QmA", got)
+	}
+
+	// only the payment of the missing object is processed again, from scratch
+	var requeued struct {
+		Status   string `db:"status"`
+		Tries    int    `db:"tries"`
+		Claimed  bool   `db:"claimed"`
+		Requeued int    `db:"requeued"`
+	}
+	err = pg.Get(&requeued, `
+SELECT status, tries, claimed_at IS NOT NULL AS claimed,
+  (SELECT count(*) FROM events WHERE kind = 'requeued' AND order_id = 'order1') AS requeued
+FROM payments WHERE order_id = 'order1'
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued.Status != "trying" || requeued.Tries != 0 || requeued.Claimed || requeued.Requeued != 1 {
+		t.Fatalf("requeued payment = %+v", requeued)
+	}
+	for _, order := range []string{"order2", "order3", "order5", "order6"} {
+		if got := status(order); got != "pinned" {
+			t.Errorf("%s status = %s, want pinned", order, got)
+		}
+	}
+}
+
+func TestInterruptedPinResumed(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+	useMemBackup(t)
+
+	node.sizes["QmA"] = 1 << 30
+	node.sizes["QmB"] = 1 << 30
+	for _, d := range []orderDescription{{CID: "QmB"}, {CID: "QmA"}} {
+		err := savePayment("order-"+d.CID, 1000, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// QmA was being pinned when the process went down, still claimed
+	pg.MustExec(`
+UPDATE payments SET claimed_at = now(), pinning_since = now() - interval '1 minute'
+WHERE order_id = 'order-QmA'
+    `)
+
+	err := releaseClaims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := claimPayments("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].OrderId != "order-QmA" || !payments[0].Resumed ||
+		payments[1].Resumed {
+		t.Fatalf("claimed %+v, want the interrupted pin first and resumed", payments)
+	}
+
+	for _, p := range payments {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = processClaimedPayment(ctx, p)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resumed, not duplicated: one pin, one object with the time paid once
+	if calls := node.called("pin/add"); strings.Join(calls, ",") != "QmA,QmB" {
+		t.Fatalf("pin/add called with %v, want QmA then QmB once each", calls)
+	}
+	var resumed struct {
+		Status   string  `db:"status"`
+		Pinning  bool    `db:"pinning"`
+		Events   int     `db:"events"`
+		Lifespan float64 `db:"lifespan"`
+	}
+	err = pg.Get(&resumed, `
+SELECT p.status, p.pinning_since IS NOT NULL AS pinning,
+  (SELECT count(*) FROM events WHERE cid = 'QmA' AND kind = 'pinned') AS events,
+  (SELECT extract(epoch FROM lifespan) FROM objects WHERE cid = 'QmA') AS lifespan
+FROM payments AS p WHERE order_id = 'order-QmA'
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Status != "pinned" || resumed.Pinning || resumed.Events != 1 ||
+		time.Duration(resumed.Lifespan)*time.Second != 24*time.Hour {
+		t.Fatalf("resumed payment = %+v, want pinned once for 24h", resumed)
+	}
+}
+
+func TestDedupeObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	// two rows for QmA, 23h and 48h left, and two for QmB from different paths
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan, notes, path) VALUES
+  ('QmA', 1, now() - interval '1 hour', interval '1 day', '{photos}', ''),
+  ('/ipfs/QmA', 1, now(), interval '2 days', '{videos}', ''),
+  ('QmB', 1, now(), interval '1 day', '{}', 'QmRoot/a'),
+  (' QmB', 1, now(), interval '1 day', '{}', 'QmRoot/b'),
+  ('QmC', 1, now(), interval '1 day', '{}', '');
+INSERT INTO payments (order_id, cid, amount, status) VALUES
+  ('order1', 'QmA', 1000, 'pinned'),
+  ('order2', '/ipfs/QmA', 2000, 'pinned');
+    `)
+
+	n, err := dedupeObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("dedupeObjects() = %d, want 1 merged", n)
+	}
+
+	var cids []string
+	err = pg.Select(&cids, `SELECT cid FROM objects ORDER BY cid COLLATE "C"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the conflicting QmB rows are left alone
+	if got := strings.Join(cids, ","); got != " QmB,QmA,QmB,QmC" {
+		t.Fatalf("objects = %q", got)
+	}
+
+	var merged struct {
+		Left  float64 `db:"left"`
+		Notes string  `db:"notes"`
+		Paid  int     `db:"paid"`
+	}
+	err = pg.Get(&merged, `
+SELECT extract(epoch FROM pinned_at + lifespan - now()) AS left,
+  array_to_string(notes, ',') AS notes,
+  (SELECT count(*) FROM payments WHERE cid = 'QmA') AS paid
+FROM objects WHERE cid = 'QmA'
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := time.Duration(merged.Left) * time.Second
+	if left < 71*time.Hour-time.Minute || left > 71*time.Hour {
+		t.Fatalf("merged object has %v left, want the 71h of both", left)
+	}
+	if merged.Notes != "photos,videos" || merged.Paid != 2 {
+		t.Fatalf("merged object = %+v, want the notes and payments of both", merged)
+	}
+}
+
+func TestHeldPayments(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+	useMemBackup(t)
+
+	node.sizes["QmA"] = 1 << 30
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process := func() string {
+		t.Helper()
+		err := processPayments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = waitBackground(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var status string
+		err = pg.Get(&status, `SELECT status FROM payments WHERE order_id = 'order1'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	err = holdPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := process(); got != "trying" || node.pinned("QmA") {
+		t.Fatalf("held payment processed: status %s, pinned %v", got, node.pinned("QmA"))
+	}
+
+	err = releasePayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := process(); got != "pinned" || !node.pinned("QmA") {
+		t.Fatalf("released payment: status %s, pinned %v, want it processed", got, node.pinned("QmA"))
+	}
+
+	if err := holdPayment("order1"); err != errPaymentProcessed {
+		t.Fatalf("holdPayment() of a processed payment = %v, want %v", err, errPaymentProcessed)
+	}
+	if err := releasePayment("order2"); err != errPaymentNotFound {
+		t.Fatalf("releasePayment() of an unknown payment = %v, want %v", err, errPaymentNotFound)
+	}
+}
+
+func TestPreviewRenewal(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmActive', 1, $1::timestamp - interval '1 hour', interval '1 day'),
+  -- ended a day ago, not erased yet
+  ('QmGrace', 1, $1::timestamp - interval '2 days', interval '1 day');
+    `, now)
+
+	tests := []struct {
+		cid     string
+		amount  int
+		want    time.Time
+		wantErr error
+	}{
+		{"QmActive", 1000, now.Add(47 * time.Hour), nil},
+		{"QmActive", 2000, now.Add(71 * time.Hour), nil},
+		// extended from when it ended, not from now
+		{"QmGrace", 1000, now, nil},
+		{"QmMissing", 1000, time.Time{}, errObjectNotFound},
+	}
+
+	for _, tt := range tests {
+		got, err := previewRenewal(tt.cid, tt.amount)
+		if err != tt.wantErr {
+			t.Errorf("previewRenewal(%s, %d) error = %v, want %v", tt.cid, tt.amount, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("previewRenewal(%s, %d) = %v, want %v", tt.cid, tt.amount, got, tt.want)
+		}
+	}
+
+	// nothing is renewed by previewing
+	var secs float64
+	err := pg.Get(&secs, `SELECT extract(epoch FROM lifespan) FROM objects WHERE cid = 'QmActive'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(secs) * time.Second; got != 24*time.Hour {
+		t.Fatalf("lifespan after previewing = %v, want 24h", got)
+	}
+}
+
+func TestEraseKeepsTombstone(t *testing.T) {
+	for _, keep := range []bool{true, false} {
+		t.Run(fmt.Sprint("keep ", keep), func(t *testing.T) {
+			useSettings(t, func(s *Settings) { s.KeepTombstones = keep })
+			useTestDB(t)
+			node := useFakeNode(t)
+
+			now := time.Now().UTC().Truncate(time.Second)
+			pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan)
+VALUES ('QmA', 2, $1::timestamp - interval '2 days', interval '1 day')
+            `, now)
+			node.pins["QmA"] = ""
+
+			err := eraseEnded()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ee, err := fetchErased("QmA")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !keep {
+				if len(ee) != 0 {
+					t.Fatalf("fetchErased() = %+v without keeping tombstones", ee)
+				}
+				return
+			}
+			if len(ee) != 1 {
+				t.Fatalf("fetchErased() = %+v, want a tombstone", ee)
+			}
+			e := ee[0]
+			if e.SizeGB != 2 || !e.PinnedAt.Equal(now.Add(-48*time.Hour)) ||
+				!e.EndsAt.Equal(now.Add(-24*time.Hour)) || e.ErasedAt.Before(now) {
+				t.Fatalf("tombstone = %+v", e)
+			}
+		})
+	}
+}
+
+func TestFindInconsistentObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+
+	pg.MustExec(`
+INSERT INTO payments (order_id, cid, amount, status, price_gb) VALUES
+  ('order1', 'QmConsistent', 1000, 'pinned', 1000),
+  ('order2', 'QmTampered', 1000, 'pinned', 1000),
+  ('order3', 'QmClose', 1000, 'pinned', 1000);
+-- paid before prices were recorded, can't be checked
+INSERT INTO payments (order_id, cid, amount, status) VALUES
+  ('order4', 'QmUnknown', 1000, 'pinned');
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmConsistent', 1, now(), interval '1 day'),
+  ('QmTampered', 1, now(), interval '3 days'),
+  ('QmClose', 1, now(), interval '24 hours 10 minutes'),
+  ('QmUnknown', 1, now(), interval '30 days');
+    `)
+
+	tests := []struct {
+		tolerance float64
+		want      string
+	}{
+		{0.01, "QmTampered"},
+		{0.001, "QmClose,QmTampered"},
+		{5, ""},
+	}
+
+	for _, tt := range tests {
+		oo, err := findInconsistentObjects(tt.tolerance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids := make([]string, len(oo))
+		for i, o := range oo {
+			cids[i] = o.CID
+		}
+		sort.Strings(cids)
+		if got := strings.Join(cids, ","); got != tt.want {
+			t.Errorf("findInconsistentObjects(%v) = %s, want %s", tt.tolerance, got, tt.want)
+		}
+	}
+}
+
+func TestZeroSizePin(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+	useMemBackup(t)
+
+	// empty content, and content the node says it stores nothing of
+	node.sizes["QmEmpty"] = 0
+	node.sizes["QmA"] = 1 << 30
+	node.stored["QmA"] = 0
+	for _, cid := range []string{"QmEmpty", "QmA"} {
+		err := savePayment("order-"+cid, 1000, orderDescription{CID: cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := processPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = waitBackground(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var empty struct {
+		Status string         `db:"status"`
+		Reason sql.NullString `db:"given_up_reason"`
+	}
+	err = pg.Get(&empty, `SELECT status, given_up_reason FROM payments WHERE order_id = 'order-QmEmpty'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Status != "given_up" || empty.Reason.String != "invalid" {
+		t.Fatalf("empty content payment = %+v, want given up as invalid", empty)
+	}
+	if node.pinned("QmEmpty") {
+		t.Fatal("empty content pinned")
+	}
+
+	// a zero measured size falls back to the estimate
+	var objects []struct {
+		CID      string  `db:"cid"`
+		SizeGB   float64 `db:"sizegb"`
+		Lifespan float64 `db:"lifespan"`
+	}
+	err = pg.Select(&objects, `SELECT cid, sizegb, extract(epoch FROM lifespan) AS lifespan FROM objects`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].CID != "QmA" || objects[0].SizeGB != 1 ||
+		time.Duration(objects[0].Lifespan)*time.Second != 24*time.Hour {
+		t.Fatalf("objects = %+v, want QmA only, 1 GB for 24h", objects)
+	}
+}
+
+func TestMeasuredSizeOverEstimate(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(s *Settings)
+		estimate   uint64
+		stored     uint64
+		amount     int
+		wantStatus string
+		wantReason string
+	}{
+		{"within the limits", nil, 1 << 29, 1 << 30, 1000, "pinned", ""},
+		{"over the payment", nil, 1 << 29, 2 << 30, 1000, "given_up", "too_large"},
+		{"absolutely too big", nil, 1 << 30, 11 << 30, 20000, "given_up", "too_large"},
+		{"over capacity", func(s *Settings) { s.MaxTotalGB = 1 }, 1 << 29, 2 << 30, 3000, "queued", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, tt.change)
+			useTestDB(t)
+			node := useFakeNode(t)
+			useMemBackup(t)
+
+			node.sizes["QmA"] = tt.estimate
+			node.stored["QmA"] = tt.stored
+			err := savePayment("order1", tt.amount, orderDescription{CID: "QmA"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = processPayment("order1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err = waitBackground(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var payment struct {
+				Status string         `db:"status"`
+				Reason sql.NullString `db:"given_up_reason"`
+			}
+			err = pg.Get(&payment, `SELECT status, given_up_reason FROM payments WHERE order_id = 'order1'`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payment.Status != tt.wantStatus || payment.Reason.String != tt.wantReason {
+				t.Fatalf("payment = %+v, want %s %s", payment, tt.wantStatus, tt.wantReason)
+			}
+
+			var objects []struct {
+				SizeGB   float64 `db:"sizegb"`
+				Lifespan float64 `db:"lifespan"`
+			}
+			err = pg.Select(&objects, `SELECT sizegb, extract(epoch FROM lifespan) AS lifespan FROM objects`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus != "pinned" {
+				if len(objects) != 0 || node.pinned("QmA") {
+					t.Fatalf("objects = %+v, pinned = %v, want neither", objects, node.pinned("QmA"))
+				}
+				return
+			}
+			// charged for what's stored, not the estimate
+			if len(objects) != 1 || objects[0].SizeGB != 1 ||
+				time.Duration(objects[0].Lifespan)*time.Second != 24*time.Hour {
+				t.Fatalf("objects = %+v, want 1 GB for 24h", objects)
+			}
+		})
+	}
+}
+
+func TestVerifyObjects(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	pg.MustExec(`
+INSERT INTO objects (cid, sizegb, pinned_at, lifespan) VALUES
+  ('QmHealthy', 1, now(), interval '1 day'),
+  ('QmDead', 1, now(), interval '1 day'),
+  -- ended, left for eraseEnded
+  ('QmEnded', 1, now() - interval '2 days', interval '1 day');
+    `)
+	node.sizes["QmHealthy"] = 1 << 20
+	node.sizes["QmEnded"] = 1 << 20
+
+	err := verifyObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []struct {
+		CID     string `db:"cid"`
+		Health  string `db:"health"`
+		Checked bool   `db:"checked"`
+	}
+	err = pg.Select(&rows, `
+SELECT cid, health, checked_at IS NOT NULL AS checked FROM objects ORDER BY cid
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(rows))
+	for i, r := range rows {
+		got[i] = fmt.Sprintf("%s %s %v", r.CID, r.Health, r.Checked)
+	}
+	want := "QmDead dead true,QmEnded healthy false,QmHealthy healthy true"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("objects = %v, want %s", got, want)
+	}
+}
+
+func TestCancelMidPin(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.sizes["QmA"] = 1 << 30
+	pinning := make(chan struct{})
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd != "pin/add" {
+			return false
+		}
+		// a big dag, fetched until the request is aborted
+		close(pinning)
+		<-r.Context().Done()
+		return true
+	}
+	err := savePayment("order1", 1000, orderDescription{CID: "QmA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processed := make(chan error, 1)
+	go func() { processed <- processPayment("order1") }()
+
+	select {
+	case <-pinning:
+	case <-time.After(time.Second):
+		t.Fatal("pin never started")
+	}
+	err = cancelPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-processed:
+	case <-time.After(time.Second):
+		t.Fatal("pin wasn't aborted")
+	}
+
+	var n int
+	err = pg.Get(&n, `SELECT count(*) FROM objects`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("%d objects saved for a cancelled payment", n)
+	}
+	var status string
+	err = pg.Get(&status, `SELECT status FROM payments WHERE order_id = 'order1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "cancelled" {
+		t.Fatalf("status = %s, want cancelled", status)
+	}
+	if node.pinned("QmA") {
+		t.Fatal("QmA pinned for a cancelled payment")
+	}
+}
+
+func TestPinSubPath(t *testing.T) {
+	useSettings(t, nil)
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	// a 4 GB directory, of which only a 1 GB file is wanted
+	node.sizes["QmDir"] = 4 << 30
+	node.sizes["QmSub"] = 1 << 30
+	err := savePayment("order1", 1000, orderDescription{CID: "QmSub", Path: "QmDir/docs/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processPayment("order1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pins := node.called("pin/add"); strings.Join(pins, ",") != "QmSub" {
+		t.Fatalf("pinned %v, want only the selected QmSub", pins)
+	}
+	o, err := fetchObject("QmSub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o == nil {
+		t.Fatal("no object saved")
+	}
+	// charged for the part, 1 GB for a day
+	if o.SizeGB != 1 || o.Path != "QmDir/docs/a.txt" {
+		t.Fatalf("object = %+v, want 1 GB selected from QmDir/docs/a.txt", o)
+	}
+	if d := o.EndsAt.Sub(o.PinnedAt); d != 24*time.Hour {
+		t.Fatalf("lifespan = %s, want 24h", d)
+	}
+}
+
+func TestProcessPaymentsTimeout(t *testing.T) {
+	useSettings(t, func(s *Settings) { s.ProcessBatchTimeout = 300 * time.Millisecond })
+	useTestDB(t)
+	node := useFakeNode(t)
+
+	node.sizes["QmFast"] = 1 << 30
+	node.sizes["QmSlow"] = 1 << 30
+	node.handle = func(w http.ResponseWriter, r *http.Request, call fakeCall) bool {
+		if call.Cmd == "pin/add" && call.Arg == "QmSlow" {
+			// fetching for far longer than the batch may take
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return true
+		}
+		return false
+	}
+	for _, cid := range []string{"QmFast", "QmSlow"} {
+		err := savePayment("order-"+cid, 1000, orderDescription{CID: cid})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	err := processPayments()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("processPayments() = %v, want a timeout", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("processPayments() took %s with a 300ms timeout", took)
+	}
+
+	// the slow pin is cancelled and left for the next batch
+	var st struct {
+		Status  string `db:"status"`
+		Claimed bool   `db:"claimed"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err = pg.Get(&st, `
+SELECT status, claimed_at IS NOT NULL AS claimed FROM payments WHERE order_id = 'order-QmSlow'
+        `)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !st.Claimed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if st.Status != "trying" || st.Claimed {
+		t.Fatalf("slow payment = %+v, want it trying and unclaimed", st)
+	}
+	if node.pinned("QmSlow") {
+		t.Fatal("slow pin finished")
+	}
+	if !node.pinned("QmFast") {
+		t.Fatal("fast pin didn't finish within the batch")
+	}
+}